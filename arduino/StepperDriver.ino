@@ -6,6 +6,9 @@
 // comment out to disable PENUP support
 #define ENABLE_PENUP
 
+// comment out to disable wide slices, the host checks the status report before sending them when WideSteps is set
+#define ENABLE_WIDE_STEPS
+
 // Constants and global variables
 // --------------------------------------
 const int LED_PINS_COUNT = 4;
@@ -15,18 +18,24 @@ const int LEFT_STEP_PIN = 7;
 const int LEFT_DIR_PIN = 6;
 const int RIGHT_STEP_PIN = 9;
 const int RIGHT_DIR_PIN = 10;
+const int MOTOR_ENABLE_PIN = 12; // connected to the enable input of both stepper drivers, active low
 
 #ifdef ENABLE_PENUP
 #include <Servo.h>
 Servo penUpServo;
 char penTransitionDirection; // -1, 0, 1
+int penTargetAngle; // angle the servo is moving to
 const int PENUP_SERVO_PIN = 5;
 const long PENUP_TRANSITION_US = 524288; // time to go from pen up to down, or down to up
 const int PENUP_TRANSITION_US_LOG = 19; // 2^19 = 524288
-const long PENUP_COOLDOWN_US = 1250000;
-const long PENUP_ANGLE = 40;
-const long PENDOWN_ANGLE = 140;
+const long PENUP_COOLDOWN_US = 1250000; // default time to wait after lifting or dropping the pen
+long penLiftDelay_US; // time to wait after lifting the pen, set by PEN_TIMING_COMMAND
+long penDropDelay_US; // time to wait after dropping the pen, set by PEN_TIMING_COMMAND
 #endif
+const int DEFAULT_PENUP_ANGLE = 40; // used until the host sends a PEN_HEIGHT_COMMAND, matches PenUpAngle in gocupi_config.xml
+const int DEFAULT_PENDOWN_ANGLE = 140; // matches PenDownAngle in gocupi_config.xml
+int penUpAngle = DEFAULT_PENUP_ANGLE; // last angle sent that lifts the pen, used by the legacy PENUP command
+int penDownAngle = DEFAULT_PENDOWN_ANGLE; // last angle sent that lowers the pen, used by the legacy PENDOWN command
 
 const unsigned int TIME_SLICE_US = 2048; // number of microseconds per time step
 const unsigned int TIME_SLICE_US_LOG = 11; // log base 2 of TIME_SLICE_US
@@ -34,8 +43,25 @@ const unsigned int POS_FACTOR = 32; // fixed point factor each position is multi
 const unsigned int POS_FACTOR_LOG = 5; // log base 2 of POS_FACTOR, used after multiplying two fixed point numbers together
 
 const char RESET_COMMAND = 0x80; // -128, command to reset
-const char PENUP_COMMAND = 0x81; // -127, command to lift pen
-const char PENDOWN_COMMAND = 0x7F; // 127, command to lower pen
+const char COMMAND_PREFIX = 0x81; // -127, marks a command frame, the next byte is the command followed by its arguments
+const char LEGACY_PENDOWN = 0x7F; // 127, original encoding of pen down, still accepted
+
+// commands that can follow COMMAND_PREFIX, each argument is sent as two 7 bit bytes
+const char WIDE_SLICE_COMMAND = 0x01; // args: left delta, right delta
+const char PEN_HEIGHT_COMMAND = 0x02; // args: servo angle, 1 if the angle lifts the pen off the surface
+const char DWELL_COMMAND = 0x03; // args: milliseconds
+const char MOTOR_ENABLE_COMMAND = 0x04; // args: 1 to enable, 0 to disable
+const char SET_POSITION_COMMAND = 0x05; // args: left high, left low, right high, right low
+const char PEN_TIMING_COMMAND = 0x06; // args: milliseconds to wait after lifting, milliseconds to wait after dropping
+const char PENUP_COMMAND = 0x81; // -127, no args, same as COMMAND_PREFIX so the frame matches the original pen up encoding
+const char PENDOWN_COMMAND = 0x7F; // 127, no args
+
+const byte STATUS_HEADER = 0xA5; // first byte of a status report, never a valid data request size
+const int STATUS_LENGTH = 12; // header, buffer length (2), left position (4), right position (4), flags
+const byte STATUS_PENUP_FLAG = 0x01;
+const byte STATUS_ERROR_FLAG = 0x02;
+const byte STATUS_WIDE_STEPS_FLAG = 0x04;
+const unsigned long STATUS_INTERVAL_US = 262144; // time between status reports
 
 const unsigned int MOVE_DATA_CAPACITY = 1024;
 char moveData[MOVE_DATA_CAPACITY]; // buffer of move data, circular buffer
@@ -43,12 +69,18 @@ unsigned int moveDataStart = 0; // where data is currently being read from
 unsigned int moveDataLength = 0; // the number of items in the moveDataBuffer
 unsigned int moveDataRequestPending = 0; // number of bytes requested
 
-char leftDelta, rightDelta; // delta in the current slice
+int leftDelta, rightDelta; // delta in the current slice
 long leftStartPos, rightStartPos; // start position for this slice
 long leftCurPos, rightCurPos; // current position of the spools
 
 unsigned long curTime; // current time in microseconds
 unsigned long sliceStartTime; // start of current slice in microseconds
+unsigned long statusSentTime; // time the last status report was sent
+
+unsigned long dwellDuration_US; // time remaining in the current dwell, 0 if not dwelling
+
+boolean penUp; // current pen state as reported in the status
+boolean moveDataError; // set when move data is dropped because the buffer was full
 
 
 // setup
@@ -66,14 +98,16 @@ void setup() {
   pinMode(LEFT_DIR_PIN, OUTPUT);
   pinMode(RIGHT_STEP_PIN, OUTPUT);
   pinMode(RIGHT_DIR_PIN, OUTPUT);	
+  pinMode(MOTOR_ENABLE_PIN, OUTPUT);
+  digitalWrite(MOTOR_ENABLE_PIN, LOW);
 
 #ifdef ENABLE_PENUP
   penUpServo.attach(PENUP_SERVO_PIN);
-  penUpServo.write(PENUP_ANGLE);
+  penUpServo.write(penUpAngle);
   delay(1000);
-  penUpServo.write(PENDOWN_ANGLE);
+  penUpServo.write(penDownAngle);
   delay(1000);
-  penUpServo.write(PENUP_ANGLE);
+  penUpServo.write(penUpAngle);
 #endif  
 
   ResetMovementVariables();
@@ -89,10 +123,16 @@ void ResetMovementVariables()
 {
   leftDelta = rightDelta = leftStartPos = rightStartPos = leftCurPos = rightCurPos = 0;
   sliceStartTime = curTime;
+  penUp = true;
+  moveDataError = false;
+  dwellDuration_US = 0;
+  digitalWrite(MOTOR_ENABLE_PIN, LOW);
 
 #ifdef ENABLE_PENUP
   penTransitionDirection = 0;
-  penUpServo.write(PENUP_ANGLE);
+  penTargetAngle = penUpAngle;
+  penLiftDelay_US = penDropDelay_US = PENUP_COOLDOWN_US;
+  penUpServo.write(penUpAngle);
 #endif  
 }
 
@@ -106,35 +146,33 @@ void loop() {
 
   long curSliceTime = curTime - sliceStartTime;
 
-#ifdef ENABLE_PENUP
-  if (penTransitionDirection) {
-    UpdatePenTransition(curSliceTime);
-    if (!penTransitionDirection) {
+  if (IsWaiting()) {
+    UpdateWaiting(curSliceTime);
+    if (!IsWaiting()) {
       sliceStartTime = curTime;
     }
   } else {	
-#endif
     // move to next slice if necessary
     while(curSliceTime > TIME_SLICE_US) {
       SetSliceVariables();
       curSliceTime -= TIME_SLICE_US;
       sliceStartTime += TIME_SLICE_US;
 
-#ifdef ENABLE_PENUP	
-      if (penTransitionDirection) {
+      if (IsWaiting()) {
         sliceStartTime = curTime;
         return;
       }
-#endif      
     }
 	
     UpdateStepperPins(curSliceTime);
-#ifdef ENABLE_PENUP    
   }
-#endif  
 
   ReadSerialMoveData();
   RequestMoreSerialMoveData();
+
+  if (curTime - statusSentTime > STATUS_INTERVAL_US) {
+    SendStatus();
+  }
 }
 
 // Update stepper pins
@@ -188,6 +226,46 @@ void UpdateStepperPins(long curSliceTime) {
   } while(true);
 }
 
+// True while movement is stopped for a pen transition or a dwell
+// --------------------------------------
+boolean IsWaiting() {
+#ifdef ENABLE_PENUP
+  if (penTransitionDirection) {
+    return true;
+  }
+#endif
+  return dwellDuration_US > 0;
+}
+
+// Finish the pen transition or dwell once enough time has passed
+// --------------------------------------
+void UpdateWaiting(long curSliceTime) {
+#ifdef ENABLE_PENUP
+  if (penTransitionDirection) {
+    UpdatePenTransition(curSliceTime);
+    return;
+  }
+#endif
+  if (curSliceTime > dwellDuration_US) {
+    dwellDuration_US = 0;
+  }
+}
+
+// Start moving the pen to the given servo angle, only raising or lowering the pen waits for the servo
+// --------------------------------------
+void MovePen(int angle, boolean up) {
+  boolean transition = up != penUp;
+  penUp = up;
+#ifdef ENABLE_PENUP
+  penTargetAngle = angle;
+  if (transition) {
+    penTransitionDirection = up ? 1 : -1;
+  } else {
+    penUpServo.write(penTargetAngle); // small pressure changes while drawing don't stop movement
+  }
+#endif
+}
+
 // Update pen position
 // --------------------------------------
 #ifdef ENABLE_PENUP
@@ -197,19 +275,13 @@ void UpdatePenTransition(long curSliceTime) {
   //if (targetAngle > PENDOWN_ANGLE) {
     //targetAngle = PENDOWN_ANGLE;
     
-    if (curSliceTime > PENUP_COOLDOWN_US) {
+    long penDelay_US = penTransitionDirection > 0 ? penLiftDelay_US : penDropDelay_US;
+    if (curSliceTime > penDelay_US) {
       penTransitionDirection = 0; // are done moving the pen servo
     }
   //}
 
-  if (penTransitionDirection == 1) {
-	//targetAngle = 180 - targetAngle;
-    penUpServo.write(PENUP_ANGLE);
-  } else if (penTransitionDirection == -1) {
-    penUpServo.write(PENDOWN_ANGLE);
-  }
-
-  //penUpServo.write(targetAngle);
+  penUpServo.write(penTargetAngle);
 }
 #endif
 
@@ -244,28 +316,132 @@ void SetSliceVariables() {
   leftStartPos = leftStartPos + long(leftDelta);
   rightStartPos = rightStartPos + long(rightDelta);
 
+  leftDelta = rightDelta = 0;
+
   if (moveDataLength < 2) {
-    leftDelta = rightDelta = 0;
+    return;
+  }
+
+  if (MoveDataPeek(0) == LEGACY_PENDOWN) {
+    MoveDataGet();
+    MoveDataGet();
+    MovePen(penDownAngle, false);
+  } else if (MoveDataPeek(0) == COMMAND_PREFIX) {
+    // wait for the rest of the command if it was split across two requests
+    char command = MoveDataPeek(1);
+    if (moveDataLength < CommandLength(command)) {
+      return;
+    }
+    MoveDataGet();
+    MoveDataGet();
+    ExecuteCommand(command);
   } else {
     leftDelta = MoveDataGet();
     rightDelta = MoveDataGet();
-    
-#ifdef ENABLE_PENUP	
-    if (leftDelta == PENUP_COMMAND) {
-      leftDelta = rightDelta = 0;
-      penTransitionDirection = 1;
-    } else if (leftDelta == PENDOWN_COMMAND) {
-      leftDelta = rightDelta = 0;
-      penTransitionDirection = -1;
+  }
+}
+
+// Number of bytes in a command frame, including the prefix and command
+// --------------------------------------
+unsigned int CommandLength(char command) {
+  switch (command) {
+  case WIDE_SLICE_COMMAND:
+  case PEN_HEIGHT_COMMAND:
+  case PEN_TIMING_COMMAND:
+    return 6;
+  case DWELL_COMMAND:
+  case MOTOR_ENABLE_COMMAND:
+    return 4;
+  case SET_POSITION_COMMAND:
+    return 10;
+  default:
+    return 2;
+  }
+}
+
+// Run a command whose prefix and command bytes have already been removed from the buffer
+// --------------------------------------
+void ExecuteCommand(char command) {
+  switch (command) {
+#ifdef ENABLE_WIDE_STEPS
+  case WIDE_SLICE_COMMAND:
+    leftDelta = ReadWideValue();
+    rightDelta = ReadWideValue();
+    break;
+#endif
+
+  case PENUP_COMMAND:
+    MovePen(penUpAngle, true);
+    break;
+
+  case PENDOWN_COMMAND:
+    MovePen(penDownAngle, false);
+    break;
+
+  case PEN_HEIGHT_COMMAND: {
+      int angle = ReadWideValue();
+      boolean up = ReadWideValue() != 0;
+      if (up) {
+        penUpAngle = angle;
+      } else {
+        penDownAngle = angle;
+      }
+      MovePen(angle, up);
+      break;
     }
-#else
-    if (leftDelta == PENUP_COMMAND || leftDelta == PENDOWN_COMMAND) {
-       leftDelta = rightDelta = 0;
+
+  case PEN_TIMING_COMMAND: {
+      long liftDelay_US = long(ReadWideValue()) * 1000;
+      long dropDelay_US = long(ReadWideValue()) * 1000;
+#ifdef ENABLE_PENUP
+      penLiftDelay_US = liftDelay_US;
+      penDropDelay_US = dropDelay_US;
+#endif
+      break;
     }
-#endif    
+
+  case DWELL_COMMAND:
+    dwellDuration_US = long(ReadWideValue()) * 1000;
+    break;
+
+  case MOTOR_ENABLE_COMMAND:
+    digitalWrite(MOTOR_ENABLE_PIN, ReadWideValue() ? LOW : HIGH);
+    break;
+
+  case SET_POSITION_COMMAND:
+    leftStartPos = leftCurPos = ReadLongValue();
+    rightStartPos = rightCurPos = ReadLongValue();
+    break;
+
+  default:
+    // unknown or disabled command, skip its arguments and flag it since the drawing won't match what was sent
+    for (unsigned int i = 2; i < CommandLength(command); i++) {
+      MoveDataGet();
+    }
+    moveDataError = true;
+    break;
   }
 }                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                    
 
+// Read a 14 bit two's complement value sent as high 7 bits then low 7 bits
+// --------------------------------------
+int ReadWideValue() {
+  int value = MoveDataGet() << 7;
+  value |= MoveDataGet();
+  if (value & 0x2000) {
+    value -= 0x4000;
+  }
+  return value;
+}
+
+// Read a 28 bit value sent as two wide values, the high 14 bits then the low 14 bits
+// --------------------------------------
+long ReadLongValue() {
+  long value = long(ReadWideValue()) << 14;
+  value |= ReadWideValue() & 0x3FFF;
+  return value;
+}
+
 // Stop everything and blink the status led value times
 // --------------------------------------
 void Blink(char value) {
@@ -296,6 +472,7 @@ void ReadSerialMoveData() {
       moveDataRequestPending = 0;
       moveDataLength = 0;
       UpdateReceiveLed(false);
+      SendStatus();
       return;
     }
 
@@ -319,6 +496,7 @@ void MoveDataPut(char value) {
   moveData[writePosition] = value;
 
   if (moveDataLength == MOVE_DATA_CAPACITY) { // full, overwrite existing data
+    moveDataError = true;
     moveDataStart++;
     if (moveDataStart == MOVE_DATA_CAPACITY) {
       moveDataStart = 0;
@@ -346,6 +524,20 @@ char MoveDataGet() {
   return result;
 }
 
+// Return a piece of data from the moveData buffer without removing it, offset is relative to the start of the buffer
+// --------------------------------------
+char MoveDataPeek(unsigned int offset) {
+  if (offset >= moveDataLength) {
+    return 0;
+  }
+
+  unsigned int readPosition = moveDataStart + offset;
+  if (readPosition >= MOVE_DATA_CAPACITY) {
+    readPosition = readPosition - MOVE_DATA_CAPACITY;
+  }
+  return moveData[readPosition];
+}
+
 // Return the amount of data sitting in the moveData buffer
 // --------------------------------------
 void RequestMoreSerialMoveData() {
@@ -358,4 +550,28 @@ void RequestMoreSerialMoveData() {
   UpdateReceiveLed(true);
 }
 
+// Send the current buffer length, spool positions and pen state back to the host
+// --------------------------------------
+void SendStatus() {
+  byte status[STATUS_LENGTH];
+  status[0] = STATUS_HEADER;
+  status[1] = moveDataLength & 0xFF;
+  status[2] = moveDataLength >> 8;
+  for (int i = 0; i < 4; i++) {
+    status[3 + i] = (leftCurPos >> (8 * i)) & 0xFF;
+    status[7 + i] = (rightCurPos >> (8 * i)) & 0xFF;
+  }
+  status[11] = 0;
+#ifdef ENABLE_WIDE_STEPS
+  status[11] |= STATUS_WIDE_STEPS_FLAG;
+#endif
+  if (penUp) {
+    status[11] |= STATUS_PENUP_FLAG;
+  }
+  if (moveDataError) {
+    status[11] |= STATUS_ERROR_FLAG;
+  }
 
+  Serial.write(status, STATUS_LENGTH);
+  statusSentTime = curTime;
+}
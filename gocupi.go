@@ -7,6 +7,7 @@ import (
 	. "github.com/brandonagr/gocupi/polargraph"
 	"github.com/qpliu/qrencode-go/qrencode"
 	"math"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -21,14 +22,36 @@ func init() {
 func main() {
 	Settings.Read()
 
-	pauseOnPenUp := flag.Bool("pause", false, "Pause when pen is raised (requires keyboard input)")
+	pauseOnPenUp := flag.Bool("pause", false, "Pause when pen is raised, resume by pressing enter")
+	controlAddress := flag.String("control", "", "Listen on this address (ie localhost:7070) for pause, resume, abort and nudge commands while plotting")
+	listenAddress := flag.String("listen", "127.0.0.1:8080", "Address serve listens on, use :8080 to accept connections from other machines")
+	tokenFlag := flag.String("token", "", "Token serve and -control require, use one when either accepts connections from other machines")
 	toImageFlag := flag.Bool("toimage", false, "Output result to an image file instead of to the stepper")
+	realisticFlag := flag.Bool("realistic", false, "With -toimage render the pen's width and colour on the drawing surface, with the spools and starting position")
+	stepAccurateFlag := flag.Bool("stepaccurate", false, "With -toimage replay the generated steps and draw them over the intended path, highlighting deviations")
+	toleranceFlag := flag.Float64("tolerance", 0.2, "Distance in mm from the intended path that -stepaccurate highlights")
+	toSvgFlag := flag.Bool("tosvg", false, "Output result to an svg file that can be zoomed in a browser instead of to the stepper")
+	toSvgArtworkFlag := flag.Bool("toSvgArtwork", false, "Output the pen down strokes to a plain svg in mm that can be edited and drawn again with the svg command")
+	toPathsFlag := flag.Bool("topaths", false, "Output the pen down strokes as a json or csv list of strokes that the paths command can read")
+	toGcodeFlag := flag.Bool("togcode", false, "Output result to a gcode file of G0 and G1 moves instead of to the stepper")
+	gcodePenUpFlag := flag.String("gcodepenup", "", "Line -togcode writes to raise the pen, defaults to the code GcodePenMode reads")
+	gcodePenDownFlag := flag.String("gcodependown", "", "Line -togcode writes to lower the pen, defaults to the code GcodePenMode reads")
 	toFileFlag := flag.Bool("tofile", false, "Output steps to a text file")
 	toChartFlag := flag.Bool("tochart", false, "Output a chart of the movement and velocity")
+	toAnimationFlag := flag.Bool("toanimation", false, "Replay the step data as the arduino would and output an animated gif, or numbered pngs when -output is a .png")
+	timeStepFlag := flag.Float64("timestep", 0, "Seconds of plotting between -toanimation frames, defaults to a step that gives 100 frames")
+	outputFlag := flag.String("output", "", "File written by -toimage, -tosvg, -toSvgArtwork, -topaths, -togcode, -tochart, -toanimation and -tofile, defaults to output.png, output.svg, artwork.svg, paths.json, output.gcode, chart.png, animation.gif and stepData.txt")
+	formatFlag := flag.String("format", "", "Format of -toimage and -tochart output, png, jpeg, svg or pdf, defaults to the extension of -output")
+	dpiFlag := flag.Float64("dpi", DefaultPixelsPerMM*25.4, "Resolution of -toimage and -toanimation output in dots per inch")
+	chartWidthFlag := flag.Float64("chartwidth", 14, "Width of -tochart output in inches")
+	chartHeightFlag := flag.Float64("chartheight", 8.5, "Height of -tochart output in inches")
+	chartSlicesFlag := flag.Int("chartslices", 1500, "Number of time slices shown by -tochart")
 	countFlag := flag.Bool("count", false, "Outputs the time it would take to draw")
+	reportFlag := flag.Bool("report", false, "Outputs a breakdown of distance, time, ink and bounds, also written to report.json")
 	speedSlowFactor := flag.Float64("slowfactor", 1.0, "Divide max speed by this number")
 	flipXFlag := flag.Bool("flipx", false, "Flip the drawing left to right")
 	flipYFlag := flag.Bool("flipy", false, "Flip the drawing top to bottom")
+	pressureFlag := flag.Bool("pressure", false, "Draw image darkness by varying pen pressure, used by imagearc and imageraster")
 	flag.Parse()
 
 	if *speedSlowFactor < 1.0 {
@@ -45,12 +68,10 @@ func main() {
 		return
 	}
 
-	plotCoords := make(chan Coordinate, 1024)
 	var err error
 	var params []float64
 
 	switch args[0] {
-
 	case "help":
 		if len(args) != 2 {
 			PrintGenericHelp()
@@ -59,6 +80,353 @@ func main() {
 		}
 		return
 
+	case "motors":
+		if len(args) != 2 || (strings.ToLower(args[1]) != "on" && strings.ToLower(args[1]) != "off") {
+			fmt.Println("ERROR: Expected on or off")
+			fmt.Println()
+			PrintCommandHelp("motors")
+			return
+		}
+
+		stepData := make(chan int8, 16)
+		SendMotorEnable(strings.ToLower(args[1]) == "on", stepData)
+		close(stepData)
+		WriteStepsToSerial(stepData, nil, false, nil, nil)
+		return
+
+	case "move":
+		PerformMouseTracking()
+		return
+
+	case "setup":
+		if params, err = GetArgsAsFloats(args[1:], 3, false); err != nil {
+			fmt.Println("ERROR: ", err)
+			fmt.Println()
+			PrintCommandHelp("setup")
+			return
+		}
+
+		if params[0] != 0 {
+			Settings.SpoolHorizontalDistance_MM = params[0]
+		} else {
+			fmt.Println("Using existing SpoolHorizontalDistance_MM of", Settings.SpoolHorizontalDistance_MM)
+		}
+		if params[1] != 0 {
+			Settings.StartingLeftDist_MM = params[1]
+		} else {
+			fmt.Println("Using existing StartingLeftDist_MM of", Settings.StartingLeftDist_MM)
+		}
+		if params[2] != 0 {
+			Settings.StartingRightDist_MM = params[2]
+		} else {
+			fmt.Println("Using existing StartingRightDist_MM of", Settings.StartingRightDist_MM)
+		}
+
+		if Settings.SpoolHorizontalDistance_MM > (Settings.StartingLeftDist_MM + Settings.StartingRightDist_MM) {
+			fmt.Println("ERROR: Attempted to specify a setup where the two string distances are less than the distance between idlers")
+			return
+		}
+
+		Settings.CalculateDerivedFields()
+
+		polarSystem := PolarSystemFromSettings()
+		polarPos := PolarCoordinate{LeftDist: Settings.StartingLeftDist_MM, RightDist: Settings.StartingRightDist_MM}
+		pos := polarPos.ToCoord(polarSystem)
+
+		if pos.X < Settings.DrawingSurfaceMinX_MM || pos.X > Settings.DrawingSurfaceMaxX_MM || pos.Y < Settings.DrawingSurfaceMinY_MM || pos.Y > Settings.DrawingSurfaceMaxY_MM {
+			fmt.Println("ERROR: The specified settings result in a pen position that exceeds the DrawingSurfaceMin/Max as defined in gocupi_config.xml")
+			fmt.Printf("Initial X,Y position of pen would have been %.3f, %.3f", pos.X, pos.Y)
+			fmt.Println()
+		} else {
+			fmt.Printf("Initial X,Y position of pen is %.3f, %.3f", pos.X, pos.Y)
+			fmt.Println()
+			Settings.Write()
+		}
+
+		return
+
+	case "spool":
+		if len(args) == 3 {
+
+			leftSpool := strings.ToLower(args[1]) == "l"
+			if params, err = GetArgsAsFloats(args[2:], 1, true); err != nil {
+				fmt.Println("ERROR: ", err)
+				fmt.Println()
+				PrintCommandHelp("spool")
+				return
+			}
+
+			MoveSpool(leftSpool, params[0])
+		} else {
+			InteractiveMoveSpool()
+		}
+		return
+
+	case "serve":
+		ServePlotJobs(*listenAddress, *tokenFlag, jobGenerator(*pressureFlag, *flipXFlag, *flipYFlag))
+		return
+
+	case "queue":
+		if err = RunQueueCommand(args[1:], jobGenerator(*pressureFlag, *flipXFlag, *flipYFlag), *controlAddress, *tokenFlag); err != nil {
+			fmt.Println("ERROR: ", err)
+			fmt.Println()
+			PrintCommandHelp("queue")
+		}
+		return
+	}
+
+	generation := NewGeneration()
+	plotCoords, err := GeneratePlotCoords(args, *pressureFlag, generation)
+	if err == errUnknownCommand {
+		PrintGenericHelp()
+		return
+	} else if err != nil {
+		fmt.Println("ERROR: ", err)
+		fmt.Println()
+		PrintCommandHelp(args[0])
+		return
+	}
+	plotCoords = FlipIfRequested(*flipXFlag, *flipYFlag, plotCoords)
+
+	// where previews and charts are written
+	outputOptions := DefaultOutputOptions(*outputFlag)
+	outputOptions.Format = *formatFlag
+	outputOptions.PixelsPerMM = PixelsPerMMFromDPI(*dpiFlag)
+	outputOptions.ChartWidth_In = *chartWidthFlag
+	outputOptions.ChartHeight_In = *chartHeightFlag
+	outputOptions.ChartSlices = *chartSlicesFlag
+	switch {
+	case *toImageFlag:
+		outputOptions = outputOptions.WithDefaultName("output.png")
+	case *toSvgFlag:
+		outputOptions = outputOptions.WithDefaultName("output.svg")
+		if outputOptions.Format == "" {
+			outputOptions.Format = "svg"
+		}
+	case *toChartFlag:
+		outputOptions = outputOptions.WithDefaultName("chart.png")
+	case *toAnimationFlag:
+		if outputOptions.FileName == "" {
+			outputOptions.FileName = "animation.gif"
+		}
+		if ext := strings.ToLower(filepath.Ext(outputOptions.FileName)); ext != ".gif" && ext != ".png" {
+			fmt.Println("ERROR: -toanimation writes a .gif, or numbered .png files")
+			return
+		}
+	}
+	if *toImageFlag || *toSvgFlag || *toChartFlag {
+		if format, err := outputOptions.ResolvedFormat(); err != nil {
+			fmt.Println("ERROR: ", err)
+			return
+		} else if *toSvgFlag && format != "svg" {
+			fmt.Println("ERROR: -tosvg only writes svg, use -toimage for other formats")
+			return
+		}
+	}
+	if outputOptions.PixelsPerMM <= 0 || outputOptions.ChartSlices <= 0 {
+		fmt.Println("ERROR: -dpi and -chartslices must be greater than 0")
+		return
+	}
+
+	if *toImageFlag {
+		fmt.Println("Outputting to", outputOptions.FileName)
+		if *stepAccurateFlag {
+			DrawStepAccurateImage(outputOptions, *toleranceFlag, plotCoords)
+		} else if *realisticFlag {
+			DrawRealisticImage(outputOptions, plotCoords)
+		} else {
+			DrawToImage(outputOptions, plotCoords)
+		}
+		reportGenerationError(generation)
+		return
+	}
+	if *toSvgFlag {
+		fmt.Println("Outputting to", outputOptions.FileName)
+		DrawToSvg(outputOptions.FileName, plotCoords)
+		reportGenerationError(generation)
+		return
+	}
+
+	if *toSvgArtworkFlag {
+		artworkFile := *outputFlag
+		if artworkFile == "" {
+			artworkFile = "artwork.svg"
+		}
+		fmt.Println("Outputting to", artworkFile)
+		DrawToSvgArtwork(artworkFile, plotCoords)
+		reportGenerationError(generation)
+		return
+	}
+	if *toPathsFlag {
+		pathsFile := *outputFlag
+		if pathsFile == "" {
+			pathsFile = "paths.json"
+		}
+		if ext := strings.ToLower(filepath.Ext(pathsFile)); ext != ".json" && ext != ".csv" {
+			fmt.Println("ERROR: -topaths writes a .json or .csv file")
+			return
+		}
+		fmt.Println("Outputting to", pathsFile)
+		DrawToPaths(pathsFile, plotCoords)
+		reportGenerationError(generation)
+		return
+	}
+	if *toGcodeFlag {
+		penMode, err := ParseGcodePenMode(Settings.GcodePenMode)
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			return
+		}
+		gcodeOptions := DefaultGcodeWriterOptions(penMode)
+		if *gcodePenUpFlag != "" {
+			gcodeOptions.PenUp = *gcodePenUpFlag
+		}
+		if *gcodePenDownFlag != "" {
+			gcodeOptions.PenDown = *gcodePenDownFlag
+		}
+
+		gcodeFile := *outputFlag
+		if gcodeFile == "" {
+			gcodeFile = "output.gcode"
+		}
+		fmt.Println("Outputting to", gcodeFile)
+		DrawToGcode(gcodeFile, gcodeOptions, plotCoords)
+		reportGenerationError(generation)
+		return
+	}
+
+	// output the max speed and acceleration
+	fmt.Println()
+	fmt.Printf("MaxSpeed: %.3f mm/s Accel: %.3f mm/s^2", Settings.MaxSpeed_MM_S, Settings.Acceleration_MM_S2)
+	fmt.Println()
+
+	stepData := make(chan int8, 1024)
+	go GenerateSteps(plotCoords, stepData)
+	switch {
+	case *countFlag:
+		CountSteps(stepData)
+		reportGenerationError(generation)
+	case *reportFlag:
+		ReportSteps(stepData)
+		reportGenerationError(generation)
+	case *toFileFlag:
+		stepFile := *outputFlag
+		if stepFile == "" {
+			stepFile = "stepData.txt"
+		}
+		WriteStepsToFile(stepFile, stepData)
+	case *toChartFlag:
+		WriteStepsToChart(outputOptions, stepData)
+	case *toAnimationFlag:
+		WriteStepsToAnimation(outputOptions, *timeStepFlag, stepData)
+	default:
+		// plot can be controlled from the keyboard or a socket, WriteStepsToSerial also listens for signals
+		controls := make(chan PlotCommand)
+		if *controlAddress != "" {
+			go ReadPlotCommandsFromSocket(*controlAddress, *tokenFlag, controls)
+		}
+		if ReadsStdin(args) {
+			// stdin is the drawing, so commands can only come from signals or -control
+			fmt.Println("Drawing read from stdin, use -control or SIGUSR1, SIGUSR2 and SIGTERM to pause, resume and abort")
+		} else {
+			go ReadPlotCommandsFromKeyboard(controls)
+			fmt.Println("While plotting enter pause, resume, abort, or nudge DX DY")
+		}
+
+		WriteStepsToSerial(stepData, generation, *pauseOnPenUp, controls, nil)
+	}
+}
+
+// Print why the drawing stopped part way through, if it did, once all of it has been read
+func reportGenerationError(generation *Generation) {
+	if err := generation.Err(); err != nil {
+		fmt.Println("ERROR: Drawing stopped part way through, the output is incomplete:", err)
+	}
+}
+
+// Generator for queued jobs that applies the same flags as drawing directly
+func jobGenerator(usePressure, flipX, flipY bool) PlotJobGenerator {
+	return func(jobArgs []string, generation *Generation) (<-chan Coordinate, error) {
+		plotCoords, err := GeneratePlotCoords(jobArgs, usePressure, generation)
+		if err != nil {
+			return nil, err
+		}
+		return FlipIfRequested(flipX, flipY, plotCoords), nil
+	}
+}
+
+// Handle the queue command, args are everything after queue
+func RunQueueCommand(args []string, generator PlotJobGenerator, controlAddress, controlToken string) error {
+	if len(args) < 1 {
+		return errors.New("Expected add, list, remove, retry or run")
+	}
+	queue := OpenJobQueue()
+
+	switch args[0] {
+	case "add":
+		params, err := GetArgsAsFloats(args[1:], 2, false)
+		if err != nil {
+			return err
+		}
+		if len(args) < 4 {
+			return errors.New("Expected a command to queue after the X and Y offset")
+		}
+		job, err := queue.Add(args[3:], "", Coordinate{X: params[0], Y: params[1]})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Queued job", job.Id, job.Args)
+
+	case "list":
+		for _, job := range queue.List() {
+			fmt.Printf("%4d  %-11s  %v at %.1f, %.1f  %s", job.Id, job.State, strings.Join(job.Args, " "), job.OffsetX_MM, job.OffsetY_MM, job.Error)
+			fmt.Println()
+		}
+
+	case "remove", "retry":
+		if len(args) != 2 {
+			return errors.New("Expected a job id")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		if args[0] == "remove" {
+			return queue.Remove(id)
+		}
+		return queue.Retry(id)
+
+	case "run":
+		waitBetween := len(args) > 1 && args[1] == "wait"
+
+		controls := make(chan PlotCommand)
+		go ReadPlotCommandsFromKeyboard(controls)
+		if controlAddress != "" {
+			go ReadPlotCommandsFromSocket(controlAddress, controlToken, controls)
+		}
+		fmt.Println("While plotting enter pause, resume, abort, or nudge DX DY")
+
+		return queue.Run(0, generator, waitBetween, controls, nil)
+
+	default:
+		return errors.New(fmt.Sprint("Unknown queue command ", args[0]))
+	}
+	return nil
+}
+
+// returned by GeneratePlotCoords when the command doesn't draw anything
+var errUnknownCommand = errors.New("Unrecognized command")
+
+// Start generating the coordinates for a drawing command, args are the command followed by its parameters
+// the goroutines generating the coordinates are run by generation, so a failure part way through can be found with generation.Err
+// commands that read a file take it from the same argument ReadsStdin checks
+func GeneratePlotCoords(args []string, usePressure bool, generation *Generation) (<-chan Coordinate, error) {
+
+	plotCoords := make(chan Coordinate, 1024)
+	var err error
+	var params []float64
+
+	switch args[0] {
 	case "test":
 		plotCoords <- Coordinate{X: 0, Y: 0}
 		plotCoords <- Coordinate{X: 10, Y: 0}
@@ -73,10 +441,7 @@ func main() {
 
 	case "circle":
 		if params, err = GetArgsAsFloats(args[1:], 3, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("circle")
-			return
+			return nil, err
 		}
 		circleSetup := SlidingCircle{
 			Radius:             params[0],
@@ -85,14 +450,14 @@ func main() {
 		}
 
 		fmt.Println("Generating sliding circle")
-		go GenerateSlidingCircle(circleSetup, plotCoords)
+		generation.Go(func() { GenerateSlidingCircle(circleSetup, plotCoords) })
 
 	case "crosshatch":
 		if params, err = GetArgsAsFloats(args[1:], 2, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("crosshatch")
-			return
+			return nil, err
+		}
+		if len(args) < 4 {
+			return nil, errors.New(fmt.Sprint("Expected 3 parameters and saw ", len(args)-1))
 		}
 		crossHatchSetup := CrossHatch{
 			Size: params[0],
@@ -101,18 +466,13 @@ func main() {
 
 		fmt.Println("Generating crosshatch path")
 		data := LoadImage(args[3])
-		go GenerateCrossHatch(crossHatchSetup, data, plotCoords)
-
-		originalPlotCoords := plotCoords
-		plotCoords = make(chan Coordinate, 1024)
-		go RemoveExtraPenUpMovements(originalPlotCoords, plotCoords)
+		hatchCoords := make(chan Coordinate, 1024)
+		generation.Go(func() { GenerateCrossHatch(crossHatchSetup, data, hatchCoords) })
+		generation.Go(func() { RemoveExtraPenUpMovements(hatchCoords, plotCoords) })
 
 	case "gcode":
 		if len(args) < 3 {
-			fmt.Println("ERROR: ", fmt.Sprint("Expected 2 parameters and saw ", len(args)-1))
-			fmt.Println()
-			PrintCommandHelp("gcode")
-			return
+			return nil, errors.New(fmt.Sprint("Expected 2 parameters and saw ", len(args)-1))
 		}
 
 		scale, _ := strconv.ParseFloat(args[1], 64)
@@ -120,16 +480,125 @@ func main() {
 			scale = 1
 		}
 
+		penModeText := Settings.GcodePenMode
+		lenient := false
+		for _, arg := range args[3:] {
+			if arg == "lenient" {
+				lenient = true
+			} else {
+				penModeText = arg
+			}
+		}
+		penMode, err := ParseGcodePenMode(penModeText)
+		if err != nil {
+			return nil, err
+		}
+
+		options := GcodeOptions{PenMode: penMode, Lenient: lenient}
+
+		// a file that parses all the way through can be plotted while it is being read, stdin can only be read once
+		// and a file with a problem is plotted only once all of it has been generated, so neither is sent part way
+		if args[2] != StdinFileName && CheckGcodeFile(args[2], options) == nil {
+			generation.Stream()
+		}
+
+		file, err := OpenInput(args[2])
+		if err != nil {
+			return nil, err
+		}
+
+		// the file is parsed as its coordinates are read, a problem part way through fails the generation
 		fmt.Println("Generating Gcode path")
-		data := ParseGcodeFile(args[2])
-		go GenerateGcodePath(data, scale, plotCoords)
+		generation.Go(func() {
+			defer file.Close()
+			if err := StreamGcode(file, options, scale, plotCoords); err != nil {
+				generation.Fail(errors.New(fmt.Sprint("Stopped reading ", args[2], " at ", err)))
+			}
+		})
+
+	case "hpgl":
+		if len(args) < 3 {
+			return nil, errors.New(fmt.Sprint("Expected 2 parameters and saw ", len(args)-1))
+		}
+
+		scale, _ := strconv.ParseFloat(args[1], 64)
+		if scale == 0 {
+			scale = 1
+		}
+
+		fmt.Println("Generating HPGL path")
+		data, err := ParseHpglFile(args[2])
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Unable to parse ", args[2], ", ", err))
+		}
+		generation.Go(func() { GenerateHpglPath(data, scale, plotCoords) })
+
+	case "dxf":
+		if len(args) < 3 {
+			return nil, errors.New(fmt.Sprint("Expected at least 2 parameters and saw ", len(args)-1))
+		}
+
+		size, _ := strconv.ParseFloat(args[1], 64)
+
+		dxfType := "box"
+		if len(args) > 3 {
+			dxfType = strings.ToLower(args[3])
+		}
+		layer := ""
+		if len(args) > 4 {
+			layer = args[4]
+		}
+
+		fmt.Println("Generating dxf path")
+		data, err := ParseDxfFile(args[2], layer)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Unable to read ", args[2], ", ", err))
+		}
+
+		// a size of 0 draws the drawing at the size given by its units
+		if size == 0 {
+			minPoint, maxPoint := data.Extents()
+			size = math.Max(maxPoint.X-minPoint.X, maxPoint.Y-minPoint.Y)
+			if dxfType == "center" {
+				size = maxPoint.X - minPoint.X
+			}
+		}
+
+		// placed the same way as an svg
+		switch dxfType {
+		case "top":
+			generation.Go(func() { GenerateSvgTopPath(data, size, plotCoords) })
+
+		case "box":
+			generation.Go(func() { GenerateSvgBoxPath(data, size, plotCoords) })
+
+		case "center":
+			generation.Go(func() { GenerateSvgCenterPath(data, size, plotCoords) })
+
+		default:
+			return nil, errors.New(fmt.Sprint("Expected top, box or center as the dxf type, and saw ", dxfType))
+		}
+
+	case "paths":
+		if len(args) < 3 {
+			return nil, errors.New(fmt.Sprint("Expected 2 parameters and saw ", len(args)-1))
+		}
+
+		scale, _ := strconv.ParseFloat(args[1], 64)
+		if scale == 0 {
+			scale = 1
+		}
+
+		fmt.Println("Generating paths")
+		data, err := ParsePathsFile(args[2])
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Unable to read ", args[2], ", ", err))
+		}
+		generation.Go(func() { GeneratePaths(data, scale, plotCoords) })
 
 	case "grid":
 		if params, err = GetArgsAsFloats(args[1:], 2, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("grid")
-			return
+			return nil, err
 		}
 		gridSetup := Grid{
 			Width: params[0],
@@ -137,14 +606,11 @@ func main() {
 		}
 
 		fmt.Println("Generating grid")
-		go GenerateGrid(gridSetup, plotCoords)
+		generation.Go(func() { GenerateGrid(gridSetup, plotCoords) })
 
 	case "hilbert":
 		if params, err = GetArgsAsFloats(args[1:], 2, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("hilbert")
-			return
+			return nil, err
 		}
 		hilbertSetup := HilbertCurve{
 			Size:   params[0],
@@ -152,47 +618,46 @@ func main() {
 		}
 
 		fmt.Println("Generating hilbert curve")
-		go GenerateHilbertCurve(hilbertSetup, plotCoords)
+		generation.Go(func() { GenerateHilbertCurve(hilbertSetup, plotCoords) })
 
 	case "imagearc":
 		if params, err = GetArgsAsFloats(args[1:], 2, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("imagearc")
-			return
+			return nil, err
+		}
+		if len(args) < 4 {
+			return nil, errors.New(fmt.Sprint("Expected 3 parameters and saw ", len(args)-1))
 		}
 		arcSetup := Arc{
-			Size:    params[0],
-			ArcDist: params[1],
+			Size:        params[0],
+			ArcDist:     params[1],
+			UsePressure: usePressure,
 		}
 
 		fmt.Println("Generating image arc path")
 		data := LoadImage(args[3])
 		data = GaussianImage(data)
-		go GenerateArc(arcSetup, data, plotCoords)
+		generation.Go(func() { GenerateArc(arcSetup, data, plotCoords) })
 
 	case "imageraster":
 		if params, err = GetArgsAsFloats(args[1:], 2, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("imageraster")
-			return
+			return nil, err
+		}
+		if len(args) < 4 {
+			return nil, errors.New(fmt.Sprint("Expected 3 parameters and saw ", len(args)-1))
 		}
 		rasterSetup := Raster{
-			Size:     params[0],
-			PenWidth: params[1],
+			Size:        params[0],
+			PenWidth:    params[1],
+			UsePressure: usePressure,
 		}
 
 		fmt.Println("Generating image raster path")
 		data := LoadImage(args[3])
-		go GenerateRaster(rasterSetup, data, plotCoords)
+		generation.Go(func() { GenerateRaster(rasterSetup, data, plotCoords) })
 
 	case "lissa":
 		if params, err = GetArgsAsFloats(args[1:], 3, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("lissa")
-			return
+			return nil, err
 		}
 		posFunc := func(t float64) Coordinate {
 			return Coordinate{
@@ -202,14 +667,11 @@ func main() {
 		}
 
 		fmt.Println("Generating Lissajous curve")
-		go GenerateParametric(posFunc, plotCoords)
+		generation.Go(func() { GenerateParametric(posFunc, plotCoords) })
 
 	case "line":
 		if params, err = GetArgsAsFloats(args[1:], 2, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("line")
-			return
+			return nil, err
 		}
 		lineSetup := BouncingLine{
 			Angle:         params[0],
@@ -217,18 +679,11 @@ func main() {
 		}
 
 		fmt.Println("Generating line")
-		go GenerateBouncingLine(lineSetup, plotCoords)
-
-	case "move":
-		PerformMouseTracking()
-		return
+		generation.Go(func() { GenerateBouncingLine(lineSetup, plotCoords) })
 
 	case "parabolic":
 		if params, err = GetArgsAsFloats(args[1:], 3, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("parabolic")
-			return
+			return nil, err
 		}
 		parabolicSetup := Parabolic{
 			Radius:           params[0],
@@ -237,61 +692,11 @@ func main() {
 		}
 
 		fmt.Println("Generating parabolic graph")
-		go GenerateParabolic(parabolicSetup, plotCoords)
-
-	case "setup":
-		if params, err = GetArgsAsFloats(args[1:], 3, false); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("setup")
-			return
-		}
-
-		if params[0] != 0 {
-			Settings.SpoolHorizontalDistance_MM = params[0]
-		} else {
-			fmt.Println("Using existing SpoolHorizontalDistance_MM of", Settings.SpoolHorizontalDistance_MM)
-		}
-		if params[1] != 0 {
-			Settings.StartingLeftDist_MM = params[1]
-		} else {
-			fmt.Println("Using existing StartingLeftDist_MM of", Settings.StartingLeftDist_MM)
-		}
-		if params[2] != 0 {
-			Settings.StartingRightDist_MM = params[2]
-		} else {
-			fmt.Println("Using existing StartingRightDist_MM of", Settings.StartingRightDist_MM)
-		}
-
-		if Settings.SpoolHorizontalDistance_MM > (Settings.StartingLeftDist_MM + Settings.StartingRightDist_MM) {
-			fmt.Println("ERROR: Attempted to specify a setup where the two string distances are less than the distance between idlers")
-			return
-		}
-
-		Settings.CalculateDerivedFields()
-
-		polarSystem := PolarSystemFromSettings()
-		polarPos := PolarCoordinate{LeftDist: Settings.StartingLeftDist_MM, RightDist: Settings.StartingRightDist_MM}
-		pos := polarPos.ToCoord(polarSystem)
-
-		if pos.X < Settings.DrawingSurfaceMinX_MM || pos.X > Settings.DrawingSurfaceMaxX_MM || pos.Y < Settings.DrawingSurfaceMinY_MM || pos.Y > Settings.DrawingSurfaceMaxY_MM {
-			fmt.Println("ERROR: The specified settings result in a pen position that exceeds the DrawingSurfaceMin/Max as defined in gocupi_config.xml")
-			fmt.Printf("Initial X,Y position of pen would have been %.3f, %.3f", pos.X, pos.Y)
-			fmt.Println()
-		} else {
-			fmt.Printf("Initial X,Y position of pen is %.3f, %.3f", pos.X, pos.Y)
-			fmt.Println()
-			Settings.Write()
-		}
-
-		return
+		generation.Go(func() { GenerateParabolic(parabolicSetup, plotCoords) })
 
 	case "spiral":
 		if params, err = GetArgsAsFloats(args[1:], 2, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("spiral")
-			return
+			return nil, err
 		}
 		spiralSetup := Spiral{
 			RadiusBegin:       params[0],
@@ -300,14 +705,11 @@ func main() {
 		}
 
 		fmt.Println("Generating spiral")
-		go GenerateSpiral(spiralSetup, plotCoords)
+		generation.Go(func() { GenerateSpiral(spiralSetup, plotCoords) })
 
 	case "spiro":
 		if params, err = GetArgsAsFloats(args[1:], 3, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("spiro")
-			return
+			return nil, err
 		}
 		bigR := params[0]
 		littleR := params[1]
@@ -321,31 +723,11 @@ func main() {
 		}
 
 		fmt.Println("Generating spiro")
-		go GenerateParametric(posFunc, plotCoords)
-
-	case "spool":
-		if len(args) == 3 {
-
-			leftSpool := strings.ToLower(args[1]) == "l"
-			if params, err = GetArgsAsFloats(args[2:], 1, true); err != nil {
-				fmt.Println("ERROR: ", err)
-				fmt.Println()
-				PrintCommandHelp("spool")
-				return
-			}
-
-			MoveSpool(leftSpool, params[0])
-		} else {
-			InteractiveMoveSpool()
-		}
-		return
+		generation.Go(func() { GenerateParametric(posFunc, plotCoords) })
 
 	case "svg":
 		if len(args) < 3 {
-			fmt.Println("ERROR: ", fmt.Sprint("Expected at least 2 parameters and saw ", len(args)-1))
-			fmt.Println()
-			PrintCommandHelp("svg")
-			return
+			return nil, errors.New(fmt.Sprint("Expected at least 2 parameters and saw ", len(args)-1))
 		}
 
 		size, _ := strconv.ParseFloat(args[1], 64)
@@ -362,25 +744,21 @@ func main() {
 		data := ParseSvgFile(args[2])
 		switch svgType {
 		case "top":
-			go GenerateSvgTopPath(data, size, plotCoords)
+			generation.Go(func() { GenerateSvgTopPath(data, size, plotCoords) })
 
 		case "box":
-			go GenerateSvgBoxPath(data, size, plotCoords)
+			generation.Go(func() { GenerateSvgBoxPath(data, size, plotCoords) })
 
 		case "center":
-			go GenerateSvgCenterPath(data, size, plotCoords)
+			generation.Go(func() { GenerateSvgCenterPath(data, size, plotCoords) })
 
 		default:
-			fmt.Println("Expected top or box as the svg type, and saw", svgType)
-			return
+			return nil, errors.New(fmt.Sprint("Expected top, box or center as the svg type, and saw ", svgType))
 		}
 
 	case "text":
 		if len(args) != 3 {
-			fmt.Println("ERROR: ", fmt.Sprint("Expected at least 2 parameters and saw ", len(args)-1))
-			fmt.Println()
-			PrintCommandHelp("text")
-			return
+			return nil, errors.New(fmt.Sprint("Expected at least 2 parameters and saw ", len(args)-1))
 		}
 		height, _ := strconv.ParseFloat(args[1], 64)
 		if height == 0 {
@@ -388,14 +766,14 @@ func main() {
 		}
 
 		fmt.Println("Generating text path")
-		go GenerateTextPath(args[2], height, plotCoords)
+		generation.Go(func() { GenerateTextPath(args[2], height, plotCoords) })
 
 	case "qr":
 		if params, err = GetArgsAsFloats(args[1:], 2, true); err != nil {
-			fmt.Println("ERROR: ", err)
-			fmt.Println()
-			PrintCommandHelp("qr")
-			return
+			return nil, err
+		}
+		if len(args) < 4 {
+			return nil, errors.New(fmt.Sprint("Expected 3 parameters and saw ", len(args)-1))
 		}
 		rasterSetup := Raster{
 			Size:     params[0],
@@ -405,45 +783,27 @@ func main() {
 		fmt.Println("Generating qr raster path for ", args[3])
 		data, err := qrencode.Encode(args[3], qrencode.ECLevelQ)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		imageData := data.ImageWithMargin(1, 0)
-		go GenerateRaster(rasterSetup, imageData, plotCoords)
+		generation.Go(func() { GenerateRaster(rasterSetup, imageData, plotCoords) })
 
 	default:
-		PrintGenericHelp()
-		return
+		return nil, errUnknownCommand
 	}
 
-	if *flipXFlag || *flipYFlag {
-		originalPlotCoords := plotCoords
-		plotCoords = make(chan Coordinate, 1024)
-		go FlipPlotCoords(*flipXFlag, *flipYFlag, originalPlotCoords, plotCoords)
-	}
+	return plotCoords, nil
+}
 
-	if *toImageFlag {
-		fmt.Println("Outputting to image")
-		DrawToImage("output.png", plotCoords)
-		return
+// Flip the coordinates if either flip is requested
+func FlipIfRequested(flipX, flipY bool, plotCoords <-chan Coordinate) <-chan Coordinate {
+	if !flipX && !flipY {
+		return plotCoords
 	}
 
-	// output the max speed and acceleration
-	fmt.Println()
-	fmt.Printf("MaxSpeed: %.3f mm/s Accel: %.3f mm/s^2", Settings.MaxSpeed_MM_S, Settings.Acceleration_MM_S2)
-	fmt.Println()
-
-	stepData := make(chan int8, 1024)
-	go GenerateSteps(plotCoords, stepData)
-	switch {
-	case *countFlag:
-		CountSteps(stepData)
-	case *toFileFlag:
-		WriteStepsToFile(stepData)
-	case *toChartFlag:
-		WriteStepsToChart(stepData)
-	default:
-		WriteStepsToSerial(stepData, *pauseOnPenUp)
-	}
+	flippedCoords := make(chan Coordinate, 1024)
+	go FlipPlotCoords(flipX, flipY, plotCoords, flippedCoords)
+	return flippedCoords
 }
 
 func FlipPlotCoords(flipX, flipY bool, coords <-chan Coordinate, flippedCoords chan<- Coordinate) {
@@ -524,16 +884,37 @@ General Usage: (flags) COMMAND PARAMETERS...
 
 All distance numbers are in millimeters
 All angles are in radians
+An input file of - reads from stdin, ie: vpype ... | gocupi svg 300 -
 
 Flags:
--pause, pause when pen is raised (requires keyboard input)
+-pause, pause when pen is raised, press enter to resume
+-control=ADDR, accept pause, resume, abort and nudge commands on a tcp address while plotting, ie localhost:7070, other addresses need -token
+-listen=ADDR, address serve listens on, defaults to 127.0.0.1:8080 which only accepts connections from this machine
+-token=TOKEN, token serve requires with every request as ?token=TOKEN or an Authorization: Bearer TOKEN header, and -control as the first line
 -toimage, outputs data to an image of what the render should look like
+-realistic, with -toimage renders anti-aliased strokes in PenWidth_MM and PenColor on the whole drawing surface
+-stepaccurate, with -toimage replays the generated steps over the intended path and highlights deviations beyond -tolerance
+-tolerance=#, distance in mm from the intended path that -stepaccurate highlights, defaults to 0.2
+-tosvg, outputs the planned path to output.svg with pen down strokes and pen up travel on separate layers
+-toSvgArtwork, outputs the pen down strokes to artwork.svg as plain paths in mm, which can be edited and drawn again with the svg command
+-topaths, outputs the pen down strokes to paths.json, or a .csv -output, in the format read by the paths command
+-togcode, outputs the planned path to output.gcode as G0 travel and G1 drawing moves, with Y up and the feed rate at the max speed
+-gcodepenup=LINE, -gcodependown=LINE, lines -togcode writes to raise and lower the pen, ie M5 and M3, default to the codes GcodePenMode reads
+-toanimation, replays the step data as the arduino would into animation.gif, or numbered pngs when -output is a .png
+-timestep=#, seconds of plotting between -toanimation frames, defaults to a step that gives 100 frames
+-output=FILE, file written by -toimage, -tosvg, -toSvgArtwork, -topaths, -togcode, -tochart, -toanimation and -tofile
+-format=png|jpeg|svg|pdf, format of -toimage and -tochart output, defaults to the extension of -output
+-dpi=#, resolution of -toimage and -toanimation output, defaults to 101.6 (4 pixels per mm)
+-chartwidth=#, -chartheight=#, size of -tochart output in inches, defaults to 14 x 8.5
+-chartslices=#, number of time slices shown by -tochart, defaults to 1500
 -tochart, outputs a graph of velocity and position
 -tofile, outputs step data to a file
 -count, outputs number of steps and render time
+-report, outputs distances, times, ink usage and bounds, also written to report.json
 -slowfactor=#, slow down rendering by #x, 2x, 4x slower etc
 -flipx, flip the generated image left to right
 -flipy, flip the generated image top to bottom
+-pressure, draw image darkness by varying pen pressure in imagearc and imageraster
 
 Commands:`)
 
@@ -572,11 +953,34 @@ crosshatch s d "path"
 	d - distance between each crosshatch line
 	path - path to image file`,
 
-	`gcode`: `Render a given gcode file, only a subset of valid gcode is recognized.
+	`dxf`: `Draw the LINE, LWPOLYLINE, POLYLINE, CIRCLE, ARC, ELLIPSE and SPLINE entities of an ASCII dxf file, curves are flattened to within 0.01mm.
+
+dxf s "path" [top|box|center] [layer]
+	s - size of long axis, 0 draws it at the size given by its $INSUNITS
+	path - path to the dxf file
+	top|box|center - type of drawing, placed the same way as svg, defaults to box since top only suits single loop drawings
+	layer - only draw entities on this layer`,
+
+	`gcode`: `Render a given gcode file. G0/G1 moves, G2/G3 arcs with I J or R, G20/G21 units and G90/G91 absolute and relative modes are recognized,
+along with N line numbers and ( ) or ; comments. The pen starts raised.
+The file is read a line at a time instead of being loaded into memory. It is checked with a quick pass first, then plotting starts
+straight away and the rest is generated as it is sent, so the length of the plot is shown as unknown.
+Stdin can only be read once, so its steps are all generated before anything is sent.
+The first line that can't be understood is reported with its line and column and nothing is plotted, previews show the drawing up to it.
 	
-gcode s "path"
+gcode s "path" [mode] [lenient]
 	s - scale
-	path - path to the gcode file`,
+	path - path to the gcode file
+	mode - how the file raises the pen, defaults to GcodePenMode from the config file
+		z50 - Z50 raises the pen, any other Z lowers it
+		z:T - Z above T raises the pen, T defaults to 0
+		m3m5 - M5 raises the pen, M3 or M4 lowers it
+		m300:T - M300 with S above T raises the pen, T defaults to 40
+		m280 - M280 S sets the servo angle, closer to PenUpAngle raises the pen
+		inkscape, gcodetools - same as z:0
+		laser - same as m3m5
+		servo - same as m300:40
+	lenient - skip unknown words, commands and lines that can't be parsed, printing a warning for each`,
 
 	`grid`: `Draw a grid, starting in the upper left.
 	
@@ -590,17 +994,26 @@ hilbert s d
 	s - size of square
 	d - degree of hilbert curve, 2 to 6`,
 
+	`hpgl`: `Render a given HPGL file. PU/PD pen moves, PA/PR absolute and relative coordinates, IN, DF and SP are recognized,
+with 40 plotter units to a mm. Selecting a different pen with SP raises the pen and pauses the plot until it is resumed.
+	
+hpgl s "path"
+	s - scale
+	path - path to the hpgl file`,
+
 	`imagearc`: `Draw an image using an arc pattern and drawing a thicker line to represent darker parts of the image.
 	
 imagearc s a "path"
 	s - size of long axis
-	a - distance between each arc`,
+	a - distance between each arc
+With -pressure darker parts are drawn by pressing the pen harder instead, set PenDownAngle and PenLightAngle in the config.`,
 
 	`imageraster`: `Draw an image using horizontal line pattern and drawing thicker lines to represent darker parts of the image.
 	
 imageraster s p "path"
 	s - size of long axis
-	p - pen thickness / distance between rows`,
+	p - pen thickness / distance between rows
+With -pressure each row is a single stroke and darker pixels press the pen harder, set PenDownAngle and PenLightAngle in the config.`,
 
 	`lissa`: `Draw a lissajous curve, drawing stops when the pen arrives back at the starting position.
 	
@@ -615,6 +1028,10 @@ line a d
 	a - initial angle to start drawing
 	d - distance in meters for line`,
 
+	`motors`: `Turn the stepper motor drivers on or off, when off the spools can be turned by hand. Motors are turned back on at the start of every drawing.
+
+motors on|off`,
+
 	`move`: `Enter a mouse based interactive movement mode, allows you to position the pen to start a new drawing or to manually move the pen to a known calibration position.`,
 
 	`parabolic`: `Draw a series of parabolic curves (curves made out of a series of straight lines).
@@ -624,6 +1041,40 @@ parabolic R c l
 	c - count of polygon edges
 	l - number of lines per edges`,
 
+	`paths`: `Draw strokes from a json or csv file, a simple format for scripts. Points are in mm relative to the starting position of the pen, with Y pointing down.
+json is a list of strokes, each a list of [x, y] points: [[[0, 0], [10, 0]], [[0, 5], [10, 5]]]
+csv has a stroke,x,y row for every point, a new stroke starts when the stroke column changes, a header row is optional
+	
+paths s "path"
+	s - scale
+	path - path to the .json or .csv file`,
+
+	`queue`: `Keep a queue of drawings in job_queue.json that is plotted back to back and survives restarts. The queue is shared with serve.
+Each job returns the pen to the starting position when it finishes. A job whose input file changes after it was queued fails instead of plotting.
+
+queue add X Y command params...
+	X Y - offset of the drawing from the starting position in mm
+	command params - any drawing command, ie: queue add 0 0 svg 500 drawing.svg center
+queue list
+queue remove ID
+queue retry ID - queue a job that failed, was aborted or was interrupted again
+queue run [wait]
+	wait - before each job after the first wait for resume, so the paper and pen can be changed`,
+
+	`serve`: `Run an http server that queues jobs and lets them be previewed, started, paused and aborted from a browser or script.
+Open http://ADDRESS/ in a browser, adding ?token=TOKEN when -token is set, or see the api below.
+Listens on -listen, which defaults to 127.0.0.1:8080 so only this machine can connect, set -token when listening on other addresses.
+Jobs can only read files from the uploads and jobs directories, requests other than GET from pages on other sites are rejected.
+	
+serve
+
+	GET  /jobs, POST /jobs with a multipart form of args and file, ie args=svg 500 {file} center
+	  add x=X&y=Y to the form to offset the drawing in mm
+	GET, DELETE /jobs/ID, GET /jobs/ID/preview, POST /jobs/ID/start, POST /jobs/ID/retry, POST /start for the oldest queued job
+	POST /run to plot every queued job back to back, /run?wait=1 waits for /resume before each job after the first
+	POST /pause, /resume, /abort, /nudge?x=DX&y=DY
+	GET  /progress websocket of job changes and progress`,
+
 	`setup`: `Enter the initial setup measurements of the system. Updates the config xml file.
 Enter 0 for a parameter that you don't want to update, so you can update just distance between the idlers by doing 'setup 500 0 0'.
 	
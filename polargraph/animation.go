@@ -0,0 +1,255 @@
+package polargraph
+
+// Animates the plot by replaying the step data the way the arduino would, which checks the real step output rather than the coordinates
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Number of frames used when no timestep is given
+const defaultAnimationFrames float64 = 100
+
+// Time each gif frame is shown for, in 100ths of a second
+const animationFrameDelay int = 10
+
+// Colours of an animation frame, by palette index
+const (
+	animationPaper uint8 = iota
+	animationTravel
+	animationInk
+	animationGondola
+)
+
+// Location of the pen at a point in time while replaying step data
+type animationPoint struct {
+	Wall    Coordinate
+	PenUp   bool
+	Time_US float64
+
+	// Position in the step data of the frame that moved the pen here
+	Offset int
+}
+
+// Replay step data, keeping a point every time the pen moves at least minDistance or is raised or lowered
+func replayAnimationPoints(stepData <-chan int8, minDistance float64) []animationPoint {
+	replay := NewStepReplay()
+	points := []animationPoint{{Wall: replay.Wall, PenUp: true}}
+
+	offset, frameOffset := 0, 0
+	for frame, ok := ReadStepFrame(stepData); ok; frame, ok = ReadStepFrame(stepData) {
+		replay.Apply(frame)
+		frameOffset = offset
+		offset += len(frame.Raw)
+
+		last := points[len(points)-1]
+		if replay.PenUp != last.PenUp || replay.Wall.Minus(last.Wall).Len() >= minDistance {
+			points = append(points, animationPoint{Wall: replay.Wall, PenUp: replay.PenUp, Time_US: replay.Elapsed_US, Offset: frameOffset})
+		}
+	}
+
+	// always finish where the arduino finishes
+	if last := points[len(points)-1]; last.Wall != replay.Wall || last.Time_US != replay.Elapsed_US {
+		points = append(points, animationPoint{Wall: replay.Wall, PenUp: replay.PenUp, Time_US: replay.Elapsed_US, Offset: frameOffset})
+	}
+	return points
+}
+
+// Renders frames of an animation one at a time, each frame adds the moves made since the last one
+type animationRenderer struct {
+	points []animationPoint
+
+	// everything drawn so far, without the gondola
+	canvas *image.Paletted
+
+	// wall coordinate of the top left corner and the resolution of the canvas
+	origin      Coordinate
+	pixelsPerMM float64
+
+	// index of the next point to draw
+	next int
+
+	// where the gondola was drawn in the previous frame
+	gondola image.Rectangle
+
+	// false until the first frame, which covers the whole canvas
+	started bool
+}
+
+// Create a renderer sized to fit every point
+func newAnimationRenderer(points []animationPoint, pixelsPerMM float64) *animationRenderer {
+	minPoint := Coordinate{X: math.Inf(1), Y: math.Inf(1)}
+	maxPoint := Coordinate{X: math.Inf(-1), Y: math.Inf(-1)}
+	for _, point := range points {
+		minPoint.X = math.Min(minPoint.X, point.Wall.X)
+		minPoint.Y = math.Min(minPoint.Y, point.Wall.Y)
+		maxPoint.X = math.Max(maxPoint.X, point.Wall.X)
+		maxPoint.Y = math.Max(maxPoint.Y, point.Wall.Y)
+	}
+	border := Coordinate{X: 12.5, Y: 12.5}
+	minPoint, maxPoint = minPoint.Minus(border), maxPoint.Add(border)
+	size := maxPoint.Minus(minPoint).Scaled(pixelsPerMM)
+
+	penColor, err := parseHexColor(Settings.PenColor)
+	if err != nil {
+		penColor = color.RGBA{0, 0, 0, 255}
+	}
+	palette := color.Palette{
+		animationPaper:   color.RGBA{255, 255, 255, 255},
+		animationTravel:  color.RGBA{200, 200, 200, 255},
+		animationInk:     penColor,
+		animationGondola: color.RGBA{220, 0, 0, 255},
+	}
+
+	return &animationRenderer{
+		points:      points,
+		canvas:      image.NewPaletted(image.Rect(0, 0, int(math.Ceil(size.X)), int(math.Ceil(size.Y))), palette),
+		origin:      minPoint,
+		pixelsPerMM: pixelsPerMM,
+		next:        1,
+	}
+}
+
+// Pixel of a wall coordinate
+func (renderer *animationRenderer) pixel(wall Coordinate) image.Point {
+	scaled := wall.Minus(renderer.origin).Scaled(renderer.pixelsPerMM)
+	return image.Point{int(scaled.X), int(scaled.Y)}
+}
+
+// Draw every move up to time_US onto the canvas and return the next frame
+// the frame only covers the part of the canvas that changed since the previous frame, so it is drawn over the previous one
+func (renderer *animationRenderer) Frame(time_US float64) *image.Paletted {
+	changed := renderer.gondola
+	if !renderer.started {
+		changed = renderer.canvas.Bounds()
+		renderer.started = true
+	}
+
+	for ; renderer.next < len(renderer.points) && renderer.points[renderer.next].Time_US <= time_US; renderer.next++ {
+		from, to := renderer.points[renderer.next-1], renderer.points[renderer.next]
+		colorIndex := animationInk
+		if to.PenUp {
+			colorIndex = animationTravel
+		}
+		changed = changed.Union(drawPalettedLine(renderer.canvas, renderer.pixel(from.Wall), renderer.pixel(to.Wall), colorIndex))
+	}
+
+	// the gondola is drawn on the frame only, so the canvas never has to be repaired after it moves
+	center := renderer.pixel(renderer.points[renderer.next-1].Wall)
+	radius := int(math.Max(2, 1.5*renderer.pixelsPerMM))
+	renderer.gondola = image.Rect(center.X-radius, center.Y-radius, center.X+radius+1, center.Y+radius+1).Intersect(renderer.canvas.Bounds())
+	changed = changed.Union(renderer.gondola)
+	if changed.Empty() {
+		changed = image.Rect(0, 0, 1, 1)
+	}
+
+	frame := image.NewPaletted(changed, renderer.canvas.Palette)
+	draw.Draw(frame, changed, renderer.canvas, changed.Min, draw.Src)
+	for y := renderer.gondola.Min.Y; y < renderer.gondola.Max.Y; y++ {
+		for x := renderer.gondola.Min.X; x < renderer.gondola.Max.X; x++ {
+			if (x-center.X)*(x-center.X)+(y-center.Y)*(y-center.Y) <= radius*radius {
+				frame.SetColorIndex(x, y, animationGondola)
+			}
+		}
+	}
+	return frame
+}
+
+// Draw a line onto a paletted image, returns the area that was drawn on
+func drawPalettedLine(target *image.Paletted, start, end image.Point, colorIndex uint8) image.Rectangle {
+	dx, dy := end.X-start.X, end.Y-start.Y
+	steps := int(math.Max(math.Abs(float64(dx)), math.Abs(float64(dy))))
+	for step := 0; step <= steps; step++ {
+		x, y := start.X, start.Y
+		if steps > 0 {
+			x += int(math.Floor(float64(dx*step)/float64(steps) + 0.5))
+			y += int(math.Floor(float64(dy*step)/float64(steps) + 0.5))
+		}
+
+		// travel never covers ink that has already been drawn
+		if colorIndex == animationTravel && target.ColorIndexAt(x, y) == animationInk {
+			continue
+		}
+		target.SetColorIndex(x, y, colorIndex)
+	}
+
+	area := image.Rectangle{start, end}.Canon()
+	area.Max = area.Max.Add(image.Point{1, 1})
+	return area.Intersect(target.Bounds())
+}
+
+// Replay step data and write frames every timeStep_S of plotting time to an animated gif, or to numbered pngs when the file is a png
+// a timeStep_S of 0 picks a step that gives about 100 frames
+func WriteStepsToAnimation(options OutputOptions, timeStep_S float64, stepData <-chan int8) {
+
+	extension := strings.ToLower(filepath.Ext(options.FileName))
+	if extension != ".gif" && extension != ".png" {
+		panic(errors.New(fmt.Sprint("Animations are written to a .gif, or to numbered .png files, got ", options.FileName)))
+	}
+
+	points := replayAnimationPoints(stepData, 0.5/options.PixelsPerMM)
+	totalTime_US := points[len(points)-1].Time_US
+	timeStep_US := timeStep_S * 1000000
+	if timeStep_US <= 0 {
+		timeStep_US = math.Max(TimeSlice_US, totalTime_US/defaultAnimationFrames)
+	}
+	frameCount := int(math.Ceil(totalTime_US/timeStep_US)) + 1
+
+	renderer := newAnimationRenderer(points, options.PixelsPerMM)
+	fmt.Println("Animating", frameCount, "frames of", renderer.canvas.Bounds().Size(), "one every", timeStep_US/1000000, "seconds of plotting")
+
+	animation := &gif.GIF{}
+	for frameIndex := 0; frameIndex < frameCount; frameIndex++ {
+		frame := renderer.Frame(float64(frameIndex) * timeStep_US)
+
+		if extension == ".gif" {
+			animation.Image = append(animation.Image, frame)
+			animation.Delay = append(animation.Delay, animationFrameDelay)
+			animation.Disposal = append(animation.Disposal, gif.DisposalNone)
+			continue
+		}
+
+		// each png is the whole picture so it can be viewed on its own
+		whole := image.NewPaletted(renderer.canvas.Bounds(), renderer.canvas.Palette)
+		copy(whole.Pix, renderer.canvas.Pix)
+		draw.Draw(whole, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+		writePng(fmt.Sprintf("%s_%04d.png", strings.TrimSuffix(options.FileName, filepath.Ext(options.FileName)), frameIndex), whole)
+	}
+
+	if extension == ".gif" {
+		// hold the finished drawing before looping
+		animation.Delay[len(animation.Delay)-1] = animationFrameDelay * 20
+		animation.Config = image.Config{ColorModel: renderer.canvas.Palette, Width: renderer.canvas.Bounds().Dx(), Height: renderer.canvas.Bounds().Dy()}
+
+		file, err := os.OpenFile(options.FileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		if err := gif.EncodeAll(file, animation); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Write an image to a png file
+func writePng(fileName string, rendered image.Image) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, rendered); err != nil {
+		panic(err)
+	}
+}
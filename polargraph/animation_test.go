@@ -0,0 +1,81 @@
+package polargraph
+
+import (
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStepsToAnimation(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 800
+	Settings.StartingLeftDist_MM = 500
+	Settings.StartingRightDist_MM = 500
+	Settings.StepSize_MM = 0.1
+	Settings.PenColor = "#000000"
+
+	directory, err := ioutil.TempDir("", "gocupi_animation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	// both strings lengthen by 10mm with the pen down then shorten by 10mm with it up, each slice takes TimeSlice_US
+	steps := func() <-chan int8 {
+		stepData := make(chan int8, 1024)
+		SendPenTiming(100, 100, stepData)
+		SendPenDown(stepData)
+		for i := 0; i < 100; i++ {
+			encodeSlice(-32, 32, stepData)
+		}
+		SendPenUp(stepData)
+		for i := 0; i < 100; i++ {
+			encodeSlice(32, -32, stepData)
+		}
+		close(stepData)
+		return stepData
+	}
+
+	points := replayAnimationPoints(steps(), 0.5)
+	first, last := points[0], points[len(points)-1]
+	if !first.PenUp || first.Wall.Minus(Coordinate{X: 400, Y: 300}).Len() > 0.001 {
+		t.Error("Expected to start at the starting position, got", first)
+	}
+	if !last.PenUp || last.Wall.Minus(first.Wall).Len() > 0.001 || last.Time_US != 200*TimeSlice_US+200000 {
+		t.Error("Expected to finish back at the start after all the slices and pen delays, got", last)
+	}
+
+	options := DefaultOutputOptions(filepath.Join(directory, "animation.gif"))
+	WriteStepsToAnimation(options, 0.1, steps())
+
+	file, err := os.Open(options.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	animation, err := gif.DecodeAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 0.61 seconds of plotting at 0.1 seconds per frame
+	if len(animation.Image) != 8 {
+		t.Error("Expected 8 frames, got", len(animation.Image))
+	}
+	for index, frame := range animation.Image[1:] {
+		if !frame.Bounds().In(animation.Image[0].Bounds()) || frame.Bounds() == animation.Image[0].Bounds() {
+			t.Error("Expected frame", index+1, "to only cover what changed, got", frame.Bounds())
+		}
+	}
+
+	// numbered pngs
+	options.FileName = filepath.Join(directory, "frame.png")
+	WriteStepsToAnimation(options, 0.1, steps())
+	for _, name := range []string{"frame_0000.png", "frame_0007.png"} {
+		if _, err := os.Stat(filepath.Join(directory, name)); err != nil {
+			t.Error("Expected", name, "to be written")
+		}
+	}
+}
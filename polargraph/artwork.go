@@ -0,0 +1,93 @@
+package polargraph
+
+// Writes the pen down strokes of any generator as plain svg paths, so they can be edited and drawn again with the svg command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Draw the pen down strokes of coordinates to an svg file
+func DrawToSvgArtwork(svgName string, plotCoords <-chan Coordinate) {
+
+	file, err := os.OpenFile(svgName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	WriteSvgArtwork(writer, plotCoords)
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// Write each continuous pen down stroke as an svg path of absolute M and L commands in mm
+// the viewBox fits the strokes, including the width of the pen, and pen up travel is left out
+func WriteSvgArtwork(writer io.Writer, plotCoords <-chan Coordinate) {
+
+	// the paths are kept until the bounds are known, they are much smaller than the coordinates
+	paths := new(bytes.Buffer)
+	minPoint := Coordinate{X: math.Inf(1), Y: math.Inf(1)}
+	maxPoint := Coordinate{X: math.Inf(-1), Y: math.Inf(-1)}
+	extend := func(point Coordinate) {
+		minPoint.X = math.Min(minPoint.X, point.X)
+		minPoint.Y = math.Min(minPoint.Y, point.Y)
+		maxPoint.X = math.Max(maxPoint.X, point.X)
+		maxPoint.Y = math.Max(maxPoint.Y, point.Y)
+	}
+
+	// a move is drawn when the point it ends at has the pen down, so a stroke starts from the point before it
+	previous := Coordinate{X: 0, Y: 0, PenUp: true}
+	inPath := false
+	for point := range plotCoords {
+		if point.PenUp {
+			if inPath {
+				fmt.Fprintln(paths, `"/>`)
+				inPath = false
+			}
+		} else {
+			if !inPath {
+				fmt.Fprintf(paths, `<path d="M %.3f,%.3f L`, previous.X, previous.Y)
+				extend(previous)
+				inPath = true
+			}
+			fmt.Fprintf(paths, " %.3f,%.3f", point.X, point.Y)
+			extend(point)
+		}
+		previous = point
+	}
+	if inPath {
+		fmt.Fprintln(paths, `"/>`)
+	}
+
+	penWidth := Settings.PenWidth_MM
+	if penWidth <= 0 {
+		penWidth = 0.5
+	}
+	penColor := Settings.PenColor
+	if _, err := parseHexColor(penColor); err != nil {
+		penColor = "#000000"
+	}
+
+	size := Coordinate{}
+	if paths.Len() == 0 {
+		minPoint = Coordinate{}
+	} else {
+		minPoint = minPoint.Minus(Coordinate{X: penWidth / 2, Y: penWidth / 2})
+		maxPoint = maxPoint.Add(Coordinate{X: penWidth / 2, Y: penWidth / 2})
+		size = maxPoint.Minus(minPoint)
+	}
+
+	fmt.Fprintf(writer, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="%.3fmm" height="%.3fmm" viewBox="%.3f %.3f %.3f %.3f">
+<g fill="none" stroke="%s" stroke-width="%.3f" stroke-linecap="round" stroke-linejoin="round">
+`, size.X, size.Y, minPoint.X, minPoint.Y, size.X, size.Y, penColor, penWidth)
+	paths.WriteTo(writer)
+	fmt.Fprintln(writer, "</g>\n</svg>")
+}
@@ -0,0 +1,54 @@
+package polargraph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteSvgArtwork(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.PenWidth_MM = 0.5
+	Settings.PenColor = "#102030"
+
+	coords := []Coordinate{
+		{X: 10, Y: 10, PenUp: true},
+		{X: 20, Y: 10},
+		{X: 20, Y: 20},
+		{X: 30, Y: 30, PenUp: true},
+		{X: 40, Y: 30},
+		{X: 0, Y: 0, PenUp: true},
+	}
+	plotCoords := make(chan Coordinate, len(coords))
+	for _, coord := range coords {
+		plotCoords <- coord
+	}
+	close(plotCoords)
+
+	written := new(bytes.Buffer)
+	WriteSvgArtwork(written, plotCoords)
+	svg := written.String()
+
+	// travel back to the start isn't part of the artwork, so the bounds only cover the strokes and the pen width
+	if !strings.Contains(svg, `width="30.500mm" height="20.500mm" viewBox="9.750 9.750 30.500 20.500"`) {
+		t.Error("Expected the viewBox to fit the strokes, got", svg)
+	}
+	if !strings.Contains(svg, `stroke="#102030"`) {
+		t.Error("Expected the pen colour, got", svg)
+	}
+	if strings.Count(svg, "<path") != 2 {
+		t.Error("Expected a path for each stroke, got", svg)
+	}
+
+	// reading the artwork back with the svg command gives the same strokes
+	read := ParseSvg(strings.NewReader(svg))
+	expected := coords[:5]
+	if len(read) != len(expected) {
+		t.Fatal("Expected", expected, "got", read)
+	}
+	for index := range expected {
+		if !read[index].Equals(expected[index]) || read[index].PenUp != expected[index].PenUp {
+			t.Error("Point", index, "expected", expected[index], "got", read[index])
+		}
+	}
+}
@@ -7,28 +7,28 @@ import (
 	"image/color"
 )
 
-// Writes step data and position to a graph
-func WriteStepsToChart(stepData <-chan int8) {
+// Writes step data and position to a graph, the file's format is taken from its extension
+func WriteStepsToChart(options OutputOptions, stepData <-chan int8) {
 
-	maxNumberSteps := 1500
+	maxNumberSteps := options.ChartSlices
 
 	leftVel := make(chartplotter.XYs, maxNumberSteps)
 	rightVel := make(chartplotter.XYs, maxNumberSteps)
 	leftPos := make(chartplotter.XYs, maxNumberSteps)
 	rightPos := make(chartplotter.XYs, maxNumberSteps)
 
-	var byteDataL, byteDataR int8
 	stepIndex := 0
-	for stepDataOpen := true; stepDataOpen; {
+	for frame, ok := ReadStepFrame(stepData); ok; frame, ok = ReadStepFrame(stepData) {
 
-		byteDataL, stepDataOpen = <-stepData
-		byteDataR, stepDataOpen = <-stepData
+		if !frame.IsSlice() {
+			continue
+		}
 
 		leftVel[stepIndex].X = float64(stepIndex)
-		leftVel[stepIndex].Y = float64(byteDataL) * Settings.StepSize_MM / (32.0 * 0.002)
+		leftVel[stepIndex].Y = float64(frame.Left) * Settings.StepSize_MM / (32.0 * 0.002)
 
 		rightVel[stepIndex].X = float64(stepIndex)
-		rightVel[stepIndex].Y = float64(byteDataR) * Settings.StepSize_MM / (32.0 * 0.002)
+		rightVel[stepIndex].Y = float64(frame.Right) * Settings.StepSize_MM / (32.0 * 0.002)
 
 		leftPos[stepIndex].X = float64(stepIndex)
 		if stepIndex > 0 {
@@ -95,8 +95,8 @@ func WriteStepsToChart(stepData <-chan int8) {
 	p.Legend.Add("Left Vel", leftVelLine)
 	p.Legend.Add("Right Vel", rightVelLine)
 
-	// Save the plot to a PNG file.
-	if err := p.Save(14, 8.5, "chart.png"); err != nil {
+	// Save the plot, which picks the format from the file extension
+	if err := p.Save(options.ChartWidth_In, options.ChartHeight_In, options.FileName); err != nil {
 		panic(err)
 	}
 }
@@ -0,0 +1,340 @@
+package polargraph
+
+// Lets a plot be paused, resumed, nudged or aborted while it is being sent to the arduino
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Actions that can be taken while plotting
+type PlotAction int
+
+const (
+	// Stop sending the plot and lift the pen, remembering where the plot was paused
+	PauseAction PlotAction = iota
+
+	// Move back to where the plot was paused, restore the pen and continue
+	ResumeAction
+
+	// Lift the pen, move back to where the plot started and stop
+	AbortAction
+
+	// Move the pen by an offset while paused
+	NudgeAction
+)
+
+// A request to control a plot
+type PlotCommand struct {
+	Action PlotAction
+
+	// Distance to move for NudgeAction, in mm
+	Nudge Coordinate
+}
+
+// Parse a line of text into a PlotCommand, accepts pause/p, resume/r/an empty line, abort/q and nudge/n DX DY
+func ParsePlotCommand(line string) (command PlotCommand, err error) {
+	fields := strings.Fields(strings.ToLower(line))
+	if len(fields) == 0 {
+		return PlotCommand{Action: ResumeAction}, nil
+	}
+
+	switch fields[0] {
+	case "pause", "p":
+		command.Action = PauseAction
+	case "resume", "r":
+		command.Action = ResumeAction
+	case "abort", "q":
+		command.Action = AbortAction
+	case "nudge", "n":
+		command.Action = NudgeAction
+		if len(fields) != 3 {
+			return command, errors.New("nudge expects an X and Y distance in mm")
+		}
+		if command.Nudge.X, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return command, err
+		}
+		if command.Nudge.Y, err = strconv.ParseFloat(fields[2], 64); err != nil {
+			return command, err
+		}
+		command.Nudge.PenUp = true
+	default:
+		return command, fmt.Errorf("unknown command '%s', expected pause, resume, abort or nudge DX DY", fields[0])
+	}
+	return command, nil
+}
+
+// Read commands one per line from reader until it is closed, replies to errors are written to output
+func ReadPlotCommands(reader io.Reader, output io.Writer, commands chan<- PlotCommand) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		command, err := ParsePlotCommand(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(output, "ERROR:", err)
+			continue
+		}
+		commands <- command
+	}
+}
+
+// Read commands typed at the keyboard
+func ReadPlotCommandsFromKeyboard(commands chan<- PlotCommand) {
+	ReadPlotCommands(os.Stdin, os.Stdout, commands)
+}
+
+// SIGUSR1 pauses, SIGUSR2 resumes and SIGTERM aborts, until stop is called and the signals go back to their default behaviour
+// signals that arrive faster than the commands are read are dropped
+func ReadPlotCommandsFromSignals() (commands <-chan PlotCommand, stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM)
+
+	signalCommands := make(chan PlotCommand, 1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			var command PlotCommand
+			select {
+			case sig := <-signals:
+				switch sig {
+				case syscall.SIGUSR1:
+					command.Action = PauseAction
+				case syscall.SIGUSR2:
+					command.Action = ResumeAction
+				case syscall.SIGTERM:
+					command.Action = AbortAction
+				}
+			case <-done:
+				return
+			}
+
+			select {
+			case signalCommands <- command:
+			default:
+			}
+		}
+	}()
+
+	return signalCommands, func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// Accept tcp connections on address, each connection can send commands one per line
+// when token isn't empty it must be the first line of every connection, without one only loopback addresses are allowed
+func ReadPlotCommandsFromSocket(address, token string, commands chan<- PlotCommand) {
+	if token == "" && !isLoopbackAddress(address) {
+		panic(fmt.Sprint("Listening for plot commands on ", address, " would let anyone who can reach it control the plotter, use a localhost address or a -token"))
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Listening for plot commands on", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("WARNING: Unable to accept control connection", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			readPlotCommandsWithToken(conn, conn, token, commands)
+		}()
+	}
+}
+
+// Read commands one per line from a connection, when token isn't empty the first line must be the token
+func readPlotCommandsWithToken(reader io.Reader, output io.Writer, token string, commands chan<- PlotCommand) {
+	buffered := bufio.NewReader(reader)
+	if token != "" {
+		line, _ := buffered.ReadString('\n')
+		if !matchesToken(strings.TrimRight(line, "\r\n"), token) {
+			fmt.Fprintln(output, "ERROR: Expected the token as the first line")
+			return
+		}
+	}
+	ReadPlotCommands(buffered, output, commands)
+}
+
+// Decides what is sent to the arduino next, either the plot itself or moves created by PlotCommands
+type plotController struct {
+	stepData <-chan int8
+	controls <-chan PlotCommand
+	progress *plotProgress
+
+	// commands from signals, only received while the plot is being sent
+	signalControls <-chan PlotCommand
+
+	// pause every time the plot lifts the pen
+	pauseOnPenUp bool
+
+	// steps created by a command that are sent before anything else
+	injectedData <-chan int8
+
+	paused, aborted bool
+
+	// state of the plot when it was paused, restored when resuming
+	pausedPolar    PolarCoordinate
+	pausedPenUp    bool
+	pausedPenAngle int
+}
+
+// Returns the next frame to send, ok is false once nothing more will be sent and idle is true while paused
+func (controller *plotController) Next() (frame StepFrame, ok, idle bool) {
+	for {
+		if controller.injectedData != nil {
+			if frame, ok = ReadStepFrame(controller.injectedData); ok {
+				controller.progress.Injected(frame)
+				return frame, true, false
+			}
+			controller.injectedData = nil
+		}
+		if controller.aborted {
+			return frame, false, false
+		}
+
+		select {
+		case command := <-controller.controls:
+			controller.handle(command)
+			continue
+		case command := <-controller.signalControls:
+			controller.handle(command)
+			continue
+		default:
+		}
+
+		if controller.paused {
+			return frame, true, true
+		}
+
+		wasPenUp := controller.progress.replay.PenUp
+		if frame, ok = ReadStepFrame(controller.stepData); ok {
+			if frame.Command == PenChangeCommand {
+				// the arduino doesn't know about pen changes, the plot just waits to be resumed
+				controller.pause()
+				fmt.Println("Change to pen", frame.Args[0], "then resume")
+				controller.progress.Log("Waiting for pen", frame.Args[0])
+				continue
+			}
+			controller.progress.Sent(frame)
+			if controller.pauseOnPenUp && !wasPenUp && controller.progress.replay.PenUp {
+				controller.pause()
+			}
+		}
+		return frame, ok, false
+	}
+}
+
+// Act on a PlotCommand
+func (controller *plotController) handle(command PlotCommand) {
+	if controller.aborted {
+		return
+	}
+
+	switch command.Action {
+	case PauseAction:
+		if controller.paused {
+			return
+		}
+		controller.pause()
+		controller.inject(func(stepData chan<- int8) {
+			SendPenHeight(Settings.PenUpAngle, true, stepData)
+		})
+
+	case ResumeAction:
+		if !controller.paused {
+			return
+		}
+		controller.paused = false
+		controller.progress.paused = false
+		controller.progress.Publish()
+		fmt.Println("Resuming plot")
+		controller.progress.Log("Resumed")
+		current, target := controller.progress.replay.Polar, controller.pausedPolar
+		penUp, penAngle := controller.pausedPenUp, controller.pausedPenAngle
+		controller.inject(func(stepData chan<- int8) {
+			generateMoveTo(current, target, stepData)
+			if !penUp {
+				SendPenHeight(penAngle, false, stepData)
+			}
+		})
+
+	case NudgeAction:
+		if !controller.paused {
+			fmt.Println("WARNING: Can only nudge the pen while paused")
+			return
+		}
+		controller.progress.Log("Nudged by", command.Nudge)
+		current := controller.progress.replay.Polar
+		controller.inject(func(stepData chan<- int8) {
+			generateMove(current, command.Nudge, stepData)
+		})
+
+	case AbortAction:
+		controller.aborted = true
+		controller.paused = false
+		controller.progress.paused = false
+		fmt.Println("Aborting plot, returning to the starting position")
+		controller.progress.Log("Aborted at", controller.progress.Position())
+		current, target := controller.progress.replay.Polar, controller.progress.replay.startingPolar
+		controller.inject(func(stepData chan<- int8) {
+			SendPenHeight(Settings.PenUpAngle, true, stepData)
+			generateMoveTo(current, target, stepData)
+		})
+	}
+}
+
+// Stop sending the plot, remembering where it was stopped
+func (controller *plotController) pause() {
+	replay := controller.progress.replay
+	controller.paused = true
+	controller.progress.paused = true
+	controller.progress.Publish()
+	controller.pausedPolar = replay.Polar
+	controller.pausedPenUp = replay.PenUp
+	controller.pausedPenAngle = replay.PenAngle
+
+	fmt.Println()
+	fmt.Println("Paused at", controller.progress.Position(), "- enter resume (or an empty line), abort, or nudge DX DY")
+	controller.progress.Log("Paused at", controller.progress.Position())
+}
+
+// Send the steps created by generate before anything else
+func (controller *plotController) inject(generate func(stepData chan<- int8)) {
+	injectedData := make(chan int8, 1024)
+	controller.injectedData = injectedData
+	go func() {
+		defer close(injectedData)
+		generate(injectedData)
+	}()
+}
+
+// Generate the steps to move with the pen up between the given spool distances
+func generateMoveTo(from, to PolarCoordinate, stepData chan<- int8) {
+	polarSystem := PolarSystemFromSettings()
+	generateMove(from, to.ToCoord(polarSystem).Minus(from.ToCoord(polarSystem)), stepData)
+}
+
+// Generate the steps to move with the pen up by offset from the given spool distances
+func generateMove(from PolarCoordinate, offset Coordinate, stepData chan<- int8) {
+	if offset.Len() < 0.001 {
+		return
+	}
+
+	plotCoords := make(chan Coordinate, 1)
+	offset.PenUp = true
+	plotCoords <- offset
+	close(plotCoords)
+	generateStepsFrom(from, plotCoords, stepData, nil)
+}
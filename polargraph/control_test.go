@@ -0,0 +1,187 @@
+package polargraph
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParsePlotCommand(t *testing.T) {
+	tests := map[string]PlotCommand{
+		"":             PlotCommand{Action: ResumeAction},
+		"pause":        PlotCommand{Action: PauseAction},
+		"R":            PlotCommand{Action: ResumeAction},
+		"q":            PlotCommand{Action: AbortAction},
+		"nudge -1 2.5": PlotCommand{Action: NudgeAction, Nudge: Coordinate{X: -1, Y: 2.5, PenUp: true}},
+	}
+	for line, expected := range tests {
+		if command, err := ParsePlotCommand(line); err != nil || command != expected {
+			t.Error("Parsing", line, "expected", expected, "got", command, err)
+		}
+	}
+
+	for _, line := range []string{"jump", "nudge 1", "n 1 x"} {
+		if _, err := ParsePlotCommand(line); err == nil {
+			t.Error("Expected error parsing", line)
+		}
+	}
+}
+
+// signals should become commands only until stop is called
+func TestReadPlotCommandsFromSignals(t *testing.T) {
+	commands, stop := ReadPlotCommandsFromSignals()
+	defer stop()
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	select {
+	case command := <-commands:
+		if command.Action != PauseAction {
+			t.Error("Expected SIGUSR1 to pause, got", command)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a command from SIGUSR1")
+	}
+}
+
+// a connection with a token must send it first, and only loopback addresses can be used without one
+func TestReadPlotCommandsWithToken(t *testing.T) {
+	var output bytes.Buffer
+	commands := make(chan PlotCommand, 2)
+	readPlotCommandsWithToken(strings.NewReader("secret\npause\n"), &output, "secret", commands)
+	if len(commands) != 1 || (<-commands).Action != PauseAction {
+		t.Error("Expected the command after the token to be read")
+	}
+
+	readPlotCommandsWithToken(strings.NewReader("wrong\nabort\n"), &output, "secret", commands)
+	if len(commands) != 0 || !strings.Contains(output.String(), "ERROR") {
+		t.Error("Expected a connection without the token to be refused, got", output.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected listening on every interface without a token to be refused")
+		}
+	}()
+	ReadPlotCommandsFromSocket(":0", "", commands)
+}
+
+// read frames until the controller goes idle or stops, returns the number of frames read
+func readUntilIdle(t *testing.T, controller *plotController) (frames int) {
+	for ; frames < 100000; frames++ {
+		if _, ok, idle := controller.Next(); !ok || idle {
+			return
+		}
+	}
+	t.Fatal("Controller never went idle")
+	return
+}
+
+func TestPlotController(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 1000
+	Settings.StartingLeftDist_MM = 600
+	Settings.StartingRightDist_MM = 600
+	Settings.StepSize_MM = 0.1
+	Settings.MaxSpeed_MM_S = 100
+	Settings.Acceleration_MM_S2 = 500
+	Settings.DrawingSurfaceMinX_MM = 0
+	Settings.DrawingSurfaceMaxX_MM = 1000
+	Settings.DrawingSurfaceMinY_MM = 0
+	Settings.DrawingSurfaceMaxY_MM = 1000
+	plotLogFile = filepath.Join(os.TempDir(), "gocupi_test_plot_log.txt")
+	defer os.Remove(plotLogFile)
+
+	stepData := make(chan int8, 1024)
+	SendPenHeight(130, false, stepData)
+	for i := 0; i < 20; i++ {
+		encodeSlice(-32, 32, stepData)
+	}
+	close(stepData)
+
+	controls := make(chan PlotCommand, 1)
+	progress := newPlotProgress(0, 0, nil)
+	defer progress.Close()
+	controller := &plotController{stepData: stepData, controls: controls, progress: progress}
+	replay := progress.replay
+
+	// pen down and 10 slices
+	for i := 0; i < 11; i++ {
+		controller.Next()
+	}
+	pausedPolar := replay.Polar
+
+	controls <- PlotCommand{Action: PauseAction}
+	readUntilIdle(t, controller)
+	if !replay.PenUp {
+		t.Error("Expected pausing to lift the pen")
+	}
+
+	controls <- PlotCommand{Action: NudgeAction, Nudge: Coordinate{X: 5, Y: 0}}
+	readUntilIdle(t, controller)
+	if nudged := replay.Polar.ToCoord(replay.polarSystem).Minus(pausedPolar.ToCoord(replay.polarSystem)); math.Abs(nudged.X-5) > 0.1 || math.Abs(nudged.Y) > 0.1 {
+		t.Error("Expected nudge of 5, 0 got", nudged)
+	}
+
+	// resuming moves back, lowers the pen to its previous height, then continues the plot
+	controls <- PlotCommand{Action: ResumeAction}
+	for replay.PenUp {
+		if _, ok, idle := controller.Next(); !ok || idle {
+			t.Fatal("Expected pen to be lowered when resuming")
+		}
+	}
+	if math.Abs(replay.Polar.LeftDist-pausedPolar.LeftDist) > 0.1 || math.Abs(replay.Polar.RightDist-pausedPolar.RightDist) > 0.1 || replay.PenAngle != 130 {
+		t.Error("Expected to resume at", pausedPolar, "angle 130, got", replay.Polar, replay.PenAngle)
+	}
+
+	controls <- PlotCommand{Action: AbortAction}
+	readUntilIdle(t, controller)
+	if _, ok, _ := controller.Next(); ok {
+		t.Error("Expected nothing more to be sent after aborting")
+	}
+	// positions can be off by less than a single step
+	if math.Abs(replay.Polar.LeftDist-600) > 0.11 || math.Abs(replay.Polar.RightDist-600) > 0.11 || !replay.PenUp {
+		t.Error("Expected abort to return to the start with the pen up, got", replay.Polar, replay.PenUp)
+	}
+}
+
+func TestPlotControllerPenChange(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 1000
+	Settings.StartingLeftDist_MM = 600
+	Settings.StartingRightDist_MM = 600
+	Settings.StepSize_MM = 0.1
+	plotLogFile = filepath.Join(os.TempDir(), "gocupi_test_plot_log.txt")
+	defer os.Remove(plotLogFile)
+
+	stepData := make(chan int8, 1024)
+	encodeSlice(-32, 32, stepData)
+	SendPenChange(2, stepData)
+	encodeSlice(-32, 32, stepData)
+	close(stepData)
+
+	progress := newPlotProgress(0, 0, nil)
+	defer progress.Close()
+	controls := make(chan PlotCommand, 1)
+	controller := &plotController{stepData: stepData, controls: controls, progress: progress}
+
+	// the pen change is never sent, the plot waits to be resumed instead
+	if frames := readUntilIdle(t, controller); frames != 1 || !controller.paused {
+		t.Error("Expected to pause after 1 frame, sent", frames, "paused", controller.paused)
+	}
+
+	controls <- PlotCommand{Action: ResumeAction}
+	for {
+		frame, ok, idle := controller.Next()
+		if !ok {
+			break
+		}
+		if idle || frame.Command == PenChangeCommand {
+			t.Fatal("Expected the rest of the plot after resuming, got", frame.Command, idle)
+		}
+	}
+}
@@ -11,6 +11,12 @@ import (
 type Coordinate struct {
 	X, Y  float64
 	PenUp bool
+
+	// How lightly the pen touches while down, 0 presses at Settings.PenDownAngle and 1 touches at Settings.PenLightAngle
+	PenHeight float64
+
+	// When above 0 the pen is raised and the plot pauses before this move, so the pen can be changed to this pen number
+	PenChange int
 }
 
 // Coordinate ToString
@@ -18,6 +24,8 @@ func (coord Coordinate) String() string {
 
 	if coord.PenUp {
 		return fmt.Sprintf("[ %.2f, %.2f, UP ]", coord.X, coord.Y)
+	} else if coord.PenHeight != 0 {
+		return fmt.Sprintf("[ %.2f, %.2f, H %.2f ]", coord.X, coord.Y, coord.PenHeight)
 	} else {
 		return fmt.Sprintf("[ %.2f, %.2f ]", coord.X, coord.Y)
 	}
@@ -31,43 +39,51 @@ func (coord Coordinate) Len() float64 {
 
 // Add two coordinates together
 func (source Coordinate) Add(dest Coordinate) Coordinate {
-	return Coordinate{dest.X + source.X, dest.Y + source.Y, dest.PenUp || source.PenUp}
+	return Coordinate{dest.X + source.X, dest.Y + source.Y, dest.PenUp || source.PenUp, math.Max(dest.PenHeight, source.PenHeight), maxPenChange(dest.PenChange, source.PenChange)}
 }
 
 // Return the vector from source to dest
 func (source Coordinate) Minus(dest Coordinate) Coordinate {
-	return Coordinate{source.X - dest.X, source.Y - dest.Y, source.PenUp || dest.PenUp}
+	return Coordinate{source.X - dest.X, source.Y - dest.Y, source.PenUp || dest.PenUp, math.Max(source.PenHeight, dest.PenHeight), maxPenChange(source.PenChange, dest.PenChange)}
+}
+
+// Larger of two pen changes, so combining coordinates keeps any pen change
+func maxPenChange(first, second int) int {
+	if first > second {
+		return first
+	}
+	return second
 }
 
 // Scales the Coordinate by the specified factor
 func (coord Coordinate) Scaled(factor float64) Coordinate {
-	return Coordinate{coord.X * factor, coord.Y * factor, coord.PenUp}
+	return Coordinate{coord.X * factor, coord.Y * factor, coord.PenUp, coord.PenHeight, coord.PenChange}
 }
 
 // Scale each axis seperately
 func (coord Coordinate) ScaledBoth(xfactor, yfactor float64) Coordinate {
-	return Coordinate{coord.X * xfactor, coord.Y * yfactor, coord.PenUp}
+	return Coordinate{coord.X * xfactor, coord.Y * yfactor, coord.PenUp, coord.PenHeight, coord.PenChange}
 }
 
 // Apply math.Ceil to each value
 func (coord Coordinate) Ceil() Coordinate {
-	return Coordinate{math.Ceil(coord.X), math.Ceil(coord.Y), coord.PenUp}
+	return Coordinate{math.Ceil(coord.X), math.Ceil(coord.Y), coord.PenUp, coord.PenHeight, coord.PenChange}
 }
 
 // Apply math.Floor to each value
 func (coord Coordinate) Floor() Coordinate {
-	return Coordinate{math.Floor(coord.X), math.Floor(coord.Y), coord.PenUp}
+	return Coordinate{math.Floor(coord.X), math.Floor(coord.Y), coord.PenUp, coord.PenHeight, coord.PenChange}
 }
 
 // Clamp the values of X,Y to the given max/min
 func (coord Coordinate) Clamp(max, min float64) Coordinate {
-	return Coordinate{math.Min(max, math.Max(coord.X, min)), math.Min(max, math.Max(coord.Y, min)), coord.PenUp}
+	return Coordinate{math.Min(max, math.Max(coord.X, min)), math.Min(max, math.Max(coord.Y, min)), coord.PenUp, coord.PenHeight, coord.PenChange}
 }
 
 // Normalize the vector
 func (coord Coordinate) Normalized() Coordinate {
 	len := coord.Len()
-	return Coordinate{coord.X / len, coord.Y / len, coord.PenUp}
+	return Coordinate{coord.X / len, coord.Y / len, coord.PenUp, coord.PenHeight, coord.PenChange}
 }
 
 // Dot product between two vectors
@@ -83,7 +99,7 @@ func (coord Coordinate) IsNaN() bool {
 // Test if the two coordinates are equal within a constant epsilon
 func (coord Coordinate) Equals(other Coordinate) bool {
 	diff := coord.Minus(other)
-	return diff.Len() < 0.00001 && coord.PenUp == other.PenUp
+	return diff.Len() < 0.00001 && coord.PenUp == other.PenUp && math.Abs(coord.PenHeight-other.PenHeight) < 0.00001
 }
 
 // PolarSystem information, 0,0 is always the upper left motor
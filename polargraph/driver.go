@@ -3,7 +3,6 @@ package polargraph
 // Handles sending data over serial to the arduino
 
 import (
-	"bufio"
 	"fmt"
 	serial "github.com/tarm/goserial"
 	"io"
@@ -25,6 +24,11 @@ func OutputCoords(plotCoords <-chan Coordinate) {
 
 // Takes in coordinates and outputs stepData
 func GenerateSteps(plotCoords <-chan Coordinate, stepData chan<- int8) {
+	generateSteps(plotCoords, stepData, nil)
+}
+
+// Generate steps for plotCoords, calling targetStarted with the index of each coordinate before writing its steps when it isn't nil
+func generateSteps(plotCoords <-chan Coordinate, stepData chan<- int8, targetStarted func(target int)) {
 
 	defer close(stepData)
 
@@ -38,6 +42,19 @@ func GenerateSteps(plotCoords <-chan Coordinate, stepData chan<- int8) {
 		panic(fmt.Sprint("Starting location is not a valid number, setup has impossible values"))
 	}
 
+	SendPenTiming(Settings.PenLiftWait_MS(), Settings.PenDropDelay_MS, stepData)
+
+	generateStepsFrom(previousPolarPos, plotCoords, stepData, targetStarted)
+	fmt.Println("Done generating steps")
+}
+
+// Generate steps for plotCoords starting with the pen raised at the given spool distances, which becomes 0,0 for plotCoords
+// targetStarted is called with the index of each coordinate before its steps are written when it isn't nil
+func generateStepsFrom(previousPolarPos PolarCoordinate, plotCoords <-chan Coordinate, stepData chan<- int8, targetStarted func(target int)) {
+
+	polarSystem := PolarSystemFromSettings()
+	startingLocation := previousPolarPos.ToCoord(polarSystem)
+
 	// setup 0,0 as the initial location of the plot head
 	polarSystem.XOffset = startingLocation.X
 	polarSystem.YOffset = startingLocation.Y
@@ -52,25 +69,38 @@ func GenerateSteps(plotCoords <-chan Coordinate, stepData chan<- int8) {
 	}
 
 	var currentPenUp bool = true // arduino code defaults to pen up on ResetCommand
+	var currentPenAngle int = Settings.PenUpAngle
 	var anotherTarget bool = true
 
-	for anotherTarget {
+	for targetIndex := 0; anotherTarget; targetIndex++ {
 		nextTarget, chanOpen := <-plotCoords
 		if !chanOpen {
 			anotherTarget = false
 			nextTarget = target
 		}
 
-		if target.PenUp != currentPenUp {
-			// send twice in order to preserve alignment of always sending 2 values at a time over serial
-			if target.PenUp {
-				stepData <- PenUpCommand
-				stepData <- PenUpCommand
-			} else {
-				stepData <- PenDownCommand
-				stepData <- PenDownCommand
+		if targetStarted != nil {
+			targetStarted(targetIndex)
+		}
+
+		// the pen is lifted out of the way before pausing to change it
+		if target.PenChange > 0 {
+			if !currentPenUp {
+				SendPenHeight(Settings.PenUpAngle, true, stepData)
+				currentPenUp = true
+				currentPenAngle = Settings.PenUpAngle
 			}
+			SendPenChange(target.PenChange, stepData)
+		}
+
+		targetPenAngle := Settings.PenUpAngle
+		if !target.PenUp {
+			targetPenAngle = Settings.PenAngle(target.PenHeight)
+		}
+		if target.PenUp != currentPenUp || targetPenAngle != currentPenAngle {
+			SendPenHeight(targetPenAngle, target.PenUp, stepData)
 			currentPenUp = target.PenUp
+			currentPenAngle = targetPenAngle
 		}
 
 		interp.Setup(origin, target, nextTarget)
@@ -82,22 +112,20 @@ func GenerateSteps(plotCoords <-chan Coordinate, stepData chan<- int8) {
 			sliceTarget := interp.Position(slice)
 			polarSliceTarget := sliceTarget.ToPolar(polarSystem)
 
-			// calc number of steps that will be made this time slice, have to precision that can be sent in a single value from StepsMaxValue to -StepsMaxValue
+			// calc number of steps that will be made this time slice, limited to the largest value that can be sent in a single slice
 			sliceSteps := polarSliceTarget.
 				Minus(previousPolarPos).
 				Scaled(StepsFixedPointFactor/Settings.StepSize_MM).
 				Ceil().
-				Clamp(StepsMaxValue, -StepsMaxValue)
+				Clamp(Settings.MaxStepsPerSlice(), -Settings.MaxStepsPerSlice())
 			previousPolarPos = previousPolarPos.
 				Add(sliceSteps.Scaled(Settings.StepSize_MM / StepsFixedPointFactor))
 
-			stepData <- int8(-sliceSteps.LeftDist)
-			stepData <- int8(sliceSteps.RightDist)
+			encodeSlice(int(-sliceSteps.LeftDist), int(sliceSteps.RightDist), stepData)
 		}
 		origin = previousPolarPos.ToCoord(polarSystem)
 		target = nextTarget
 	}
-	fmt.Println("Done generating steps")
 }
 
 // Count steps
@@ -105,38 +133,51 @@ func CountSteps(stepData <-chan int8) {
 
 	sliceCount := 0
 	penTransition := 0
-	for step := range stepData {
+	wait_MS := 0
+	penUp := true
+	liftDelay_MS, dropDelay_MS := DefaultPenDelay_MS, DefaultPenDelay_MS
+	for frame, ok := ReadStepFrame(stepData); ok; frame, ok = ReadStepFrame(stepData) {
 
-		if step == PenUpCommand || step == PenDownCommand {
+		// only raising or lowering the pen waits for the servo, height changes while drawing do not
+		if movesPen, framePenUp := frame.PenState(); movesPen && framePenUp != penUp {
 			penTransition++
-		} else {
+			penUp = framePenUp
+			if penUp {
+				wait_MS += liftDelay_MS
+			} else {
+				wait_MS += dropDelay_MS
+			}
+		}
+
+		switch frame.Command {
+		case NoCommand:
 			sliceCount++
+		case DwellCommand:
+			wait_MS += frame.Args[0]
+		case PenTimingCommand:
+			liftDelay_MS, dropDelay_MS = frame.Args[0], frame.Args[1]
 		}
 	}
-	// since data is sent once for left and right spools, have to divide by 2
-	sliceCount = sliceCount >> 1
-	penTransition = penTransition >> 1
-	penTransitionCooldown_US := 1250000.0 // as defined in the microcontroller code
-	fmt.Println("Steps", sliceCount, "Pen Transitions", penTransition, "Time", time.Duration(float64(sliceCount)*TimeSlice_US+float64(penTransition)*penTransitionCooldown_US)*time.Microsecond)
+	fmt.Println("Steps", sliceCount, "Pen Transitions", penTransition, "Time", time.Duration(float64(sliceCount)*TimeSlice_US+float64(wait_MS)*1000)*time.Microsecond)
 }
 
-// Sends the given stepData to a file
-func WriteStepsToFile(stepData <-chan int8) {
+// Sends the given stepData to a text file
+func WriteStepsToFile(fileName string, stepData <-chan int8) {
 
-	file, err := os.OpenFile("stepData.txt", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
 	if err != nil {
 		panic(err)
 	}
 	defer file.Close()
 
-	var byteDataL, byteDataR int8
 	size := 0
-	for stepDataOpen := true; stepDataOpen; {
+	for frame, ok := ReadStepFrame(stepData); ok; frame, ok = ReadStepFrame(stepData) {
 
-		byteDataL, stepDataOpen = <-stepData
-		byteDataR, stepDataOpen = <-stepData
-
-		io.WriteString(file, fmt.Sprintln(byteDataL, byteDataR))
+		if frame.IsSlice() {
+			io.WriteString(file, fmt.Sprintln(frame.Left, frame.Right))
+		} else {
+			io.WriteString(file, fmt.Sprintln(frame.Raw[0], frame.Raw[1]))
+		}
 		size++
 		if size > 10000 {
 			return
@@ -144,86 +185,216 @@ func WriteStepsToFile(stepData <-chan int8) {
 	}
 }
 
-// Sends the given stepData to the stepper driver
-func WriteStepsToSerial(stepData <-chan int8, pauseOnPenUp bool) {
+// Opens the serial port the arduino is connected to
+var openSerialPort = func() (io.ReadWriteCloser, error) {
+	return serial.OpenPort(&serial.Config{Name: "/dev/ttyAMA0", Baud: 57600})
+}
+
+// Sends the given stepData to the stepper driver, refusing to send anything if generation failed part way through
+// controls can pause, resume, nudge or abort the plot while it is being sent, and progress is published to updates, any can be nil
+// returns true if the plot was aborted
+func WriteStepsToSerial(stepData <-chan int8, generation *Generation, pauseOnPenUp bool, controls <-chan PlotCommand, updates chan<- PlotUpdate) (aborted bool) {
 	if pauseOnPenUp {
 		fmt.Println("Pause on PenUp enabled!")
 	}
 
+	// open the port first so a missing arduino is reported before the whole job is generated
 	fmt.Println("Opening com port")
-	c := &serial.Config{Name: "/dev/ttyAMA0", Baud: 57600}
-	s, err := serial.OpenPort(c)
+	s, err := openSerialPort()
 	if err != nil {
 		panic(err)
 	}
 	defer s.Close()
 
+	totalTime_US, totalSlices := unknownTotalTime_US, 0
+	if generation.Streamed() {
+		// the drawing was checked before it started so it is sent as it is generated, anything left after an abort is discarded
+		fmt.Println("Sending the job as it is generated, its length isn't known yet")
+		defer func() {
+			go func() {
+				for range stepData {
+				}
+			}()
+		}()
+	} else {
+		// count the whole job up front so progress and ETA can be shown
+		var stopBuffered func()
+		stepData, totalTime_US, totalSlices, stopBuffered = BufferSteps(stepData)
+		defer stopBuffered() // an aborted plot leaves the rest of the buffered data unread
+		if err := generation.Err(); err != nil {
+			panic(fmt.Sprint("Drawing stopped part way through, nothing was sent: ", err))
+		}
+		fmt.Println("Job is", totalSlices, "slices, estimated time", time.Duration(totalTime_US)*time.Microsecond)
+	}
+
 	// buffers to use during serial communication
 	writeData := make([]byte, 128)
-	readData := make([]byte, 1)
 
-	previousSend := time.Now()
 	var totalSends int = 0
-	var byteData int8 = 0
+
+	// encoded values of the current frame that have not been sent yet, frames can be split across two writes
+	var pendingData []int8
+
+	// running total of all step values sent, used to verify the final position reported by the arduino
+	var sentLeft, sentRight int64
+	receivedStatus := false
+	penUp := true
+
+	statusLog := newStatusLogger(statusLogFile)
+	defer statusLog.Close()
+
+	progress := newPlotProgress(totalTime_US, totalSlices, updates)
+	defer progress.Close()
+
+	// signals only control the plot while it is being sent, the rest of the time SIGTERM still ends the process
+	signalControls, stopSignals := ReadPlotCommandsFromSignals()
+	defer stopSignals()
+
+	controller := &plotController{
+		stepData:       stepData,
+		controls:       controls,
+		signalControls: signalControls,
+		progress:       progress,
+		pauseOnPenUp:   pauseOnPenUp,
+	}
 
 	// send a -128 to force the arduino to restart and rerequest data
 	s.Write([]byte{ResetCommand})
 
-	var pauseAfterWrite = false
+	// data requests that arrived while waiting for the arduino to confirm wide slice support, answered before reading any more
+	queuedRequest := 0
+	if Settings.WideSteps {
+		fmt.Println("Waiting for arduino to confirm wide step support")
+		status, requested, err := waitForStatus(s, statusTimeout)
+		if err != nil {
+			panic(fmt.Sprint("WideSteps is enabled in ", settingsFile, " but the arduino did not confirm it: ", err))
+		}
+		if !status.WideSteps {
+			panic("WideSteps is enabled in " + settingsFile + " but the arduino code does not support wide slices")
+		}
+		receivedStatus = true
+		reportStatus(status, statusLog, progress)
+		queuedRequest = requested
+	}
 
 	for stepDataOpen := true; stepDataOpen; {
-		// wait for next data request
-		n, err := s.Read(readData)
-		if err != nil {
-			panic(err)
+		dataToWrite := queuedRequest
+		queuedRequest = 0
+		if dataToWrite == 0 {
+			// wait for next data request, showing any status reports that arrive in the meantime
+			var status *ControllerStatus
+			if dataToWrite, status = readSerialMessage(s); status != nil {
+				receivedStatus = true
+				reportStatus(*status, statusLog, progress)
+				continue
+			}
 		}
-		if n != 1 {
-			panic(err)
+		if dataToWrite > len(writeData) {
+			writeData = make([]byte, dataToWrite)
 		}
 
-		dataToWrite := int(readData[0])
-		for i := 0; i < dataToWrite; i += 2 {
+		for i := 0; i < dataToWrite; i++ {
 
-			if pauseAfterWrite {
-				// want to fill remainder of buffer with 0s before writing it to serial
-				writeData[i] = byte(0)
-				writeData[i+1] = byte(0)
-			} else {
-				// even if stepData is closed and empty, receiving from it will return default value 0 for byteData and false for stepDataOpen
-				byteData, stepDataOpen = <-stepData
-				writeData[i] = byte(byteData)
-				byteData, stepDataOpen = <-stepData
-				writeData[i+1] = byte(byteData)
-
-				// pause on pen up
-				if byteData == PenUpCommand {
+			if len(pendingData) == 0 && stepDataOpen {
+				frame, ok, idle := controller.Next()
+				stepDataOpen = ok
+
+				movesPen, framePenUp := frame.PenState()
+				switch {
+				case !ok, idle:
+					// stepData is closed and empty or the plot is paused, finish the buffer with 0s
+				case movesPen && framePenUp && !penUp:
 					fmt.Println("PenUp...")
-					pauseAfterWrite = pauseOnPenUp
-				} else if byteData == PenDownCommand {
+					penUp = true
+				case movesPen && !framePenUp && penUp:
 					fmt.Println("PenDown...")
+					penUp = false
+				case frame.Command == SetPositionCommand:
+					sentLeft = int64(frame.Left)
+					sentRight = int64(frame.Right)
+				case frame.IsSlice():
+					sentLeft += int64(frame.Left)
+					sentRight += int64(frame.Right)
 				}
+				pendingData = frame.Raw
+			}
+
+			if len(pendingData) > 0 {
+				writeData[i] = byte(pendingData[0])
+				pendingData = pendingData[1:]
+			} else {
+				// when paused or finished want to fill remainder of buffer with 0s before writing it to serial
+				writeData[i] = byte(0)
 			}
 		}
 
+		// older arduino code never sends status reports, so show progress as data is sent instead
 		totalSends++
-		if totalSends >= 100 {
-			curTime := time.Now()
-
-			fmt.Println("Sent 100 messages after", curTime.Sub(previousSend))
+		if totalSends >= 100 && !receivedStatus {
+			fmt.Print("\r", progress)
+			progress.Publish()
 			totalSends = 0
+		}
 
-			previousSend = curTime
+		s.Write(writeData[:dataToWrite])
+	}
+
+	// older arduino code never sends status reports, so there is nothing to compare against
+	if receivedStatus {
+		verifyFinalPosition(s, sentLeft, sentRight, statusLog, progress)
+	}
+
+	// a streamed drawing that failed part way through has been plotted up to where it stopped
+	if !controller.aborted && generation.Streamed() {
+		if err := generation.Err(); err != nil {
+			panic(fmt.Sprint("Drawing stopped part way through, it was plotted up to there: ", err))
 		}
+	}
+	return controller.aborted
+}
 
-		s.Write(writeData)
+// Output a status report as a live progress line and add it to the log
+func reportStatus(status ControllerStatus, statusLog *statusLogger, progress *plotProgress) {
+	progress.Status(status)
+	progress.Publish()
+	fmt.Print("\r", progress, "  ", status)
+	statusLog.Log(status)
+}
+
+// Wait for the arduino to empty its buffer, then check that its spool positions match the total of all steps sent
+func verifyFinalPosition(reader io.Reader, sentLeft, sentRight int64, statusLog *statusLogger, progress *plotProgress) {
 
-		if pauseAfterWrite {
-			pauseAfterWrite = false
+	fmt.Println()
+	fmt.Println("Waiting for the arduino to finish moving")
 
-			fmt.Println("Press any key to continue...")
-			reader := bufio.NewReader(os.Stdin)
-			reader.ReadString('\n')
+	// require two reports in a row with an empty buffer so the final slice has time to complete
+	var status *ControllerStatus
+	for idleReports := 0; idleReports < 2; {
+		if _, status = readSerialMessage(reader); status == nil {
+			continue
 		}
+		reportStatus(*status, statusLog, progress)
+
+		if status.BufferLength == 0 {
+			idleReports++
+		} else {
+			idleReports = 0
+		}
+	}
+	fmt.Println()
+
+	if status.Error {
+		fmt.Println("WARNING: Arduino reported that it dropped data during the plot")
+	}
+
+	// the arduino only moves whole steps so its position can lag what was sent by less than a single step
+	leftDiff := float64(int64(status.LeftPos)-sentLeft) / StepsFixedPointFactor
+	rightDiff := float64(int64(status.RightPos)-sentRight) / StepsFixedPointFactor
+	if math.Abs(leftDiff) >= 1 || math.Abs(rightDiff) >= 1 {
+		fmt.Println("WARNING: Arduino position does not match what was sent, off by", leftDiff, "left steps and", rightDiff, "right steps")
+		progress.Log("Final position off by", leftDiff, "left steps and", rightDiff, "right steps")
+	} else {
+		fmt.Println("Verified final arduino position", status.Spools())
 	}
 }
 
@@ -250,7 +421,7 @@ func InteractiveMoveSpool() {
 func MoveSpool(leftSpool bool, distance float64) {
 
 	alignStepData := make(chan int8, 1024)
-	go WriteStepsToSerial(alignStepData, false)
+	go WriteStepsToSerial(alignStepData, nil, false, nil, nil)
 
 	interp := new(TrapezoidInterpolater)
 	interp.Setup(Coordinate{}, Coordinate{X: distance, Y: 0}, Coordinate{})
@@ -265,11 +436,9 @@ func MoveSpool(leftSpool bool, distance float64) {
 		position = position + sliceSteps*(Settings.StepSize_MM/StepsFixedPointFactor)
 
 		if leftSpool {
-			alignStepData <- int8(-sliceSteps)
-			alignStepData <- 0
+			encodeSlice(int(-sliceSteps), 0, alignStepData)
 		} else {
-			alignStepData <- 0
-			alignStepData <- int8(sliceSteps)
+			encodeSlice(0, int(sliceSteps), alignStepData)
 		}
 	}
 
@@ -284,8 +453,7 @@ func PerformMouseTracking() {
 	defer mouse.Close()
 
 	fmt.Println("Opening com port")
-	c := &serial.Config{Name: "/dev/ttyAMA0", Baud: 57600}
-	s, err := serial.OpenPort(c)
+	s, err := openSerialPort()
 	if err != nil {
 		panic(err)
 	}
@@ -295,7 +463,6 @@ func PerformMouseTracking() {
 
 	// buffers to use during serial communication
 	writeData := make([]byte, 128)
-	readData := make([]byte, 1)
 
 	polarSystem := PolarSystemFromSettings()
 	previousPolarPos := PolarCoordinate{LeftDist: Settings.StartingLeftDist_MM, RightDist: Settings.StartingRightDist_MM}
@@ -311,13 +478,10 @@ func PerformMouseTracking() {
 	// send a -128 to force the arduino to restart and rerequest data
 	s.Write([]byte{ResetCommand})
 	for stepDataOpen := true; stepDataOpen; {
-		// wait for next data request
-		n, err := s.Read(readData)
-		if err != nil {
-			panic(err)
-		}
-		if n != 1 {
-			panic(err)
+		// wait for next data request, status reports are not needed while moving with the mouse
+		dataToWrite, status := readSerialMessage(s)
+		if status != nil {
+			continue
 		}
 
 		if mouse.GetLeftButton() {
@@ -342,7 +506,6 @@ func PerformMouseTracking() {
 		}
 		//fmt.Println("Got mouse pos", mousePos)
 
-		dataToWrite := int(readData[0])
 		for i := 0; i < dataToWrite; i += 2 {
 
 			sliceTarget := currentPos.Add(direction.Scaled(float64(i) * distance / 128.0))
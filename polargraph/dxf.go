@@ -0,0 +1,477 @@
+package polargraph
+
+// Reads the entities of an ASCII DXF file and converts them to strokes, in the same form as the coordinates read from an svg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Largest distance a curve is allowed to stray from the lines it is flattened into, in mm
+const dxfCurveTolerance_MM float64 = 0.01
+
+// Millimetres in each of the units $INSUNITS can be set to, unitless drawings are taken to be in mm
+var dxfUnits_MM = map[int]float64{
+	0:  1,
+	1:  25.4,
+	2:  304.8,
+	3:  1609344,
+	4:  1,
+	5:  10,
+	6:  1000,
+	7:  1000000,
+	8:  0.0000254,
+	9:  0.0254,
+	10: 914.4,
+	11: 0.0000001,
+	12: 0.000001,
+	13: 0.001,
+	14: 100,
+}
+
+// A group code and its value, DXF files are made entirely of these pairs
+type dxfPair struct {
+	Code  int
+	Value string
+}
+
+// An entity and every pair up to the next one
+type dxfEntity struct {
+	Type  string
+	Pairs []dxfPair
+}
+
+// First value of a code as a number, or 0
+func (entity dxfEntity) float(code int) float64 {
+	for _, pair := range entity.Pairs {
+		if pair.Code == code {
+			value, _ := strconv.ParseFloat(pair.Value, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// Every value of a code as numbers, in the order they appear
+func (entity dxfEntity) floats(code int) []float64 {
+	values := make([]float64, 0)
+	for _, pair := range entity.Pairs {
+		if pair.Code == code {
+			value, _ := strconv.ParseFloat(pair.Value, 64)
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// First value of a code as text, or an empty string
+func (entity dxfEntity) text(code int) string {
+	for _, pair := range entity.Pairs {
+		if pair.Code == code {
+			return pair.Value
+		}
+	}
+	return ""
+}
+
+// Pairs of X and Y values, from the codes for X and Y
+func (entity dxfEntity) points(xCode, yCode int) []Coordinate {
+	xs, ys := entity.floats(xCode), entity.floats(yCode)
+	points := make([]Coordinate, int(math.Min(float64(len(xs)), float64(len(ys)))))
+	for index := range points {
+		points[index] = Coordinate{X: xs[index], Y: ys[index]}
+	}
+	return points
+}
+
+// True if the extrusion direction points away from the viewer, which mirrors X for entities in object coordinates
+func (entity dxfEntity) mirrored() bool {
+	return entity.float(230) < 0
+}
+
+// Converts entities to strokes in mm
+type dxfConverter struct {
+	// mm in a drawing unit
+	unit_MM float64
+
+	// entity types that were skipped because they aren't understood
+	ignored map[string]bool
+
+	data []Coordinate
+}
+
+// read a file, or stdin when fileName is -, and convert its entities, only entities on layer are read unless it is empty
+func ParseDxfFile(fileName, layer string) (Coordinates, error) {
+
+	file, err := OpenInput(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseDxf(file, layer)
+}
+
+// read DXF data and convert the LINE, LWPOLYLINE, POLYLINE, CIRCLE, ARC, ELLIPSE and SPLINE entities to strokes in mm with Y pointing down
+// each stroke starts with a pen up move, the same as paths read from an svg
+func ParseDxf(reader io.Reader, layer string) (Coordinates, error) {
+
+	pairs, err := readDxfPairs(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	units := 0
+	entities := make([]dxfEntity, 0)
+	section := ""
+	for index := 0; index < len(pairs); index++ {
+		pair := pairs[index]
+		switch {
+		case pair.Code == 0 && pair.Value == "SECTION" && index+1 < len(pairs):
+			index++
+			section = pairs[index].Value
+		case pair.Code == 0 && pair.Value == "ENDSEC":
+			section = ""
+		case section == "HEADER" && pair.Code == 9 && pair.Value == "$INSUNITS" && index+1 < len(pairs):
+			index++
+			if units, err = strconv.Atoi(pairs[index].Value); err != nil {
+				return nil, errors.New(fmt.Sprint("Invalid $INSUNITS of ", pairs[index].Value))
+			}
+		case section == "ENTITIES" && pair.Code == 0:
+			entities = append(entities, dxfEntity{Type: pair.Value})
+		case section == "ENTITIES" && len(entities) > 0:
+			entity := &entities[len(entities)-1]
+			entity.Pairs = append(entity.Pairs, pair)
+		}
+	}
+
+	unit_MM, ok := dxfUnits_MM[units]
+	if !ok {
+		return nil, errors.New(fmt.Sprint("Unsupported $INSUNITS of ", units))
+	}
+	converter := dxfConverter{unit_MM: unit_MM, ignored: make(map[string]bool), data: make([]Coordinate, 0)}
+
+	for index := 0; index < len(entities); index++ {
+		entity := entities[index]
+
+		// the vertices of a POLYLINE are the VERTEX entities that follow it
+		var vertices []dxfEntity
+		if entity.Type == "POLYLINE" {
+			for index+1 < len(entities) && entities[index+1].Type == "VERTEX" {
+				index++
+				vertices = append(vertices, entities[index])
+			}
+		}
+
+		if layer != "" && !strings.EqualFold(entity.text(8), layer) {
+			continue
+		}
+		converter.convert(entity, vertices)
+	}
+
+	if len(converter.ignored) > 0 {
+		ignored := make([]string, 0, len(converter.ignored))
+		for entityType := range converter.ignored {
+			ignored = append(ignored, entityType)
+		}
+		sort.Strings(ignored)
+		fmt.Println("WARNING: Skipped DXF entities that aren't supported:", strings.Join(ignored, ", "))
+	}
+
+	if len(converter.data) == 0 {
+		if layer != "" {
+			return nil, errors.New(fmt.Sprint("DXF contained no drawable entities on layer ", layer))
+		}
+		return nil, errors.New("DXF contained no drawable entities")
+	}
+	return converter.data, nil
+}
+
+// Read every group code and value
+func readDxfPairs(reader io.Reader) ([]dxfPair, error) {
+	buffered := bufio.NewReader(reader)
+	pairs := make([]dxfPair, 0)
+	for lineNumber := 1; ; lineNumber += 2 {
+		codeText, err := buffered.ReadString('\n')
+		if err == io.EOF && strings.TrimSpace(codeText) == "" {
+			return pairs, nil
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+		value, err := buffered.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		code, err := strconv.Atoi(strings.TrimSpace(codeText))
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Expected a DXF group code on line ", lineNumber, ", saw ", strconv.Quote(strings.TrimSpace(codeText))))
+		}
+		pairs = append(pairs, dxfPair{Code: code, Value: strings.TrimSpace(value)})
+		if code == 0 && strings.TrimSpace(value) == "EOF" {
+			return pairs, nil
+		}
+	}
+}
+
+// Convert a single entity
+func (converter *dxfConverter) convert(entity dxfEntity, vertices []dxfEntity) {
+	switch entity.Type {
+	case "LINE":
+		converter.stroke([]Coordinate{
+			{X: entity.float(10), Y: entity.float(20)},
+			{X: entity.float(11), Y: entity.float(21)},
+		}, false)
+
+	case "LWPOLYLINE":
+		// a bulge belongs to the vertex it follows, and curves the segment from that vertex to the next
+		points := make([]Coordinate, 0)
+		bulges := make([]float64, 0)
+		for _, pair := range entity.Pairs {
+			value, _ := strconv.ParseFloat(pair.Value, 64)
+			switch pair.Code {
+			case 10:
+				points = append(points, Coordinate{X: value})
+				bulges = append(bulges, 0)
+			case 20:
+				if len(points) > 0 {
+					points[len(points)-1].Y = value
+				}
+			case 42:
+				if len(bulges) > 0 {
+					bulges[len(bulges)-1] = value
+				}
+			}
+		}
+		converter.stroke(converter.bulgedPolyline(points, bulges, int(entity.float(70))&1 != 0), entity.mirrored())
+
+	case "POLYLINE":
+		// meshes and polyface faces aren't outlines
+		if flags := int(entity.float(70)); flags&(16|64) != 0 {
+			converter.ignored[entity.Type+" mesh"] = true
+			return
+		}
+		points := make([]Coordinate, 0)
+		bulges := make([]float64, 0)
+		for _, vertex := range vertices {
+			// spline frame control points aren't on the curve
+			if int(vertex.float(70))&16 != 0 {
+				continue
+			}
+			points = append(points, Coordinate{X: vertex.float(10), Y: vertex.float(20)})
+			bulges = append(bulges, vertex.float(42))
+		}
+		converter.stroke(converter.bulgedPolyline(points, bulges, int(entity.float(70))&1 != 0), entity.mirrored())
+
+	case "CIRCLE":
+		center := Coordinate{X: entity.float(10), Y: entity.float(20)}
+		converter.stroke(converter.arc(center, entity.float(40), 0, 2*math.Pi), entity.mirrored())
+
+	case "ARC":
+		center := Coordinate{X: entity.float(10), Y: entity.float(20)}
+		start, end := entity.float(50)*math.Pi/180, entity.float(51)*math.Pi/180
+		sweep := math.Mod(end-start, 2*math.Pi)
+		if sweep <= 0 {
+			sweep += 2 * math.Pi
+		}
+		converter.stroke(converter.arc(center, entity.float(40), start, sweep), entity.mirrored())
+
+	case "ELLIPSE":
+		converter.stroke(converter.ellipse(entity), false)
+
+	case "SPLINE":
+		converter.stroke(converter.spline(entity), false)
+
+	case "VERTEX", "SEQEND":
+		// part of a POLYLINE
+
+	default:
+		converter.ignored[entity.Type] = true
+	}
+}
+
+// Add a stroke in drawing units, starting with a pen up move to the first point
+func (converter *dxfConverter) stroke(points []Coordinate, mirrored bool) {
+	if len(points) < 2 {
+		return
+	}
+	for index, point := range points {
+		if mirrored {
+			point.X = -point.X
+		}
+		converter.data = append(converter.data, Coordinate{X: point.X * converter.unit_MM, Y: -point.Y * converter.unit_MM, PenUp: index == 0})
+	}
+}
+
+// Number of lines needed to keep a curve of the given radius and sweep in drawing units within dxfCurveTolerance_MM
+func (converter *dxfConverter) segments(radius, sweep float64) int {
+	tolerance := dxfCurveTolerance_MM / converter.unit_MM
+	if radius <= tolerance {
+		return 1
+	}
+	return int(math.Max(1, math.Ceil(math.Abs(sweep)/(2*math.Acos(1-tolerance/radius)))))
+}
+
+// Points along an arc, angles are counter clockwise from the X axis in radians
+func (converter *dxfConverter) arc(center Coordinate, radius, start, sweep float64) []Coordinate {
+	segments := converter.segments(radius, sweep)
+	points := make([]Coordinate, segments+1)
+	for segment := 0; segment <= segments; segment++ {
+		angle := start + sweep*float64(segment)/float64(segments)
+		points[segment] = Coordinate{X: center.X + radius*math.Cos(angle), Y: center.Y + radius*math.Sin(angle)}
+	}
+	return points
+}
+
+// Points along a polyline, a non zero bulge turns the segment after its vertex into an arc
+// the bulge is the tangent of a quarter of the arc's angle, positive bulges turn counter clockwise
+func (converter *dxfConverter) bulgedPolyline(vertices []Coordinate, bulges []float64, closed bool) []Coordinate {
+	if len(vertices) == 0 {
+		return nil
+	}
+	count := len(vertices) - 1
+	if closed {
+		count = len(vertices)
+	}
+
+	points := []Coordinate{vertices[0]}
+	for index := 0; index < count; index++ {
+		start, end := vertices[index], vertices[(index+1)%len(vertices)]
+		chord := end.Minus(start)
+		if bulges[index] == 0 || chord.Len() == 0 {
+			points = append(points, end)
+			continue
+		}
+
+		sweep := 4 * math.Atan(bulges[index])
+		radius := chord.Len() / (2 * math.Abs(math.Sin(sweep/2)))
+
+		// the center is to the left of the chord for counter clockwise arcs of less than half a circle
+		left := Coordinate{X: -chord.Y / chord.Len(), Y: chord.X / chord.Len()}
+		center := start.Add(chord.Scaled(0.5)).Add(left.Scaled(chord.Len() / 2 / math.Tan(sweep/2)))
+		arc := converter.arc(center, radius, math.Atan2(start.Y-center.Y, start.X-center.X), sweep)
+
+		// the last point is exactly the next vertex
+		points = append(points, arc[1:len(arc)-1]...)
+		points = append(points, end)
+	}
+	return points
+}
+
+// Points along an ellipse, given by its center, the end of its major axis, the ratio of its minor axis and its start and end parameters
+func (converter *dxfConverter) ellipse(entity dxfEntity) []Coordinate {
+	center := Coordinate{X: entity.float(10), Y: entity.float(20)}
+	major := Coordinate{X: entity.float(11), Y: entity.float(21)}
+	minor := Coordinate{X: -major.Y, Y: major.X}.Scaled(entity.float(40))
+
+	start, end := entity.float(41), entity.float(42)
+	if end <= start {
+		end += 2 * math.Pi
+	}
+	if entity.mirrored() {
+		// the minor axis is at a right angle to the major axis around the extrusion direction, so it flips when that points away
+		minor = minor.Scaled(-1)
+	}
+
+	segments := converter.segments(major.Len(), end-start)
+	points := make([]Coordinate, segments+1)
+	for segment := 0; segment <= segments; segment++ {
+		parameter := start + (end-start)*float64(segment)/float64(segments)
+		points[segment] = center.Add(major.Scaled(math.Cos(parameter))).Add(minor.Scaled(math.Sin(parameter)))
+	}
+	return points
+}
+
+// Points along a spline, evaluated from its control points, knots and weights
+// a spline given only by fit points is drawn through them as straight lines
+func (converter *dxfConverter) spline(entity dxfEntity) []Coordinate {
+	controls := entity.points(10, 20)
+	if len(controls) == 0 {
+		return entity.points(11, 21)
+	}
+
+	degree := int(entity.float(71))
+	if degree < 1 {
+		degree = 3
+	}
+	if degree >= len(controls) {
+		degree = len(controls) - 1
+	}
+	if degree < 1 {
+		return controls
+	}
+
+	// missing or mismatched knots are replaced by a clamped uniform knot vector
+	knots := entity.floats(40)
+	if len(knots) != len(controls)+degree+1 {
+		knots = make([]float64, len(controls)+degree+1)
+		for index := range knots {
+			knots[index] = math.Min(math.Max(float64(index-degree), 0), float64(len(controls)-degree))
+		}
+	}
+	weights := entity.floats(41)
+	if len(weights) != len(controls) {
+		weights = make([]float64, len(controls))
+		for index := range weights {
+			weights[index] = 1
+		}
+	}
+
+	// the length of the control polygon limits how far apart samples can be
+	length := 0.0
+	for index := 1; index < len(controls); index++ {
+		length += controls[index].Minus(controls[index-1]).Len()
+	}
+	samples := int(math.Max(float64(len(controls)*16), math.Ceil(length*converter.unit_MM)))
+
+	first, last := knots[degree], knots[len(controls)]
+	points := make([]Coordinate, samples+1)
+	for sample := 0; sample <= samples; sample++ {
+		points[sample] = evaluateSpline(degree, knots, controls, weights, first+(last-first)*float64(sample)/float64(samples))
+	}
+	return points
+}
+
+// Evaluate a rational B-spline at a parameter using de Boor's algorithm
+func evaluateSpline(degree int, knots []float64, controls []Coordinate, weights []float64, parameter float64) Coordinate {
+
+	// the knot span that holds the parameter, the last span holds the end of the curve
+	span := degree
+	for span < len(controls)-1 && parameter >= knots[span+1] {
+		span++
+	}
+
+	// work in homogeneous coordinates so the weights are interpolated along with the points
+	type weighted struct{ X, Y, W float64 }
+	points := make([]weighted, degree+1)
+	for index := range points {
+		control, weight := controls[span-degree+index], weights[span-degree+index]
+		points[index] = weighted{control.X * weight, control.Y * weight, weight}
+	}
+
+	for level := 1; level <= degree; level++ {
+		for index := degree; index >= level; index-- {
+			knotIndex := span - degree + index
+			denominator := knots[knotIndex+degree-level+1] - knots[knotIndex]
+			alpha := 0.0
+			if denominator != 0 {
+				alpha = (parameter - knots[knotIndex]) / denominator
+			}
+			previous := points[index-1]
+			points[index] = weighted{
+				(1-alpha)*previous.X + alpha*points[index].X,
+				(1-alpha)*previous.Y + alpha*points[index].Y,
+				(1-alpha)*previous.W + alpha*points[index].W,
+			}
+		}
+	}
+
+	result := points[degree]
+	return Coordinate{X: result.X / result.W, Y: result.Y / result.W}
+}
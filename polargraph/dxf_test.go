@@ -0,0 +1,111 @@
+package polargraph
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// Build dxf text from alternating group codes and values
+func dxfText(pairs ...interface{}) string {
+	lines := make([]string, len(pairs))
+	for index, pair := range pairs {
+		lines[index] = fmt.Sprint(pair)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// Split coordinates into strokes, each starting at a pen up move
+func dxfStrokes(data Coordinates) [][]Coordinate {
+	strokes := make([][]Coordinate, 0)
+	for _, point := range data {
+		if point.PenUp {
+			strokes = append(strokes, []Coordinate{})
+		}
+		strokes[len(strokes)-1] = append(strokes[len(strokes)-1], point)
+	}
+	return strokes
+}
+
+func TestParseDxf(t *testing.T) {
+	text := dxfText(
+		0, "SECTION", 2, "HEADER", 9, "$INSUNITS", 70, 1, 0, "ENDSEC",
+		0, "SECTION", 2, "ENTITIES",
+		0, "LINE", 8, "cut", 10, 0, 20, 0, 11, 1, 21, 0,
+		0, "CIRCLE", 8, "draw", 10, 2, 20, 2, 40, 1,
+		0, "LWPOLYLINE", 8, "draw", 90, 2, 70, 0, 10, 0, 20, 0, 42, 1, 10, 2, 20, 0,
+		0, "ARC", 8, "draw", 10, 0, 20, 0, 40, 1, 50, 0, 51, 90,
+		0, "ELLIPSE", 8, "draw", 10, 0, 20, 0, 11, 2, 21, 0, 40, 0.5, 41, 0, 42, 2*math.Pi,
+		0, "SPLINE", 8, "draw", 71, 1, 72, 4, 40, 0, 40, 0, 40, 1, 40, 1, 10, 0, 20, 0, 10, 1, 20, 1,
+		0, "POLYLINE", 8, "draw", 70, 1,
+		0, "VERTEX", 8, "draw", 10, 0, 20, 0,
+		0, "VERTEX", 8, "draw", 10, 1, 20, 0,
+		0, "VERTEX", 8, "draw", 10, 1, 20, 1,
+		0, "SEQEND",
+		0, "TEXT", 8, "draw", 1, "skipped",
+		0, "ENDSEC", 0, "EOF")
+
+	data, err := ParseDxf(strings.NewReader(text), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strokes := dxfStrokes(data)
+	if len(strokes) != 7 {
+		t.Fatal("Expected 7 strokes, got", len(strokes))
+	}
+
+	// inches are converted to mm and Y is flipped
+	assertGcodeDests([]Coordinate{{X: 0, Y: 0, PenUp: true}, {X: 25.4, Y: 0}}, strokes[0], t)
+
+	onCurve := func(name string, stroke []Coordinate, distance func(Coordinate) float64) {
+		if len(stroke) < 10 {
+			t.Error(name, "expected to be flattened into many moves, got", stroke)
+		}
+		for _, point := range stroke {
+			if math.Abs(distance(point)) > 0.0001 {
+				t.Error(name, "point", point, "is off the curve by", distance(point))
+				return
+			}
+		}
+	}
+	onCurve("circle", strokes[1], func(point Coordinate) float64 {
+		return point.Minus(Coordinate{X: 50.8, Y: -50.8}).Len() - 25.4
+	})
+	onCurve("bulge", strokes[2], func(point Coordinate) float64 {
+		return point.Minus(Coordinate{X: 25.4, Y: 0}).Len() - 25.4
+	})
+	onCurve("arc", strokes[3], func(point Coordinate) float64 {
+		return point.Len() - 25.4
+	})
+	onCurve("ellipse", strokes[4], func(point Coordinate) float64 {
+		return math.Pow(point.X/50.8, 2) + math.Pow(point.Y/25.4, 2) - 1
+	})
+	onCurve("spline", strokes[5], func(point Coordinate) float64 {
+		return point.X + point.Y
+	})
+
+	// a positive bulge turns counter clockwise, which passes below the chord in dxf and above it once Y is flipped
+	if middle := strokes[2][len(strokes[2])/2]; middle.Y < 20 {
+		t.Error("Expected the bulge to pass through 25.4, 25.4, got", middle)
+	}
+	if end := strokes[3][len(strokes[3])-1]; !end.Equals(Coordinate{X: 0, Y: -25.4}) {
+		t.Error("Expected the arc to end at 0, -25.4, got", end)
+	}
+
+	// a closed polyline returns to its first vertex
+	assertGcodeDests([]Coordinate{{X: 0, Y: 0, PenUp: true}, {X: 25.4, Y: 0}, {X: 25.4, Y: -25.4}, {X: 0, Y: 0}}, strokes[6], t)
+
+	layered, err := ParseDxf(strings.NewReader(text), "CUT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGcodeDests(strokes[0], layered, t)
+
+	if _, err := ParseDxf(strings.NewReader(text), "missing"); err == nil {
+		t.Error("Expected an error when no entities are on the layer")
+	}
+	if _, err := ParseDxf(strings.NewReader(dxfText("x", "SECTION")), ""); err == nil {
+		t.Error("Expected an error for an invalid group code")
+	}
+}
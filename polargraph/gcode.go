@@ -4,25 +4,158 @@ package polargraph
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"math"
-	"os"
 	"strconv"
 	"strings"
 )
 
 // Any of the possible command types that are supported
 type GcodeCommand int32
-var penupcode float64
 
 const (
-	MOVE_RAPID GcodeCommand = 0
-	MOVE                    = 1
+	MOVE_RAPID           GcodeCommand = 0
+	MOVE                              = 1
+	ARC_CLOCKWISE                     = 2
+	ARC_COUNTERCLOCKWISE              = 3
 
 	SET_UNITS_INCHES = 20
 	SET_UNITS_MM     = 21
+
+	SET_ABSOLUTE = 90
+	SET_RELATIVE = 91
+)
+
+// Rules for deciding when a gcode file raises the pen
+const (
+	// Z50 raises the pen and any other Z lowers it
+	GcodePenZ50 string = "z50"
+
+	// Z above the threshold raises the pen
+	GcodePenZ string = "z"
+
+	// M5 raises the pen and M3 or M4 lowers it, as laser and spindle tools do
+	GcodePenM3M5 string = "m3m5"
+
+	// M300 with S above the threshold raises the pen
+	GcodePenM300 string = "m300"
+
+	// M280 sets the servo angle in S, raising the pen when it is closer to PenUpAngle than PenDownAngle
+	GcodePenM280 string = "m280"
+)
+
+// Presets for the output of common tools
+var gcodePenPresets = map[string]GcodePenMode{
+	"inkscape":   {Rule: GcodePenZ, Threshold: 0},
+	"gcodetools": {Rule: GcodePenZ, Threshold: 0},
+	"laser":      {Rule: GcodePenM3M5},
+	"servo":      {Rule: GcodePenM300, Threshold: 40},
+}
+
+// How a gcode file raises and lowers the pen
+type GcodePenMode struct {
+	// One of the GcodePen rules
+	Rule string
+
+	// Z or S value above which the pen is raised, for the z and m300 rules
+	Threshold float64
+}
+
+// Parse a pen mode written as a preset name or a rule with an optional threshold, ie laser, z, z:2.5 or m300:40
+func ParseGcodePenMode(text string) (GcodePenMode, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if preset, ok := gcodePenPresets[text]; ok {
+		return preset, nil
+	}
+
+	parts := strings.SplitN(text, ":", 2)
+	mode := GcodePenMode{Rule: parts[0]}
+	switch mode.Rule {
+	case GcodePenZ50, GcodePenM3M5, GcodePenM280:
+		if len(parts) > 1 {
+			return mode, fmt.Errorf("gcode pen mode %s doesn't take a threshold", mode.Rule)
+		}
+	case GcodePenZ, GcodePenM300:
+		if mode.Rule == GcodePenM300 {
+			mode.Threshold = 40
+		}
+		if len(parts) > 1 {
+			var err error
+			if mode.Threshold, err = strconv.ParseFloat(parts[1], 64); err != nil {
+				return mode, fmt.Errorf("invalid gcode pen threshold %s", parts[1])
+			}
+		}
+	default:
+		return mode, fmt.Errorf("unknown gcode pen mode '%s', expected z50, z[:threshold], m3m5, m300[:threshold], m280, inkscape, gcodetools, laser or servo", text)
+	}
+	return mode, nil
+}
+
+// Work out the pen state after a line, returns the current state when the line doesn't change it
+func (mode GcodePenMode) penUp(penUp bool, values map[byte]float64, mCodes []float64) bool {
+	switch mode.Rule {
+	case GcodePenZ50:
+		if z, ok := values['Z']; ok {
+			return z == 50
+		}
+	case GcodePenZ:
+		if z, ok := values['Z']; ok {
+			return z > mode.Threshold
+		}
+	}
+
+	for _, mCode := range mCodes {
+		switch {
+		case mode.Rule == GcodePenM3M5 && (mCode == 3 || mCode == 4):
+			penUp = false
+		case mode.Rule == GcodePenM3M5 && mCode == 5:
+			penUp = true
+		case mode.Rule == GcodePenM300 && mCode == 300:
+			if s, ok := values['S']; ok {
+				penUp = s > mode.Threshold
+			}
+		case mode.Rule == GcodePenM280 && mCode == 280:
+			if s, ok := values['S']; ok {
+				penUp = math.Abs(s-float64(Settings.PenUpAngle)) < math.Abs(s-float64(Settings.PenDownAngle))
+			}
+		}
+	}
+	return penUp
+}
+
+// Largest distance an arc is allowed to stray from the lines it is flattened into, in mm
+const gcodeArcTolerance_MM float64 = 0.01
+
+// Letters that are understood, or that don't affect a drawing, such as feed rates and tool numbers
+const gcodeKnownLetters string = "GMXYZIJRSPNFT"
+
+// Commands that don't affect a drawing and are accepted without being understood
+var (
+	gcodeIgnoredGCodes = []float64{4, 17, 40, 49, 54, 61, 64, 80, 94}
+	gcodeKnownMCodes   = []float64{0, 1, 2, 3, 4, 5, 6, 17, 18, 30, 84, 106, 107, 280, 300}
 )
 
+// Options for parsing gcode
+type GcodeOptions struct {
+	// Decides when the pen is raised
+	PenMode GcodePenMode
+
+	// Skip words, commands and lines that can't be understood, keeping a warning for each, instead of failing on the first
+	Lenient bool
+}
+
+// A problem at a place in a gcode file, Line and Column count from 1
+type GcodeError struct {
+	Line, Column int
+	Message      string
+}
+
+// GcodeError ToString
+func (err GcodeError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", err.Line, err.Column, err.Message)
+}
+
 // Data on a single line, the command followed by any values on the line
 type GcodeLine struct {
 	Command GcodeCommand
@@ -33,87 +166,386 @@ type GcodeLine struct {
 // All of the data from a file
 type GcodeData struct {
 	Lines []GcodeLine
+
+	// Problems that were skipped by lenient parsing
+	Warnings []GcodeError
+}
+
+// A letter and the number following it, ie X12.5
+type gcodeWord struct {
+	Letter byte
+	Value  float64
+
+	// where the letter is on its line, counting from 1
+	Column int
+}
+
+// Modal state that carries from one line to the next
+type gcodeInterpreter struct {
+	// current motion command, used by lines that only have coordinates, -1 until the first motion command
+	motion GcodeCommand
+
+	// true for G90, false for G91
+	absolute bool
+
+	// mm per unit, 1 for G21 and 25.4 for G20
+	unitScale float64
+
+	// current position in mm, with Y up as gcode has it
+	position Coordinate
+
+	// decides when the pen is raised, the pen starts raised
+	penUp bool
+
+	options GcodeOptions
+
+	// line being executed, counting from 1
+	lineNumber int
+
+	// receive each move, and each problem skipped by lenient parsing, as soon as it is found
+	output func(GcodeLine)
+	warn   func(GcodeError)
+}
+
+// Create an interpreter in the state a file starts in
+func newGcodeInterpreter(options GcodeOptions, output func(GcodeLine), warn func(GcodeError)) *gcodeInterpreter {
+	return &gcodeInterpreter{motion: -1, absolute: true, unitScale: 1, penUp: true, options: options, output: output, warn: warn}
+}
+
+// read a file, or stdin when fileName is -, and parse its Gcode
+func ParseGcodeFile(fileName string, options GcodeOptions) (GcodeData, error) {
+
+	file, err := OpenInput(fileName)
+	if err != nil {
+		return GcodeData{}, err
+	}
+	defer file.Close()
+
+	return ParseGcodeReader(file, options)
+}
+
+// read Gcode from reader, generating a GcodeData object
+func ParseGcodeReader(reader io.Reader, options GcodeOptions) (GcodeData, error) {
+	data := GcodeData{Lines: make([]GcodeLine, 0)}
+	interpreter := newGcodeInterpreter(options, func(line GcodeLine) {
+		data.Lines = append(data.Lines, line)
+	}, func(problem GcodeError) {
+		data.Warnings = append(data.Warnings, problem)
+	})
+
+	err := interpreter.readFrom(reader)
+	return data, err
+}
+
+// read all of the fileData lines, generating a GcodeData object
+// returns the first problem as a GcodeError, unless options.Lenient is set when problems are kept in the Warnings of the data
+func ParseGcode(fileData []string, options GcodeOptions) (GcodeData, error) {
+	data := GcodeData{Lines: make([]GcodeLine, 0)}
+	interpreter := newGcodeInterpreter(options, func(line GcodeLine) {
+		data.Lines = append(data.Lines, line)
+	}, func(problem GcodeError) {
+		data.Warnings = append(data.Warnings, problem)
+	})
+
+	for _, fileLine := range fileData {
+		if err := interpreter.executeLine(fileLine); err != nil {
+			return data, err
+		}
+	}
+
+	return data, nil
+}
+
+// Parse Gcode from reader a line at a time, sending each destination multiplied by scale to plotCoords as soon as it is parsed
+// problems skipped by lenient parsing are printed as warnings, on any other problem the pen is raised where it is and the error is returned,
+// so the caller should fail the drawing with Generation.Fail rather than plot what was sent before it
+func StreamGcode(reader io.Reader, options GcodeOptions, scale float64, plotCoords chan<- Coordinate) error {
+
+	defer close(plotCoords)
+
+	last := Coordinate{PenUp: true}
+	interpreter := newGcodeInterpreter(options, func(line GcodeLine) {
+		last = line.Dest.Scaled(scale)
+		plotCoords <- last
+	}, func(problem GcodeError) {
+		fmt.Println("WARNING: Skipped gcode at", problem)
+	})
+
+	err := interpreter.readFrom(reader)
+	if err != nil && !last.PenUp {
+		last.PenUp = true
+		plotCoords <- last
+	}
+	return err
 }
 
-// read a file and parse its Gcode
-func ParseGcodeFile(fileName string) GcodeData {
+// read a file, or stdin when fileName is -, without keeping any of its Gcode, returning the first problem StreamGcode would stop at
+func CheckGcodeFile(fileName string, options GcodeOptions) error {
 
-	file, err := os.Open(fileName)
+	file, err := OpenInput(fileName)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	reader := bufio.NewReader(file)
+	defer file.Close()
+
+	return CheckGcode(file, options)
+}
 
-	lines := make([]string, 0)
+// Read Gcode from reader without keeping any of it, returning the first problem that StreamGcode would stop at
+func CheckGcode(reader io.Reader, options GcodeOptions) error {
+	interpreter := newGcodeInterpreter(options, func(line GcodeLine) {}, func(problem GcodeError) {})
+	return interpreter.readFrom(reader)
+}
+
+// Execute every line read from reader
+func (interpreter *gcodeInterpreter) readFrom(reader io.Reader) error {
+	buffered := bufio.NewReader(reader)
 	for {
-		l, err := reader.ReadString('\n')
+		l, err := buffered.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err := interpreter.executeLine(strings.TrimRight(l, "\r\n")); err != nil {
+			return err
+		}
 		if err == io.EOF {
-			break
-		} else if err != nil {
-			panic(err)
+			return nil
 		}
-		lines = append(lines, strings.TrimSpace(l))
 	}
+}
+
+// Split and execute the next line
+func (interpreter *gcodeInterpreter) executeLine(line string) error {
+	interpreter.lineNumber++
 
-	return ParseGcode(lines)
+	words, err := splitGcodeWords(line)
+	if err != nil {
+		// a line that can't be split is skipped entirely
+		problem := err.(GcodeError)
+		problem.Line = interpreter.lineNumber
+		return interpreter.report(problem)
+	}
+	return interpreter.execute(words)
 }
 
-// read all of the fileData lines, generating a GcodeData object
-func ParseGcode(fileData []string) (data GcodeData) {
+// Keep a problem as a warning when parsing leniently, otherwise return it
+func (interpreter *gcodeInterpreter) report(problem GcodeError) error {
+	if interpreter.options.Lenient {
+		interpreter.warn(problem)
+		return nil
+	}
+	return problem
+}
 
-	data = GcodeData{make([]GcodeLine, 0)}
-	
+// Report a problem at a column of the current line
+func (interpreter *gcodeInterpreter) problem(column int, format string, args ...interface{}) error {
+	return interpreter.report(GcodeError{Line: interpreter.lineNumber, Column: column, Message: fmt.Sprintf(format, args...)})
+}
 
-	for _, fileLine := range fileData {
+// Remove comments from a line and split it into words, whitespace between and inside words is ignored
+// errors are GcodeErrors with the column of the problem, the line is left for the caller to fill in
+func splitGcodeWords(line string) ([]gcodeWord, error) {
+	words := make([]gcodeWord, 0)
+
+	line = strings.ToUpper(line)
+	for index := 0; index < len(line); {
+		char := line[index]
+		switch {
+		case char == ';':
+			return words, nil
+		case char == '(':
+			end := strings.IndexByte(line[index:], ')')
+			if end < 0 {
+				return words, nil
+			}
+			index += end + 1
+		case char == ' ' || char == '\t' || char == '\r' || char == '%':
+			index++
+		case char >= 'A' && char <= 'Z':
+			start := index + 1
+			end := start
+			for end < len(line) && (strings.IndexByte("+-.0123456789 \t", line[end]) >= 0) {
+				end++
+			}
+			number := strings.Replace(strings.Replace(line[start:end], " ", "", -1), "\t", "", -1)
+			value, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return nil, GcodeError{Column: index + 1, Message: fmt.Sprintf("invalid number '%s' after %c", strings.TrimSpace(line[start:end]), char)}
+			}
+			words = append(words, gcodeWord{Letter: char, Value: value, Column: index + 1})
+			index = end
+		default:
+			return nil, GcodeError{Column: index + 1, Message: fmt.Sprintf("unexpected character '%c'", char)}
+		}
+	}
+	return words, nil
+}
+
+// Apply the words from a single line
+func (interpreter *gcodeInterpreter) execute(words []gcodeWord) error {
 
-		if strings.HasPrefix(fileLine, "G00") || strings.HasPrefix(fileLine, "G01") {
-
-			coord := Coordinate{X: math.MaxFloat64, Y: math.MaxFloat64, PenUp: false}
-			
-			for _, part := range strings.Split(fileLine, " ") {
-				
-				var err interface{}
-				if strings.HasPrefix(part, "X") {
-					coord.X, err = strconv.ParseFloat(part[1:], 64)
-					if err != nil {
-						panic(err)
-					}
-				} else if strings.HasPrefix(part, "Y") {
-					if strings.HasSuffix(part, ";") {
-				        part = part[:len(part)-len(";")]
-					}
-					coord.Y, err = strconv.ParseFloat(part[1:], 64)
-					if err != nil {
-						panic(err)
-					}
-					coord.Y = -coord.Y
-				} else if strings.HasPrefix(part, "Z") {
-				    if strings.HasSuffix(part, ";") {
-				        part = part[:len(part)-len(";")]
-				    }
-				    penupcode, err = strconv.ParseFloat(part[1:],64)
-					if err != nil {
-						panic(err)
-					}
-					
-					
+	values := make(map[byte]float64)
+	columns := make(map[byte]int)
+	mCodes := make([]float64, 0)
+	motion := interpreter.motion
+	for _, word := range words {
+		switch {
+		case word.Letter == 'M':
+			if !gcodeCodeIn(word.Value, gcodeKnownMCodes) {
+				if err := interpreter.problem(word.Column, "unknown command M%v", word.Value); err != nil {
+					return err
 				}
-				
+				continue
 			}
-			if penupcode == 50 {
-				coord.PenUp = true
-				//fmt.Println("PENUP")
-			} else {
-				coord.PenUp = false
-				//fmt.Println("PENDOWN")
+			mCodes = append(mCodes, word.Value)
+			continue
+		case word.Letter != 'G' && strings.IndexByte(gcodeKnownLetters, word.Letter) < 0:
+			if err := interpreter.problem(word.Column, "unknown word %c%v", word.Letter, word.Value); err != nil {
+				return err
 			}
-			if coord.X != math.MaxFloat64 && coord.Y != math.MaxFloat64 {
-				data.Lines = append(data.Lines, GcodeLine{Command: MOVE, Dest: coord})
+			continue
+		case word.Letter != 'G':
+			values[word.Letter] = word.Value
+			columns[word.Letter] = word.Column
+			continue
+		}
+
+		switch word.Value {
+		case float64(MOVE_RAPID), float64(MOVE), float64(ARC_CLOCKWISE), float64(ARC_COUNTERCLOCKWISE):
+			motion = GcodeCommand(word.Value)
+		case SET_UNITS_INCHES:
+			interpreter.unitScale = 25.4
+		case SET_UNITS_MM:
+			interpreter.unitScale = 1
+		case SET_ABSOLUTE:
+			interpreter.absolute = true
+		case SET_RELATIVE:
+			interpreter.absolute = false
+		default:
+			if !gcodeCodeIn(word.Value, gcodeIgnoredGCodes) {
+				if err := interpreter.problem(word.Column, "unknown command G%v", word.Value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	interpreter.motion = motion
+
+	interpreter.penUp = interpreter.options.PenMode.penUp(interpreter.penUp, values, mCodes)
+
+	_, hasX := values['X']
+	_, hasY := values['Y']
+	if !hasX && !hasY || motion < 0 {
+		return nil
+	}
+
+	target := interpreter.position
+	if interpreter.absolute {
+		if hasX {
+			target.X = values['X'] * interpreter.unitScale
+		}
+		if hasY {
+			target.Y = values['Y'] * interpreter.unitScale
+		}
+	} else {
+		target.X += values['X'] * interpreter.unitScale
+		target.Y += values['Y'] * interpreter.unitScale
+	}
+
+	switch motion {
+	case MOVE_RAPID, MOVE:
+		interpreter.move(motion, target)
+	case ARC_CLOCKWISE, ARC_COUNTERCLOCKWISE:
+		if err := interpreter.arc(motion == ARC_CLOCKWISE, target, values); err != nil {
+			problem := err.(GcodeError)
+			problem.Column = columns['R']
+			if err := interpreter.report(problem); err != nil {
+				return err
 			}
+			// a lenient parse still ends up where the arc should have
+			interpreter.move(MOVE, target)
 		}
 	}
+	return nil
+}
 
-	return
+// Check if a G or M code is in a list of codes
+func gcodeCodeIn(code float64, codes []float64) bool {
+	for _, known := range codes {
+		if code == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a straight move to target
+func (interpreter *gcodeInterpreter) move(command GcodeCommand, target Coordinate) {
+	interpreter.position = target
+	interpreter.output(GcodeLine{
+		Command: command,
+		Dest:    Coordinate{X: target.X, Y: -target.Y, PenUp: interpreter.penUp},
+	})
+}
+
+// Flatten an arc from the current position to target into straight moves, the center is given by I and J offsets from the start or by a radius R
+// returns a GcodeError without a column and without adding any moves if the arc is impossible
+func (interpreter *gcodeInterpreter) arc(clockwise bool, target Coordinate, values map[byte]float64) error {
+	start := interpreter.position
+
+	var center Coordinate
+	if radius, ok := values['R']; ok {
+		radius *= interpreter.unitScale
+		chord := target.Minus(start)
+		chordLength := chord.Len()
+		if chordLength == 0 {
+			return GcodeError{Line: interpreter.lineNumber, Message: "arc with R needs different start and end points"}
+		}
+
+		// distance from the middle of the chord to the center, small rounding errors on half circles are allowed
+		offsetSquared := radius*radius - chordLength*chordLength/4
+		if offsetSquared < -gcodeArcTolerance_MM {
+			return GcodeError{Line: interpreter.lineNumber, Message: fmt.Sprint("arc radius ", math.Abs(radius/interpreter.unitScale), " is too small to reach from ", start, " to ", target)}
+		}
+		offset := math.Sqrt(math.Max(0, offsetSquared))
+
+		// the center is to the right of the chord for clockwise arcs of up to half a circle, a negative radius picks the longer arc
+		side := 1.0
+		if !clockwise {
+			side = -side
+		}
+		if radius < 0 {
+			side = -side
+		}
+		right := Coordinate{X: chord.Y / chordLength, Y: -chord.X / chordLength}
+		center = start.Add(chord.Scaled(0.5)).Add(right.Scaled(side * offset))
+	} else {
+		center = start.Add(Coordinate{X: values['I'] * interpreter.unitScale, Y: values['J'] * interpreter.unitScale})
+	}
+
+	radius := start.Minus(center).Len()
+	startAngle := math.Atan2(start.Y-center.Y, start.X-center.X)
+	endAngle := math.Atan2(target.Y-center.Y, target.X-center.X)
+
+	// angles increase counter clockwise, an arc that ends where it starts is a full circle
+	sweep := endAngle - startAngle
+	if clockwise && sweep >= -1e-9 {
+		sweep -= 2 * math.Pi
+	} else if !clockwise && sweep <= 1e-9 {
+		sweep += 2 * math.Pi
+	}
+
+	segments := 1
+	if radius > gcodeArcTolerance_MM {
+		maxStep := 2 * math.Acos(1-gcodeArcTolerance_MM/radius)
+		segments = int(math.Ceil(math.Abs(sweep) / maxStep))
+	}
+	for segment := 1; segment < segments; segment++ {
+		angle := startAngle + sweep*float64(segment)/float64(segments)
+		interpreter.move(MOVE, Coordinate{X: center.X + radius*math.Cos(angle), Y: center.Y + radius*math.Sin(angle)})
+	}
+	interpreter.move(MOVE, target)
+	return nil
 }
 
 // Given GCodeData, returns all of the
@@ -122,6 +554,6 @@ func GenerateGcodePath(data GcodeData, scale float64, plotCoords chan<- Coordina
 	defer close(plotCoords)
 
 	for _, curTarget := range data.Lines {
-	   plotCoords <- curTarget.Dest.Scaled(scale)
+		plotCoords <- curTarget.Dest.Scaled(scale)
 	}
 }
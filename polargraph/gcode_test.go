@@ -0,0 +1,240 @@
+package polargraph
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// Parse lines and return the destinations
+func parseGcodeDests(lines ...string) []Coordinate {
+	return parseGcodeDestsWithPen(GcodePenMode{Rule: GcodePenZ50}, lines...)
+}
+
+// Parse lines with the given pen mode and return the destinations
+func parseGcodeDestsWithPen(penMode GcodePenMode, lines ...string) []Coordinate {
+	data, err := ParseGcode(lines, GcodeOptions{PenMode: penMode})
+	if err != nil {
+		panic(err)
+	}
+	return gcodeDests(data)
+}
+
+// Destinations of parsed data
+func gcodeDests(data GcodeData) []Coordinate {
+	dests := make([]Coordinate, len(data.Lines))
+	for index, line := range data.Lines {
+		dests[index] = line.Dest
+	}
+	return dests
+}
+
+// assert that the destinations match, Y is flipped from gcode
+func assertGcodeDests(expected, actual []Coordinate, t *testing.T) {
+	if len(expected) != len(actual) {
+		t.Error("Expected", len(expected), "moves, got", len(actual), actual)
+		return
+	}
+	for index := range expected {
+		if !expected[index].Equals(actual[index]) {
+			t.Error("Move", index, "expected", expected[index], "got", actual[index])
+		}
+	}
+}
+
+func TestParseGcodeModal(t *testing.T) {
+	dests := parseGcodeDests(
+		"%",
+		"(header comment)",
+		"G21 G90",
+		"G00 X10 Y10 Z50",
+		"N10 G1 Z0 ; lower the pen",
+		"N20 G01 X20 (move right) Y10",
+		"Y20",
+		"x30",
+		"G91",
+		"G1 X-10 Y-10",
+		"G0 Z50",
+		"X-10",
+		"G90 G20",
+		"G1X1Y1",
+	)
+
+	assertGcodeDests([]Coordinate{
+		{X: 10, Y: -10, PenUp: true},
+		{X: 20, Y: -10},
+		{X: 20, Y: -20},
+		{X: 30, Y: -20},
+		{X: 20, Y: -10},
+		{X: 10, Y: -10, PenUp: true},
+		{X: 25.4, Y: -25.4, PenUp: true},
+	}, dests, t)
+}
+
+func TestParseGcodeArcs(t *testing.T) {
+	// quarter circle counter clockwise around the origin from 10,0 to 0,10, with I/J and with R
+	for _, arc := range []string{"G3 X0 Y10 I-10 J0", "G3 X0 Y10 R10"} {
+		dests := parseGcodeDests("G1 X10 Y0 Z0", arc)
+		if len(dests) < 10 {
+			t.Error("Expected the arc to be flattened into many moves, got", len(dests))
+			continue
+		}
+		if end := dests[len(dests)-1]; !end.Equals(Coordinate{X: 0, Y: -10}) {
+			t.Error("Expected the arc to end at 0,10, got", end)
+		}
+		for _, dest := range dests {
+			if math.Abs(dest.Len()-10) > 0.0001 {
+				t.Error("Expected every point to be on the circle, got", dest)
+			}
+			if dest.X < -0.0001 || dest.Y > 0.0001 {
+				t.Error("Expected the short counter clockwise arc, got", dest)
+			}
+		}
+	}
+
+	// clockwise full circle, starts and ends at the same point and passes through the bottom of the circle
+	dests := parseGcodeDests("G1 X10 Y0 Z0", "G2 X10 Y0 I-10 J0")
+	sawBottom := false
+	for _, dest := range dests {
+		if math.Abs(dest.Y-10) < 0.5 && math.Abs(dest.X+10) > 1 {
+			sawBottom = true
+		}
+	}
+	if !sawBottom || !dests[len(dests)-1].Equals(Coordinate{X: 10, Y: 0}) {
+		t.Error("Expected a full clockwise circle", dests[len(dests)-1])
+	}
+
+	// a negative radius takes the long way around
+	long := parseGcodeDests("G1 X10 Y0 Z0", "G2 X0 Y10 R-10")
+	short := parseGcodeDests("G1 X10 Y0 Z0", "G2 X0 Y10 R10")
+	if len(long) <= len(short) {
+		t.Error("Expected the negative radius arc to be longer", len(long), len(short))
+	}
+}
+
+func TestGcodePenModes(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.PenUpAngle = 40
+	Settings.PenDownAngle = 140
+
+	cases := []struct {
+		mode  string
+		lines []string
+	}{
+		{"z50", []string{"G0 X1 Y0 Z50", "G1 X2 Z0", "G1 X3", "G0 X4 Z50"}},
+		{"inkscape", []string{"G0 X1 Y0 Z1", "G1 Z-0.125", "G1 X2", "G1 X3", "G0 Z1", "G0 X4"}},
+		{"z:2.5", []string{"G0 X1 Y0 Z3", "G1 X2 Z2", "G1 X3", "G0 X4 Z5"}},
+		{"laser", []string{"G0 X1 Y0", "M3 S1000", "G1 X2", "G1 X3", "M5", "G0 X4"}},
+		{"m300", []string{"M300 S50", "G0 X1 Y0", "M300 S30", "G1 X2", "G1 X3", "M300 S50", "G0 X4"}},
+		{"m280", []string{"G0 X1 Y0", "M280 P0 S130", "G1 X2", "G1 X3", "M280 P0 S45", "G0 X4"}},
+	}
+	expected := []Coordinate{{X: 1, Y: 0, PenUp: true}, {X: 2, Y: 0}, {X: 3, Y: 0}, {X: 4, Y: 0, PenUp: true}}
+
+	for _, c := range cases {
+		mode, err := ParseGcodePenMode(c.mode)
+		if err != nil {
+			t.Error(c.mode, err)
+			continue
+		}
+		dests := parseGcodeDestsWithPen(mode, c.lines...)
+		if len(dests) != len(expected) {
+			t.Error(c.mode, "expected", len(expected), "moves, got", dests)
+			continue
+		}
+		for index := range expected {
+			if dests[index].PenUp != expected[index].PenUp || !dests[index].Equals(expected[index]) {
+				t.Error(c.mode, "move", index, "expected", expected[index], "got", dests[index])
+			}
+		}
+	}
+
+	for _, invalid := range []string{"z50:1", "z:abc", "m6"} {
+		if _, err := ParseGcodePenMode(invalid); err == nil {
+			t.Error("Expected", invalid, "to be rejected")
+		}
+	}
+}
+
+func TestParseGcodeErrors(t *testing.T) {
+	cases := []struct {
+		line   string
+		column int
+	}{
+		{"G1 X1.2.3", 4},
+		{"G1 X2 Y3 # comment", 10},
+		{"G18", 1},
+		{"G1 X1 Q5", 7},
+		{"M117", 1},
+		{"G1 Z0 G2 X1 Y0 R0.1", 16},
+	}
+
+	for _, c := range cases {
+		_, err := ParseGcode([]string{"G0 X0 Y0", "", c.line, "G1 X5"}, GcodeOptions{PenMode: GcodePenMode{Rule: GcodePenZ50}})
+		problem, ok := err.(GcodeError)
+		if !ok {
+			t.Error(c.line, "expected a GcodeError, got", err)
+			continue
+		}
+		if problem.Line != 3 || problem.Column != c.column {
+			t.Error(c.line, "expected line 3 column", c.column, "got", problem)
+		}
+	}
+
+	// lenient parsing skips bad lines and unknown words, keeping everything else
+	data, err := ParseGcode([]string{"G0 X1 Y0 Z50", "G1 X$2", "G1 X3 Q5 Z0", "G18", "G2 X3 Y0 R1", "G1 X4"}, GcodeOptions{PenMode: GcodePenMode{Rule: GcodePenZ50}, Lenient: true})
+	if err != nil {
+		t.Fatal("Expected lenient parsing to succeed, got", err)
+	}
+	if len(data.Warnings) != 4 {
+		t.Error("Expected 4 warnings, got", data.Warnings)
+	}
+	assertGcodeDests([]Coordinate{
+		{X: 1, Y: 0, PenUp: true},
+		{X: 3, Y: 0},
+		{X: 3, Y: 0},
+		{X: 4, Y: 0},
+	}, gcodeDests(data), t)
+}
+
+func TestStreamGcode(t *testing.T) {
+	lines := []string{"G21", "G0 X1 Y1 Z50", "G1 Z0", "G1 X2 Y2", "G1 X3 Y3"}
+
+	plotCoords := make(chan Coordinate, 1024)
+	if err := StreamGcode(strings.NewReader(strings.Join(lines, "\r\n")), GcodeOptions{PenMode: GcodePenMode{Rule: GcodePenZ50}}, 2, plotCoords); err != nil {
+		t.Fatal(err)
+	}
+	streamed := make([]Coordinate, 0)
+	for coord := range plotCoords {
+		streamed = append(streamed, coord)
+	}
+	expected := parseGcodeDests(lines...)
+	for index := range expected {
+		expected[index] = expected[index].Scaled(2)
+	}
+	assertGcodeDests(expected, streamed, t)
+
+	// a bad line stops the stream with the pen raised where it was
+	plotCoords = make(chan Coordinate, 1024)
+	err := StreamGcode(strings.NewReader("G0 X1 Y1 Z50\nG1 Z0\nG1 X2 Y2\nG1 X=3\nG1 X4"), GcodeOptions{PenMode: GcodePenMode{Rule: GcodePenZ50}}, 1, plotCoords)
+	if problem, ok := err.(GcodeError); !ok || problem.Line != 4 {
+		t.Error("Expected an error on line 4, got", err)
+	}
+	streamed = streamed[:0]
+	for coord := range plotCoords {
+		streamed = append(streamed, coord)
+	}
+	assertGcodeDests([]Coordinate{{X: 1, Y: -1, PenUp: true}, {X: 2, Y: -2}, {X: 2, Y: -2, PenUp: true}}, streamed, t)
+	if !streamed[len(streamed)-1].PenUp {
+		t.Error("Expected the pen to be raised after the error")
+	}
+}
+
+func TestCheckGcode(t *testing.T) {
+	options := GcodeOptions{PenMode: GcodePenMode{Rule: GcodePenZ50}}
+	if err := CheckGcode(strings.NewReader("G0 X1 Y1 Z50\nG1 Z0\nG1 X2 Y2"), options); err != nil {
+		t.Error("Expected no problems, got", err)
+	}
+	if problem, ok := CheckGcode(strings.NewReader("G0 X1 Y1 Z50\nG1 Z0\nG1 X=3\nG1 X4"), options).(GcodeError); !ok || problem.Line != 3 {
+		t.Error("Expected the check to stop on line 3, got", problem)
+	}
+}
@@ -0,0 +1,101 @@
+package polargraph
+
+// Writes plot coordinates from any generator as gcode, so the patterns can be drawn by other machines
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// How gcode is written
+type GcodeWriterOptions struct {
+	// Lines written to raise and lower the pen
+	PenUp, PenDown string
+
+	// Feed rate of pen down moves in mm per minute, left out when 0
+	Feed_MM_Min float64
+}
+
+// Pen codes that are read back by the given pen mode, with the feed rate at the max speed from the settings
+func DefaultGcodeWriterOptions(penMode GcodePenMode) GcodeWriterOptions {
+	options := GcodeWriterOptions{Feed_MM_Min: Settings.MaxSpeed_MM_S * 60}
+
+	switch penMode.Rule {
+	case GcodePenZ50:
+		options.PenUp, options.PenDown = "G0 Z50", "G1 Z0"
+	case GcodePenZ:
+		options.PenUp, options.PenDown = "G0 Z"+formatNumber(penMode.Threshold+1), "G1 Z"+formatNumber(penMode.Threshold-1)
+	case GcodePenM3M5:
+		options.PenUp, options.PenDown = "M5", "M3"
+	case GcodePenM300:
+		options.PenUp, options.PenDown = "M300 S"+formatNumber(penMode.Threshold+10), "M300 S"+formatNumber(penMode.Threshold-10)
+	case GcodePenM280:
+		options.PenUp, options.PenDown = fmt.Sprint("M280 P0 S", Settings.PenUpAngle), fmt.Sprint("M280 P0 S", Settings.PenDownAngle)
+	}
+	return options
+}
+
+// Write coordinates to a gcode file
+func DrawToGcode(fileName string, options GcodeWriterOptions, plotCoords <-chan Coordinate) {
+
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	if err := WriteGcode(writer, options, plotCoords); err != nil {
+		panic(err)
+	}
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// Write coordinates as G0 travel and G1 drawing moves in absolute mm, relative to the starting position of the pen
+// gcode has Y pointing up, so Y is flipped the same way the gcode command flips it when reading
+func WriteGcode(writer io.Writer, options GcodeWriterOptions, plotCoords <-chan Coordinate) error {
+
+	lines := bufio.NewWriter(writer)
+	fmt.Fprintln(lines, "(written by gocupi)")
+	fmt.Fprintln(lines, "G21")
+	fmt.Fprintln(lines, "G90")
+	fmt.Fprintln(lines, options.PenUp)
+
+	penUp := true
+	previous := Coordinate{X: 0, Y: 0, PenUp: true}
+	feedWritten := false
+	for coord := range plotCoords {
+		if coord.PenUp != penUp {
+			penUp = coord.PenUp
+			if penUp {
+				fmt.Fprintln(lines, options.PenUp)
+			} else {
+				fmt.Fprintln(lines, options.PenDown)
+			}
+		}
+
+		x, y := formatNumber(coord.X), formatNumber(-coord.Y)
+		if x == formatNumber(previous.X) && y == formatNumber(-previous.Y) {
+			continue
+		}
+		previous = coord
+
+		if penUp {
+			fmt.Fprintf(lines, "G0 X%s Y%s\n", x, y)
+		} else if !feedWritten && options.Feed_MM_Min > 0 {
+			fmt.Fprintf(lines, "G1 X%s Y%s F%s\n", x, y, formatNumber(options.Feed_MM_Min))
+			feedWritten = true
+		} else {
+			fmt.Fprintf(lines, "G1 X%s Y%s\n", x, y)
+		}
+	}
+
+	if !penUp {
+		fmt.Fprintln(lines, options.PenUp)
+	}
+	return lines.Flush()
+}
@@ -0,0 +1,60 @@
+package polargraph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteGcode(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.PenUpAngle = 40
+	Settings.PenDownAngle = 140
+
+	coords := []Coordinate{
+		{X: 10, Y: 10, PenUp: true},
+		{X: 20, Y: 10},
+		{X: 20, Y: 25.5},
+		{X: 20, Y: 25.5},
+		{X: -5.25, Y: 0, PenUp: true},
+		{X: 0, Y: 0},
+	}
+
+	// whatever the pen codes, reading the gcode back with the same mode gives the same path
+	for _, modeText := range []string{"z50", "inkscape", "laser", "servo", "m280"} {
+		penMode, err := ParseGcodePenMode(modeText)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plotCoords := make(chan Coordinate, len(coords))
+		for _, coord := range coords {
+			plotCoords <- coord
+		}
+		close(plotCoords)
+
+		written := new(bytes.Buffer)
+		options := DefaultGcodeWriterOptions(penMode)
+		options.Feed_MM_Min = 3000
+		if err := WriteGcode(written, options, plotCoords); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(written.String(), "G1 X20 Y-10 F3000\n") {
+			t.Error(modeText, "expected the first drawing move to set the feed rate, got", written.String())
+		}
+
+		data, err := ParseGcodeReader(written, GcodeOptions{PenMode: penMode})
+		if err != nil {
+			t.Error(modeText, err)
+			continue
+		}
+		read := gcodeDests(data)
+		expected := []Coordinate{coords[0], coords[1], coords[2], coords[4], coords[5]}
+		assertGcodeDests(expected, read, t)
+		for index := range read {
+			if index < len(expected) && read[index].PenUp != expected[index].PenUp {
+				t.Error(modeText, "move", index, "expected pen up", expected[index].PenUp, "got", read[index].PenUp)
+			}
+		}
+	}
+}
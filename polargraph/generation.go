@@ -0,0 +1,89 @@
+package polargraph
+
+// Runs the goroutines that generate a drawing so that a failure part way through is kept as an error instead of ending the program
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// The goroutines generating a single drawing, a drawing that stopped part way through has an error so it can be refused
+// instead of being plotted as if it were complete
+type Generation struct {
+	running sync.WaitGroup
+
+	mutex sync.Mutex
+	err   error
+
+	// closed when the first error is recorded
+	failed chan struct{}
+
+	// true when the drawing was checked before it started, so it can be sent while it is still being generated
+	streamed bool
+}
+
+// Create a generation with no goroutines running
+func NewGeneration() *Generation {
+	return &Generation{failed: make(chan struct{})}
+}
+
+// Run generate in its own goroutine, turning a panic into the generation's error
+// generate must still close its output when it panics, which generators do with defer close
+func (generation *Generation) Go(generate func()) {
+	generation.running.Add(1)
+	go func() {
+		defer generation.running.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				generation.Fail(errors.New(fmt.Sprint(r)))
+			}
+		}()
+		generate()
+	}()
+}
+
+// Record why the drawing stopped part way through, only the first error is kept
+func (generation *Generation) Fail(err error) {
+	generation.mutex.Lock()
+	defer generation.mutex.Unlock()
+
+	if generation.err == nil {
+		generation.err = err
+		close(generation.failed)
+	}
+}
+
+// Wait for every goroutine to finish, or for one of them to fail, and return the first error
+// only call once all of the drawing has been read, a goroutine waiting to send more would never finish
+func (generation *Generation) Err() error {
+	if generation == nil {
+		return nil
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		generation.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-generation.failed:
+	}
+
+	generation.mutex.Lock()
+	defer generation.mutex.Unlock()
+	return generation.err
+}
+
+// Mark the drawing as checked before it started, so plotting doesn't have to generate all of it before sending any
+// only a problem the check couldn't find, like failing to read the rest of a file, then stops the plot part way through
+func (generation *Generation) Stream() {
+	generation.streamed = true
+}
+
+// True if the drawing can be sent while it is still being generated
+func (generation *Generation) Streamed() bool {
+	return generation != nil && generation.streamed
+}
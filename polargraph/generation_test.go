@@ -0,0 +1,46 @@
+package polargraph
+
+import (
+	"testing"
+)
+
+func TestGeneration(t *testing.T) {
+	generation := NewGeneration()
+	plotCoords := make(chan Coordinate, 1)
+	generation.Go(func() {
+		defer close(plotCoords)
+		plotCoords <- Coordinate{X: 1, Y: 1}
+	})
+	for range plotCoords {
+	}
+	if err := generation.Err(); err != nil {
+		t.Error("Expected no error, got", err)
+	}
+
+	// a panic closes the output and becomes the error
+	generation = NewGeneration()
+	plotCoords = make(chan Coordinate, 1)
+	generation.Go(func() {
+		defer close(plotCoords)
+		plotCoords <- Coordinate{X: 1, Y: 1}
+		var args []string
+		plotCoords <- Coordinate{X: float64(len(args[3]))}
+	})
+	for range plotCoords {
+	}
+	if err := generation.Err(); err == nil {
+		t.Error("Expected the panic to be returned as an error")
+	}
+
+	var none *Generation
+	if err := none.Err(); err != nil {
+		t.Error("Expected a nil generation to have no error", err)
+	}
+	if none.Streamed() || generation.Streamed() {
+		t.Error("Expected drawings to be buffered unless marked as streamed")
+	}
+	generation.Stream()
+	if !generation.Streamed() {
+		t.Error("Expected the drawing to be streamed")
+	}
+}
@@ -294,6 +294,9 @@ type Arc struct {
 
 	// Distance between arcs
 	ArcDist float64
+
+	// Draw darkness by pressing the pen harder instead of zig zagging across the arc
+	UsePressure bool
 }
 
 // Draw image by generate a series of arcs, where darknes of a pixel is a movement along the arc
@@ -365,7 +368,9 @@ func GenerateArc(setup Arc, imageData image.Image, plotCoords chan<- Coordinate)
 				imageValue := 1.0 - sampleImageAt(imageData, pos.Scaled(1/scale))
 				offset := setup.ArcDist * 0.485 * imageValue
 
-				if imageValue > 0.05 {
+				if imageValue > 0.05 && setup.UsePressure {
+					plotCoords <- arcOrigin.Add(Coordinate{X: math.Cos(theta) * radius, Y: math.Sin(theta) * radius, PenUp: false, PenHeight: 1.0 - imageValue})
+				} else if imageValue > 0.05 {
 					plotCoords <- arcOrigin.Add(Coordinate{X: math.Cos(theta) * radius, Y: math.Sin(theta) * radius, PenUp: false})
 					plotCoords <- arcOrigin.Add(Coordinate{X: math.Cos(theta) * (radius + offset), Y: math.Sin(theta) * (radius + offset), PenUp: false})                               //up
 					plotCoords <- arcOrigin.Add(Coordinate{X: math.Cos(theta+thetaDelta/2.0) * (radius + offset), Y: math.Sin(theta+thetaDelta/2.0) * (radius + offset), PenUp: false}) //bottom
@@ -383,7 +388,9 @@ func GenerateArc(setup Arc, imageData image.Image, plotCoords chan<- Coordinate)
 				imageValue := 1.0 - sampleImageAt(imageData, pos.Scaled(1/scale))
 				offset := setup.ArcDist * 0.485 * imageValue
 
-				if imageValue > 0.05 {
+				if imageValue > 0.05 && setup.UsePressure {
+					plotCoords <- arcOrigin.Add(Coordinate{X: math.Cos(theta) * radius, Y: math.Sin(theta) * radius, PenUp: false, PenHeight: 1.0 - imageValue})
+				} else if imageValue > 0.05 {
 					plotCoords <- arcOrigin.Add(Coordinate{X: math.Cos(theta) * radius, Y: math.Sin(theta) * radius, PenUp: false})
 					plotCoords <- arcOrigin.Add(Coordinate{X: math.Cos(theta) * (radius + offset), Y: math.Sin(theta) * (radius + offset), PenUp: false})
 					plotCoords <- arcOrigin.Add(Coordinate{X: math.Cos(theta-thetaDelta/2.0) * (radius + offset), Y: math.Sin(theta-thetaDelta/2.0) * (radius + offset), PenUp: false})
@@ -609,6 +616,9 @@ type Raster struct {
 	// Width of the pen used when filling in a pixel
 	PenWidth float64
 
+	// Draw each row as a single stroke, pressing harder on darker pixels instead of filling them in
+	UsePressure bool
+
 	// Size of a given pixel
 	pixelSize float64
 }
@@ -628,6 +638,11 @@ func GenerateRaster(setup Raster, imageData image.Image, plotCoords chan<- Coord
 	//polarPos := PolarCoordinate{Settings.StartingLeftDist_MM, Settings.StartingRightDist_MM}
 	//startingPos := polarPos.ToCoord(polarSystem)
 
+	if setup.UsePressure {
+		generateRasterPressure(imageData, scale, plotCoords)
+		return
+	}
+
 	for y := 0; ; {
 
 		for x := 0; x < imageSize.X; x++ {
@@ -664,6 +679,34 @@ func GenerateRaster(setup Raster, imageData image.Image, plotCoords chan<- Coord
 	plotCoords <- Coordinate{X: 0, Y: 0}
 }
 
+// Draw each row of the image as a single stroke, where the darkness of a pixel sets how hard the pen presses
+// white is drawn with PenUp=true
+func generateRasterPressure(imageData image.Image, scale float64, plotCoords chan<- Coordinate) {
+	imageSize := imageData.Bounds().Max
+
+	for y := 0; y < imageSize.Y; y++ {
+		for step := 0; step < imageSize.X; step++ {
+
+			// alternate the direction of each row so the pen doesn't travel back across the image
+			x := step
+			if y%2 == 1 {
+				x = imageSize.X - 1 - step
+			}
+
+			pos := Coordinate{X: float64(x) * scale, Y: float64(y) * scale}
+			darkness := 1.0 - average(imageData.At(x, y))
+			if step == 0 || darkness < 0.05 {
+				pos.PenUp = true
+			} else {
+				pos.PenHeight = 1.0 - darkness
+			}
+			plotCoords <- pos
+		}
+	}
+
+	plotCoords <- Coordinate{X: 0, Y: 0, PenUp: true}
+}
+
 // Draw a pixel at the given location
 func drawPixel(center Coordinate, setup Raster, plotCoords chan<- Coordinate) {
 
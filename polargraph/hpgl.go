@@ -0,0 +1,308 @@
+package polargraph
+
+// Reads HPGL plotter instructions and generates the same coordinates as a gcode file
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Plotter units in a millimetre, each unit is 0.025mm
+const HpglUnitsPerMM float64 = 40
+
+// Character that ends the text of an LB instruction unless DT changes it
+const hpglLabelTerminator byte = 3
+
+// All of the moves from an HPGL file, in mm with Y pointing down
+type HpglData struct {
+	Coords []Coordinate
+}
+
+// State that carries from one instruction to the next
+type hpglInterpreter struct {
+	// true for PA, false for PR
+	absolute bool
+
+	// current position in plotter units, with Y up as HPGL has it
+	position Coordinate
+
+	penUp bool
+
+	// the pen was lowered without moving, a dot is drawn if it is raised again before it moves
+	dot bool
+
+	// pen selected by the last SP, 0 before any pen is selected
+	pen int
+
+	// pen change to attach to the next move
+	pendingPenChange int
+
+	// ends the text of LB instructions
+	labelTerminator byte
+
+	// index of the instruction being executed, counting from 1
+	instruction int
+
+	// mnemonics that were skipped because they aren't understood
+	ignored map[string]bool
+
+	data HpglData
+}
+
+// read a file, or stdin when fileName is -, and parse its HPGL
+func ParseHpglFile(fileName string) (HpglData, error) {
+
+	file, err := OpenInput(fileName)
+	if err != nil {
+		return HpglData{}, err
+	}
+	defer file.Close()
+
+	return ParseHpgl(file)
+}
+
+// read HPGL instructions, PU, PD, PA, PR, SP, IN and DF are understood and anything else is skipped with a warning
+// an SP that changes from one pen to another pauses the plot so the pen can be changed
+func ParseHpgl(reader io.Reader) (HpglData, error) {
+
+	interpreter := hpglInterpreter{absolute: true, penUp: true, labelTerminator: hpglLabelTerminator, ignored: make(map[string]bool)}
+	interpreter.data = HpglData{Coords: make([]Coordinate, 0)}
+
+	buffered := bufio.NewReader(reader)
+	for {
+		mnemonic, params, err := readHpglInstruction(buffered, interpreter.labelTerminator)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return interpreter.data, err
+		}
+
+		interpreter.instruction++
+		if err := interpreter.execute(mnemonic, params); err != nil {
+			return interpreter.data, errors.New(fmt.Sprint("HPGL instruction ", interpreter.instruction, " ", mnemonic, params, ": ", err))
+		}
+	}
+
+	if len(interpreter.ignored) > 0 {
+		ignored := make([]string, 0, len(interpreter.ignored))
+		for mnemonic := range interpreter.ignored {
+			ignored = append(ignored, mnemonic)
+		}
+		sort.Strings(ignored)
+		fmt.Println("WARNING: Skipped HPGL instructions that aren't supported:", strings.Join(ignored, ", "))
+	}
+
+	return interpreter.data, nil
+}
+
+// Read the next two letter mnemonic and the text of its parameters, returns io.EOF when there are no more instructions
+func readHpglInstruction(reader *bufio.Reader, labelTerminator byte) (mnemonic, params string, err error) {
+
+	// skip separators and escape sequences before the mnemonic
+	var first byte
+	for {
+		if first, err = reader.ReadByte(); err != nil {
+			return
+		}
+		if first == 27 {
+			// device control sequences are ESC . and a letter
+			reader.ReadByte()
+			reader.ReadByte()
+			continue
+		}
+		if strings.IndexByte(" \t\r\n;,", first) < 0 {
+			break
+		}
+	}
+
+	second, err := reader.ReadByte()
+	if err == io.EOF {
+		err = errors.New(fmt.Sprint("HPGL ended part way through the instruction ", string(first)))
+	}
+	if err != nil {
+		return
+	}
+	mnemonic = strings.ToUpper(string([]byte{first, second}))
+	if !isHpglLetter(first) || !isHpglLetter(second) {
+		return mnemonic, "", errors.New(fmt.Sprint("Expected an HPGL instruction, got ", strconv.Quote(mnemonic)))
+	}
+
+	// a label is everything up to its terminator, other parameters end at the next instruction
+	if mnemonic == "LB" {
+		params, err = reader.ReadString(labelTerminator)
+		if err == io.EOF {
+			err = nil
+		}
+		return mnemonic, strings.TrimSuffix(params, string(labelTerminator)), err
+	}
+
+	// the label terminator is the character straight after DT, DT on its own goes back to the default
+	terminator := labelTerminator
+	if mnemonic == "DT" {
+		terminator = hpglLabelTerminator
+		next, err := reader.ReadByte()
+		if err != nil && err != io.EOF {
+			return mnemonic, "", err
+		}
+		if err == nil && next != ';' {
+			terminator = next
+		} else if err == nil {
+			reader.UnreadByte()
+		}
+	}
+
+	text := make([]byte, 0)
+	for {
+		next, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return mnemonic, "", err
+		}
+		if next == ';' {
+			break
+		}
+		if isHpglLetter(next) {
+			reader.UnreadByte()
+			break
+		}
+		text = append(text, next)
+	}
+	if mnemonic == "DT" {
+		// any mode that follows the terminator doesn't change how labels are read
+		return mnemonic, string([]byte{terminator}), nil
+	}
+	return mnemonic, strings.TrimSpace(string(text)), nil
+}
+
+// True for the letters that make up mnemonics
+func isHpglLetter(char byte) bool {
+	return char >= 'A' && char <= 'Z' || char >= 'a' && char <= 'z'
+}
+
+// Split parameters separated by commas or spaces into numbers
+func parseHpglNumbers(params string) ([]float64, error) {
+	fields := strings.FieldsFunc(params, func(char rune) bool {
+		return char == ',' || char == ' ' || char == '\t' || char == '\r' || char == '\n'
+	})
+	numbers := make([]float64, len(fields))
+	for index, field := range fields {
+		number, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("invalid number ", field))
+		}
+		numbers[index] = number
+	}
+	return numbers, nil
+}
+
+// Apply a single instruction
+func (interpreter *hpglInterpreter) execute(mnemonic, params string) error {
+
+	switch mnemonic {
+	case "DT":
+		interpreter.labelTerminator = params[0]
+		return nil
+	case "LB":
+		// labels need the plotter's character set, so they aren't drawn
+		interpreter.ignored[mnemonic] = true
+		return nil
+	}
+
+	numbers, err := parseHpglNumbers(params)
+	if err != nil {
+		return err
+	}
+
+	switch mnemonic {
+	case "IN", "DF":
+		interpreter.absolute = true
+		if mnemonic == "IN" {
+			interpreter.penUp = true
+			interpreter.position = Coordinate{}
+			interpreter.labelTerminator = hpglLabelTerminator
+		}
+
+	case "PA", "PR":
+		interpreter.absolute = mnemonic == "PA"
+		return interpreter.moves(numbers)
+
+	case "PU":
+		interpreter.raisePen()
+		return interpreter.moves(numbers)
+
+	case "PD":
+		interpreter.dot = interpreter.penUp && len(numbers) == 0
+		interpreter.penUp = false
+		return interpreter.moves(numbers)
+
+	case "SP":
+		pen := 0
+		if len(numbers) > 0 {
+			pen = int(numbers[0])
+		}
+		if pen > 0 && interpreter.pen > 0 && pen != interpreter.pen {
+			interpreter.pendingPenChange = pen
+		}
+		if pen > 0 {
+			interpreter.pen = pen
+		}
+		interpreter.raisePen()
+
+	default:
+		interpreter.ignored[mnemonic] = true
+	}
+	return nil
+}
+
+// Move through each pair of numbers, absolute or relative to the previous point
+func (interpreter *hpglInterpreter) moves(numbers []float64) error {
+	if len(numbers)%2 != 0 {
+		return errors.New(fmt.Sprint("expected pairs of X Y values and saw ", len(numbers), " values"))
+	}
+
+	for index := 0; index < len(numbers); index += 2 {
+		if interpreter.absolute {
+			interpreter.position = Coordinate{X: numbers[index], Y: numbers[index+1]}
+		} else {
+			interpreter.position = interpreter.position.Add(Coordinate{X: numbers[index], Y: numbers[index+1]})
+		}
+		interpreter.emit()
+	}
+	return nil
+}
+
+// Raise the pen, drawing a dot if it was lowered without moving
+func (interpreter *hpglInterpreter) raisePen() {
+	if interpreter.dot {
+		interpreter.emit()
+	}
+	interpreter.penUp = true
+}
+
+// Add a move to the current position
+func (interpreter *hpglInterpreter) emit() {
+	interpreter.dot = false
+	interpreter.data.Coords = append(interpreter.data.Coords, Coordinate{
+		X:         interpreter.position.X / HpglUnitsPerMM,
+		Y:         -interpreter.position.Y / HpglUnitsPerMM,
+		PenUp:     interpreter.penUp,
+		PenChange: interpreter.pendingPenChange,
+	})
+	interpreter.pendingPenChange = 0
+}
+
+// Given HpglData, sends each of the moves to plotCoords multiplied by scale
+func GenerateHpglPath(data HpglData, scale float64, plotCoords chan<- Coordinate) {
+
+	defer close(plotCoords)
+
+	for _, curTarget := range data.Coords {
+		plotCoords <- curTarget.Scaled(scale)
+	}
+}
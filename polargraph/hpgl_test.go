@@ -0,0 +1,74 @@
+package polargraph
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHpgl(t *testing.T) {
+	data, err := ParseHpgl(strings.NewReader("IN;SP1;PU400,400;PD800,400,800,800;PU;\r\nSP2;PR-400,0;PD;PU;PA0,0 PD 40 0;LBHELLO\x03VS10;SP0;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Coordinate{
+		{X: 10, Y: -10, PenUp: true},
+		{X: 20, Y: -10},
+		{X: 20, Y: -20},
+		{X: 10, Y: -20, PenUp: true, PenChange: 2},
+		{X: 10, Y: -20},
+		{X: 0, Y: 0, PenUp: true},
+		{X: 1, Y: 0},
+	}
+	if len(data.Coords) != len(expected) {
+		t.Fatal("Expected", expected, "got", data.Coords)
+	}
+	for index := range expected {
+		if data.Coords[index] != expected[index] {
+			t.Error("Move", index, "expected", expected[index], "got", data.Coords[index])
+		}
+	}
+
+	for _, invalid := range []string{"PA10,10,5;", "PA1x,2;", "P"} {
+		if _, err := ParseHpgl(strings.NewReader(invalid)); err == nil {
+			t.Error("Expected", invalid, "to be rejected")
+		}
+	}
+}
+
+func TestHpglPenChangeSteps(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 1000
+	Settings.StartingLeftDist_MM = 600
+	Settings.StartingRightDist_MM = 600
+	Settings.StepSize_MM = 0.1
+	Settings.MaxSpeed_MM_S = 100
+	Settings.Acceleration_MM_S2 = 500
+
+	data, err := ParseHpgl(strings.NewReader("SP1;PD400,0;SP2;PU0,400;PD;PU;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plotCoords := make(chan Coordinate, 1024)
+	go GenerateHpglPath(data, 1, plotCoords)
+	stepData := make(chan int8, 1024)
+	go GenerateSteps(plotCoords, stepData)
+
+	// the pen is raised before the plot pauses for the pen change
+	penChanges := 0
+	penUp := true
+	for frame, ok := ReadStepFrame(stepData); ok; frame, ok = ReadStepFrame(stepData) {
+		if movesPen, framePenUp := frame.PenState(); movesPen {
+			penUp = framePenUp
+		}
+		if frame.Command == PenChangeCommand {
+			penChanges++
+			if frame.Args[0] != 2 || !penUp {
+				t.Error("Expected a change to pen 2 with the pen up, got", frame.Args, penUp)
+			}
+		}
+	}
+	if penChanges != 1 {
+		t.Error("Expected 1 pen change, got", penChanges)
+	}
+}
@@ -8,12 +8,11 @@ import (
 	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
-	"image/png"
-	"os"
+	"io"
 )
 
-// Draw coordinates to image
-func DrawToImage(imageName string, plotCoords <-chan Coordinate) {
+// Draw coordinates to an image at the resolution and in the format given by options
+func DrawToImage(options OutputOptions, plotCoords <-chan Coordinate) {
 
 	// buffer all of the coordinates into a slice in order to figure out the min and max points to know how big the image needs to be
 	points := make([]Coordinate, len(plotCoords))
@@ -21,7 +20,7 @@ func DrawToImage(imageName string, plotCoords <-chan Coordinate) {
 	maxPoint := Coordinate{X: -100000, Y: -10000}
 
 	for point := range plotCoords {
-		point = point.Scaled(4.0) // 4 pixels = 1mm
+		point = point.Scaled(options.PixelsPerMM)
 		points = append(points, point)
 
 		if point.X < minPoint.X {
@@ -38,8 +37,9 @@ func DrawToImage(imageName string, plotCoords <-chan Coordinate) {
 	}
 
 	// add some border to the image
-	maxPoint = maxPoint.Add(Coordinate{X: 50, Y: 50})
-	minPoint = minPoint.Add(Coordinate{X: -50, Y: -50})
+	border := 12.5 * options.PixelsPerMM
+	maxPoint = maxPoint.Add(Coordinate{X: border, Y: border})
+	minPoint = minPoint.Add(Coordinate{X: -border, Y: -border})
 
 	fmt.Println("Image Min:", minPoint, "Max:", maxPoint)
 
@@ -54,15 +54,7 @@ func DrawToImage(imageName string, plotCoords <-chan Coordinate) {
 		previousPoint = point
 	}
 
-	file, err := os.OpenFile(imageName, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-
-	if err = png.Encode(file, image); err != nil {
-		panic(err)
-	}
+	SaveImage(options, image)
 }
 
 // Draw a line, from http://41j.com/blog/2012/09/bresenhams-line-drawing-algorithm-implemetations-in-go-and-c/
@@ -112,8 +104,9 @@ func drawLine(start Coordinate, end Coordinate, minPoint Coordinate, maxPoint Co
 	}
 	err := dx - dy
 
+	// a line never takes more than dx + dy pixels, so this only guards against looping forever
 	var n int
-	for n = 0; n < 10000; n++ {
+	for n = 0; n <= dx+dy; n++ {
 
 		image.Set(cx, cy, lineColor)
 		if (cx == end_x) && (cy == end_y) {
@@ -131,16 +124,22 @@ func drawLine(start Coordinate, end Coordinate, minPoint Coordinate, maxPoint Co
 	}
 }
 
-// Load image data
+// Load image data from a file, or stdin when imageFileName is -
 func LoadImage(imageFileName string) image.Image {
 
-	file, err := os.Open(imageFileName)
+	file, err := OpenInput(imageFileName)
 	if err != nil {
 		panic(err)
 	}
 	defer file.Close()
 
-	image, format, err := image.Decode(file)
+	return DecodeImage(file)
+}
+
+// Decode a png, jpeg or gif image
+func DecodeImage(reader io.Reader) image.Image {
+
+	image, format, err := image.Decode(reader)
 	if err != nil {
 		panic(err)
 	}
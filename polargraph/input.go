@@ -0,0 +1,83 @@
+package polargraph
+
+// Opens the files drawings are read from, a file name of - reads stdin so drawings can be piped in from other programs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File name that reads from stdin instead of a file
+const StdinFileName = "-"
+
+// When not empty OpenInput only opens files inside these directories and never stdin,
+// set by serve so that jobs submitted over http can't read any file the server can
+var InputDirectories []string
+
+// Open a file to read from, or stdin when fileName is -
+// named pipes are opened like any other file and read until the writer closes them
+func OpenInput(fileName string) (io.ReadCloser, error) {
+	if len(InputDirectories) > 0 {
+		if err := checkInputDirectory(fileName); err != nil {
+			return nil, err
+		}
+	} else if fileName == StdinFileName {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(fileName)
+}
+
+// Returns an error unless fileName is inside one of InputDirectories, following any symlinks
+func checkInputDirectory(fileName string) error {
+	if fileName == StdinFileName {
+		return errors.New("Reading from stdin is not allowed")
+	}
+	path, err := filepath.EvalSymlinks(fileName)
+	if err != nil {
+		return err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return err
+	}
+
+	for _, directory := range InputDirectories {
+		directory, err := filepath.EvalSymlinks(directory)
+		if err != nil {
+			continue
+		}
+		if directory, err = filepath.Abs(directory); err != nil {
+			continue
+		}
+		if relative, err := filepath.Rel(directory, path); err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is outside of %s, the only directories files can be read from", fileName, strings.Join(InputDirectories, ", "))
+}
+
+// Position in a command's args of the file it reads its drawing from, for the commands that read one, matching GeneratePlotCoords
+var inputFileArgs = map[string]int{
+	"crosshatch":  3,
+	"dxf":         2,
+	"gcode":       2,
+	"hpgl":        2,
+	"imagearc":    3,
+	"imageraster": 3,
+	"paths":       2,
+	"svg":         2,
+}
+
+// True when the command in args reads its drawing from stdin, which then can't also be used to type plot commands
+// only the argument the command reads its file from counts, so a - anywhere else, like text to draw, doesn't
+func ReadsStdin(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	index, ok := inputFileArgs[args[0]]
+	return ok && index < len(args) && args[index] == StdinFileName
+}
@@ -0,0 +1,62 @@
+package polargraph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenInputDirectories(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gocupi_input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	allowed := filepath.Join(directory, "jobs")
+	os.Mkdir(allowed, 0777)
+	inside := filepath.Join(allowed, "drawing.svg")
+	outside := filepath.Join(directory, "secret.txt")
+	ioutil.WriteFile(inside, []byte("<svg></svg>"), 0666)
+	ioutil.WriteFile(outside, []byte("secret"), 0666)
+	os.Symlink(outside, filepath.Join(allowed, "link.txt"))
+
+	defer func(saved []string) { InputDirectories = saved }(InputDirectories)
+	InputDirectories = []string{allowed}
+
+	if file, err := OpenInput(inside); err != nil {
+		t.Error("Expected file inside the directory to open", err)
+	} else {
+		file.Close()
+	}
+	for _, fileName := range []string{outside, filepath.Join(allowed, "..", "secret.txt"), filepath.Join(allowed, "link.txt"), StdinFileName} {
+		if file, err := OpenInput(fileName); err == nil {
+			file.Close()
+			t.Error("Expected", fileName, "to be refused")
+		}
+	}
+	// loaders only read stdin through OpenInput, so they are refused it too
+	if _, err := ParsePathsFile(StdinFileName); err == nil {
+		t.Error("Expected paths from stdin to be refused")
+	}
+}
+
+func TestReadsStdin(t *testing.T) {
+	tests := map[string]bool{
+		"svg 300 -":                true,
+		"imagearc 100 5 -":         true,
+		"gcode 1 - lenient":        true,
+		"text 40 -":                false,
+		"imagearc 100 - image.png": false,
+		"svg 300 drawing.svg":      false,
+		"gcode":                    false,
+		"":                         false,
+	}
+	for command, expected := range tests {
+		if ReadsStdin(strings.Fields(command)) != expected {
+			t.Error("Expected", command, "reading stdin to be", expected)
+		}
+	}
+}
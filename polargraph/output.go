@@ -0,0 +1,220 @@
+package polargraph
+
+// Where and how previews and charts are written
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Resolution previews are drawn at unless told otherwise, 4 pixels = 1mm
+const DefaultPixelsPerMM float64 = 4
+
+// Formats previews and charts can be written in
+var outputFormats = []string{"png", "jpeg", "svg", "pdf"}
+
+// Output settings for a preview or chart
+type OutputOptions struct {
+	// File to write, its extension sets the format when Format is empty
+	FileName string
+
+	// One of outputFormats
+	Format string
+
+	// Resolution of images
+	PixelsPerMM float64
+
+	// Size of charts
+	ChartWidth_In, ChartHeight_In float64
+
+	// Most time slices shown in a chart
+	ChartSlices int
+}
+
+// Default options for writing to fileName
+func DefaultOutputOptions(fileName string) OutputOptions {
+	return OutputOptions{
+		FileName:       fileName,
+		PixelsPerMM:    DefaultPixelsPerMM,
+		ChartWidth_In:  14,
+		ChartHeight_In: 8.5,
+		ChartSlices:    1500,
+	}
+}
+
+// Convert a resolution in dots per inch to pixels per mm
+func PixelsPerMMFromDPI(dpi float64) float64 {
+	return dpi / 25.4
+}
+
+// Format a number with up to 3 decimal places and no trailing zeros, for text formats
+func formatNumber(value float64) string {
+	value = math.Floor(value*1000+0.5) / 1000
+	if value == 0 {
+		// avoid writing -0
+		value = 0
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Normalize a format name or file extension, returns an empty string if it isn't a known format
+func normalizeFormat(format string) string {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	for _, known := range outputFormats {
+		if format == known {
+			return format
+		}
+	}
+	return ""
+}
+
+// The format to write, taken from Format or the extension of FileName
+func (options OutputOptions) ResolvedFormat() (string, error) {
+	extension := filepath.Ext(options.FileName)
+	fromExtension := normalizeFormat(extension)
+
+	if options.Format == "" {
+		if fromExtension == "" {
+			return "", errors.New(fmt.Sprint("Unable to tell the format of ", options.FileName, " from its extension, expected one of ", outputFormats))
+		}
+		return fromExtension, nil
+	}
+
+	format := normalizeFormat(options.Format)
+	switch {
+	case format == "":
+		return "", errors.New(fmt.Sprint("Unknown format ", options.Format, ", expected one of ", outputFormats))
+	case extension != "" && fromExtension != format:
+		return "", errors.New(fmt.Sprint("Format ", format, " doesn't match the extension of ", options.FileName))
+	}
+	return format, nil
+}
+
+// Pick the output file for a mode, using defaultName with the extension of the requested format when no file was given
+func (options OutputOptions) WithDefaultName(defaultName string) OutputOptions {
+	if options.FileName != "" {
+		return options
+	}
+	options.FileName = defaultName
+	if format := normalizeFormat(options.Format); format != "" {
+		options.FileName = strings.TrimSuffix(defaultName, filepath.Ext(defaultName)) + "." + format
+	}
+	return options
+}
+
+// Write an image in the requested format, svg and pdf embed the image at its physical size
+func SaveImage(options OutputOptions, rendered image.Image) {
+	format, err := options.ResolvedFormat()
+	if err != nil {
+		panic(err)
+	}
+
+	file, err := os.OpenFile(options.FileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	switch format {
+	case "png":
+		err = png.Encode(writer, rendered)
+	case "jpeg":
+		err = jpeg.Encode(writer, rendered, &jpeg.Options{Quality: 95})
+	case "svg":
+		err = writeSvgImage(writer, rendered, options.PixelsPerMM)
+	case "pdf":
+		err = writePdfImage(writer, rendered, options.PixelsPerMM)
+	}
+	if err != nil {
+		panic(err)
+	}
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// Write an svg containing the image as an embedded png
+func writeSvgImage(writer io.Writer, rendered image.Image, pixelsPerMM float64) error {
+	encoded := new(bytes.Buffer)
+	if err := png.Encode(encoded, rendered); err != nil {
+		return err
+	}
+
+	size := rendered.Bounds().Size()
+	_, err := fmt.Fprintf(writer, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%.3fmm" height="%.3fmm" viewBox="0 0 %d %d">
+<image width="%d" height="%d" xlink:href="data:image/png;base64,%s"/>
+</svg>
+`, float64(size.X)/pixelsPerMM, float64(size.Y)/pixelsPerMM, size.X, size.Y, size.X, size.Y, base64.StdEncoding.EncodeToString(encoded.Bytes()))
+	return err
+}
+
+// Write a single page pdf containing the image
+func writePdfImage(writer io.Writer, rendered image.Image, pixelsPerMM float64) error {
+	bounds := rendered.Bounds()
+
+	// pdf images are compressed rows of RGB bytes
+	pixels := new(bytes.Buffer)
+	compressor := zlib.NewWriter(pixels)
+	row := make([]byte, 0, bounds.Dx()*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := rendered.At(x, y).RGBA()
+			row = append(row, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+		compressor.Write(row)
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+
+	// page size in points, 72 per inch
+	pointsPerPixel := 72.0 / 25.4 / pixelsPerMM
+	width, height := float64(bounds.Dx())*pointsPerPixel, float64(bounds.Dy())*pointsPerPixel
+	contents := fmt.Sprintf("q %.3f 0 0 %.3f 0 0 cm /Im0 Do Q", width, height)
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.3f %.3f] /Resources << /XObject << /Im0 4 0 R >> >> /Contents 5 0 R >>", width, height),
+		fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream",
+			bounds.Dx(), bounds.Dy(), pixels.Len(), pixels.String()),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(contents), contents),
+	}
+
+	// the cross reference table needs the byte offset of every object
+	document := new(bytes.Buffer)
+	document.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for index, object := range objects {
+		offsets[index] = document.Len()
+		fmt.Fprintf(document, "%d 0 obj\n%s\nendobj\n", index+1, object)
+	}
+	crossReference := document.Len()
+	fmt.Fprintf(document, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(document, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(document, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, crossReference)
+
+	_, err := writer.Write(document.Bytes())
+	return err
+}
@@ -0,0 +1,91 @@
+package polargraph
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvedFormat(t *testing.T) {
+	cases := []struct {
+		fileName, format, expected string
+		fails                      bool
+	}{
+		{"output.png", "", "png", false},
+		{"output.JPG", "", "jpeg", false},
+		{"chart.pdf", "", "pdf", false},
+		{"preview", "svg", "svg", false},
+		{"output.png", "png", "png", false},
+		{"output.png", "pdf", "", true},
+		{"output", "", "", true},
+		{"output.gif", "", "", true},
+		{"output", "bmp", "", true},
+	}
+	for _, c := range cases {
+		format, err := OutputOptions{FileName: c.fileName, Format: c.format}.ResolvedFormat()
+		if format != c.expected || (err != nil) != c.fails {
+			t.Error("Unexpected format for", c.fileName, c.format, "got", format, err)
+		}
+	}
+
+	if name := (OutputOptions{Format: "pdf"}).WithDefaultName("chart.png").FileName; name != "chart.pdf" {
+		t.Error("Expected the default name to use the format, got", name)
+	}
+	if name := (OutputOptions{FileName: "mine.svg"}).WithDefaultName("chart.png").FileName; name != "mine.svg" {
+		t.Error("Expected the given name to be kept, got", name)
+	}
+}
+
+func TestDrawToImageFormats(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gocupi_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	draw := func(fileName string, size float64, pixelsPerMM float64) []byte {
+		plotCoords := make(chan Coordinate, 2)
+		plotCoords <- Coordinate{X: 0, Y: 0}
+		plotCoords <- Coordinate{X: size, Y: size}
+		close(plotCoords)
+
+		options := DefaultOutputOptions(filepath.Join(directory, fileName))
+		options.PixelsPerMM = pixelsPerMM
+		DrawToImage(options, plotCoords)
+
+		data, err := ioutil.ReadFile(options.FileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// a smaller image replaces a larger one completely
+	draw("output.png", 200, 4)
+	small := draw("output.png", 10, 4)
+	decoded, _, err := image.Decode(bytes.NewReader(small))
+	if err != nil {
+		t.Fatal("Expected a valid png after overwriting a larger one", err)
+	}
+	if size := decoded.Bounds().Size(); size.X != 140 || size.Y != 140 {
+		t.Error("Unexpected image size", size)
+	}
+
+	// resolution scales the image
+	highResolution, _, err := image.Decode(bytes.NewReader(draw("output.jpg", 10, 8)))
+	if err != nil || highResolution.Bounds().Size().X != 280 {
+		t.Error("Expected a jpeg at twice the resolution", err)
+	}
+
+	if svg := draw("output.svg", 10, 4); !bytes.Contains(svg, []byte(`width="35.000mm"`)) || !bytes.Contains(svg, []byte("data:image/png;base64,")) {
+		t.Error("Expected an svg with the embedded image at its physical size", string(svg))
+	}
+
+	pdf := draw("output.pdf", 10, 4)
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) || !bytes.Contains(pdf, []byte("/Width 140 /Height 140")) {
+		t.Error("Expected a pdf containing the image")
+	}
+}
@@ -0,0 +1,230 @@
+package polargraph
+
+// Reads and writes drawings as a list of strokes in json or csv, a simple format for scripts to create or process drawings
+// json is a list of strokes, each a list of [x, y] points, ie [[[0, 0], [10, 0]], [[0, 5], [10, 5]]]
+// csv has a stroke,x,y row for every point, a new stroke starts whenever the stroke column changes
+// points are in mm relative to the starting position of the pen, with Y pointing down
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The paths format of a file from its extension, json or csv
+func pathsFormat(fileName string) (string, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return "json", nil
+	case ".csv":
+		return "csv", nil
+	}
+	return "", errors.New(fmt.Sprint("Paths are read from and written to .json or .csv files, got ", fileName))
+}
+
+// read a json or csv paths file, or stdin when fileName is -
+// stdin has no extension so its format is sniffed from the first character
+func ParsePathsFile(fileName string) (Coordinates, error) {
+	format := ""
+	if fileName != StdinFileName {
+		var err error
+		if format, err = pathsFormat(fileName); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := OpenInput(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if format == "" {
+		return SniffPaths(file)
+	}
+	return ParsePaths(file, format)
+}
+
+// read strokes when there is no file extension to give the format, json starts with [ and anything else is csv
+func SniffPaths(reader io.Reader) (Coordinates, error) {
+	buffered := bufio.NewReader(reader)
+	for {
+		next, err := buffered.Peek(1)
+		if err != nil {
+			return nil, errors.New("Paths contained no points")
+		}
+		switch next[0] {
+		case ' ', '\t', '\r', '\n':
+			buffered.ReadByte()
+		case '[':
+			return ParsePaths(buffered, "json")
+		default:
+			return ParsePaths(buffered, "csv")
+		}
+	}
+}
+
+// read strokes in the json or csv format, each stroke starts with a pen up move to its first point
+// a stroke of a single point is drawn as a dot
+func ParsePaths(reader io.Reader, format string) (Coordinates, error) {
+	var strokes [][][]float64
+	switch format {
+	case "json":
+		if err := json.NewDecoder(reader).Decode(&strokes); err != nil {
+			return nil, errors.New(fmt.Sprint("Unable to read json paths, ", err))
+		}
+	case "csv":
+		var err error
+		if strokes, err = readCsvStrokes(reader); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New(fmt.Sprint("Unknown paths format ", format, ", expected json or csv"))
+	}
+
+	data := make(Coordinates, 0)
+	for strokeIndex, stroke := range strokes {
+		for pointIndex, point := range stroke {
+			if len(point) != 2 {
+				return nil, errors.New(fmt.Sprint("Stroke ", strokeIndex, " point ", pointIndex, " has ", len(point), " values, expected [x, y]"))
+			}
+			data = append(data, Coordinate{X: point[0], Y: point[1], PenUp: pointIndex == 0})
+		}
+		if len(stroke) == 1 {
+			data = append(data, Coordinate{X: stroke[0][0], Y: stroke[0][1]})
+		}
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("Paths contained no points")
+	}
+	return data, nil
+}
+
+// Read stroke,x,y rows into strokes, a first row that isn't numbers is taken as a header
+func readCsvStrokes(reader io.Reader) ([][][]float64, error) {
+	rows := csv.NewReader(reader)
+	rows.FieldsPerRecord = 3
+	rows.TrimLeadingSpace = true
+
+	strokes := make([][][]float64, 0)
+	previousStroke := ""
+	for rowNumber := 1; ; rowNumber++ {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return strokes, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		x, xErr := strconv.ParseFloat(row[1], 64)
+		y, yErr := strconv.ParseFloat(row[2], 64)
+		if xErr != nil || yErr != nil {
+			if rowNumber == 1 {
+				continue
+			}
+			return nil, errors.New(fmt.Sprint("Expected numbers for x and y on csv row ", rowNumber, ", saw ", row[1], " and ", row[2]))
+		}
+
+		if len(strokes) == 0 || row[0] != previousStroke {
+			strokes = append(strokes, [][]float64{})
+			previousStroke = row[0]
+		}
+		strokes[len(strokes)-1] = append(strokes[len(strokes)-1], []float64{x, y})
+	}
+}
+
+// Send each point multiplied by scale to plotCoords
+func GeneratePaths(data Coordinates, scale float64, plotCoords chan<- Coordinate) {
+
+	defer close(plotCoords)
+
+	for _, curTarget := range data {
+		plotCoords <- curTarget.Scaled(scale)
+	}
+}
+
+// Write the pen down strokes of coordinates to a json or csv paths file
+func DrawToPaths(fileName string, plotCoords <-chan Coordinate) {
+	format, err := pathsFormat(fileName)
+	if err != nil {
+		panic(err)
+	}
+
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	if err := WritePaths(writer, format, plotCoords); err != nil {
+		panic(err)
+	}
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// Write each continuous pen down stroke as a list of points, pen up travel is left out
+func WritePaths(writer io.Writer, format string, plotCoords <-chan Coordinate) error {
+	if format != "json" && format != "csv" {
+		return errors.New(fmt.Sprint("Unknown paths format ", format, ", expected json or csv"))
+	}
+
+	lines := bufio.NewWriter(writer)
+	if format == "json" {
+		fmt.Fprint(lines, "[")
+	} else {
+		fmt.Fprintln(lines, "stroke,x,y")
+	}
+
+	// a move is drawn when the point it ends at has the pen down, so a stroke starts from the point before it
+	previous := Coordinate{X: 0, Y: 0, PenUp: true}
+	strokes := 0
+	inStroke := false
+	for point := range plotCoords {
+		switch {
+		case point.PenUp && inStroke && format == "json":
+			fmt.Fprint(lines, "]")
+			inStroke = false
+		case point.PenUp:
+			inStroke = false
+		case !inStroke:
+			if format == "json" {
+				if strokes > 0 {
+					fmt.Fprint(lines, ",")
+				}
+				fmt.Fprintf(lines, "\n[[%s,%s]", formatNumber(previous.X), formatNumber(previous.Y))
+			} else {
+				fmt.Fprintf(lines, "%d,%s,%s\n", strokes, formatNumber(previous.X), formatNumber(previous.Y))
+			}
+			strokes++
+			inStroke = true
+		}
+
+		if !point.PenUp {
+			if format == "json" {
+				fmt.Fprintf(lines, ",[%s,%s]", formatNumber(point.X), formatNumber(point.Y))
+			} else {
+				fmt.Fprintf(lines, "%d,%s,%s\n", strokes-1, formatNumber(point.X), formatNumber(point.Y))
+			}
+		}
+		previous = point
+	}
+
+	if format == "json" {
+		if inStroke {
+			fmt.Fprint(lines, "]")
+		}
+		fmt.Fprintln(lines, "\n]")
+	}
+	return lines.Flush()
+}
@@ -0,0 +1,96 @@
+package polargraph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParsePaths(t *testing.T) {
+	expected := Coordinates{
+		{X: 0, Y: 0, PenUp: true},
+		{X: 10, Y: 0},
+		{X: 10, Y: 5.5},
+		{X: -2, Y: 3, PenUp: true},
+		{X: -2, Y: 3},
+	}
+
+	fromJson, err := ParsePaths(strings.NewReader("[[[0, 0], [10, 0], [10, 5.5]], [[-2, 3]]]"), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGcodeDests(expected, fromJson, t)
+
+	fromCsv, err := ParsePaths(strings.NewReader("stroke,x,y\na,0,0\na,10,0\na, 10, 5.5\nb,-2,3\n"), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGcodeDests(expected, fromCsv, t)
+	for index := range expected {
+		if fromJson[index].PenUp != expected[index].PenUp || fromCsv[index].PenUp != expected[index].PenUp {
+			t.Error("Point", index, "expected pen up", expected[index].PenUp, "got", fromJson[index].PenUp, fromCsv[index].PenUp)
+		}
+	}
+
+	for format, invalid := range map[string]string{
+		"json": "[[[0, 0, 1]]]",
+		"csv":  "0,0,0\n0,x,1\n",
+		"svg":  "",
+	} {
+		if _, err := ParsePaths(strings.NewReader(invalid), format); err == nil {
+			t.Error("Expected", format, invalid, "to be rejected")
+		}
+	}
+}
+
+func TestSniffPaths(t *testing.T) {
+	expected := Coordinates{{X: 1, Y: 2, PenUp: true}, {X: 3, Y: 4}}
+
+	for _, text := range []string{"\n  [[[1, 2], [3, 4]]]", "0,1,2\n0,3,4\n", "stroke,x,y\n0,1,2\n0,3,4\n"} {
+		data, err := SniffPaths(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(text, err)
+		}
+		assertGcodeDests(expected, data, t)
+	}
+
+	if _, err := SniffPaths(strings.NewReader(" \n")); err == nil {
+		t.Error("Expected empty input to be rejected")
+	}
+}
+
+func TestWritePaths(t *testing.T) {
+	coords := []Coordinate{
+		{X: 10, Y: 10, PenUp: true},
+		{X: 20, Y: 10},
+		{X: 20, Y: 20.25},
+		{X: 30, Y: 30, PenUp: true},
+		{X: 40, Y: 30},
+		{X: 0, Y: 0, PenUp: true},
+	}
+
+	for _, format := range []string{"json", "csv"} {
+		plotCoords := make(chan Coordinate, len(coords))
+		for _, coord := range coords {
+			plotCoords <- coord
+		}
+		close(plotCoords)
+
+		written := new(bytes.Buffer)
+		if err := WritePaths(written, format, plotCoords); err != nil {
+			t.Fatal(err)
+		}
+
+		// the strokes read back are the pen down moves, travel back to the start is left out
+		read, err := ParsePaths(written, format)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		assertGcodeDests(coords[:5], read, t)
+		for index := range read {
+			if index < 5 && read[index].PenUp != coords[index].PenUp {
+				t.Error(format, "point", index, "expected pen up", coords[index].PenUp, "got", read[index].PenUp)
+			}
+		}
+	}
+}
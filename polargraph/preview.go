@@ -0,0 +1,123 @@
+package polargraph
+
+// Writes the planned path to an svg so it can be inspected in a browser at any zoom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Border added around the drawing in an svg preview, in mm
+const svgPreviewBorder_MM float64 = 10
+
+// Draw coordinates to an svg with the pen down strokes and pen up travel on separate layers
+func DrawToSvg(svgName string, plotCoords <-chan Coordinate) {
+
+	file, err := os.OpenFile(svgName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	WriteSvgPreview(writer, plotCoords)
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// Write coordinates as an svg document, coordinates are in mm relative to the starting position of the pen
+func WriteSvgPreview(writer io.Writer, plotCoords <-chan Coordinate) {
+
+	// every move starts from the previous point, the first from the starting position
+	points := []Coordinate{{X: 0, Y: 0, PenUp: true}}
+	for point := range plotCoords {
+		points = append(points, point)
+	}
+
+	// the drawing surface in the same coordinates as the plot
+	polarSystem := PolarSystemFromSettings()
+	startingLocation := PolarCoordinate{LeftDist: Settings.StartingLeftDist_MM, RightDist: Settings.StartingRightDist_MM}.ToCoord(polarSystem)
+	hasSurface := !startingLocation.IsNaN() && Settings.DrawingSurfaceMaxX_MM > Settings.DrawingSurfaceMinX_MM
+	surfaceMin := Coordinate{X: Settings.DrawingSurfaceMinX_MM, Y: Settings.DrawingSurfaceMinY_MM}.Minus(startingLocation)
+	surfaceMax := Coordinate{X: Settings.DrawingSurfaceMaxX_MM, Y: Settings.DrawingSurfaceMaxY_MM}.Minus(startingLocation)
+
+	minPoint := Coordinate{X: math.Inf(1), Y: math.Inf(1)}
+	maxPoint := Coordinate{X: math.Inf(-1), Y: math.Inf(-1)}
+	extend := func(point Coordinate) {
+		minPoint.X = math.Min(minPoint.X, point.X)
+		minPoint.Y = math.Min(minPoint.Y, point.Y)
+		maxPoint.X = math.Max(maxPoint.X, point.X)
+		maxPoint.Y = math.Max(maxPoint.Y, point.Y)
+	}
+	for _, point := range points {
+		extend(point)
+	}
+	if hasSurface {
+		extend(surfaceMin)
+		extend(surfaceMax)
+	}
+	minPoint = minPoint.Minus(Coordinate{X: svgPreviewBorder_MM, Y: svgPreviewBorder_MM})
+	maxPoint = maxPoint.Add(Coordinate{X: svgPreviewBorder_MM, Y: svgPreviewBorder_MM})
+	size := maxPoint.Minus(minPoint)
+
+	penWidth := Settings.PenWidth_MM
+	if penWidth <= 0 {
+		penWidth = 0.5
+	}
+
+	fmt.Fprintf(writer, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" width="%.3fmm" height="%.3fmm" viewBox="%.3f %.3f %.3f %.3f">
+`, size.X, size.Y, minPoint.X, minPoint.Y, size.X, size.Y)
+
+	if hasSurface {
+		fmt.Fprintf(writer, `<g id="surface" inkscape:groupmode="layer" inkscape:label="Drawing surface">
+<rect x="%.3f" y="%.3f" width="%.3f" height="%.3f" fill="none" stroke="#999" stroke-width="%.3f"/>
+</g>
+`, surfaceMin.X, surfaceMin.Y, surfaceMax.X-surfaceMin.X, surfaceMax.Y-surfaceMin.Y, penWidth)
+	}
+
+	fmt.Fprintf(writer, `<g id="travel" inkscape:groupmode="layer" inkscape:label="Pen up travel" fill="none" stroke="#bbb" stroke-width="%.3f" stroke-dasharray="%.3f">
+`, penWidth/2, penWidth*2)
+	writeSvgPolylines(writer, points, true)
+	fmt.Fprintln(writer, "</g>")
+
+	fmt.Fprintf(writer, `<g id="strokes" inkscape:groupmode="layer" inkscape:label="Pen down strokes" fill="none" stroke="#00f" stroke-width="%.3f" stroke-linecap="round" stroke-linejoin="round">
+`, penWidth)
+	writeSvgPolylines(writer, points, false)
+	fmt.Fprintln(writer, "</g>")
+
+	start, end := points[0], points[len(points)-1]
+	fmt.Fprintf(writer, `<g id="markers" inkscape:groupmode="layer" inkscape:label="Start and end">
+<circle cx="%.3f" cy="%.3f" r="%.3f" fill="#0a0"><title>Start</title></circle>
+<circle cx="%.3f" cy="%.3f" r="%.3f" fill="#d00"><title>End</title></circle>
+</g>
+</svg>
+`, start.X, start.Y, penWidth*3, end.X, end.Y, penWidth*2)
+}
+
+// Write each run of moves with the given pen state as a polyline, a move's pen state is that of the point it ends at
+func writeSvgPolylines(writer io.Writer, points []Coordinate, penUp bool) {
+	inLine := false
+	for index := 1; index < len(points); index++ {
+		if points[index].PenUp != penUp {
+			if inLine {
+				fmt.Fprintln(writer, `"/>`)
+				inLine = false
+			}
+			continue
+		}
+
+		if !inLine {
+			fmt.Fprintf(writer, `<polyline points="%.3f,%.3f`, points[index-1].X, points[index-1].Y)
+			inLine = true
+		}
+		fmt.Fprintf(writer, " %.3f,%.3f", points[index].X, points[index].Y)
+	}
+	if inLine {
+		fmt.Fprintln(writer, `"/>`)
+	}
+}
@@ -0,0 +1,50 @@
+package polargraph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteSvgPreview(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 800
+	Settings.StartingLeftDist_MM = 500
+	Settings.StartingRightDist_MM = 500
+	Settings.DrawingSurfaceMinX_MM = 100
+	Settings.DrawingSurfaceMaxX_MM = 700
+	Settings.DrawingSurfaceMinY_MM = 100
+	Settings.DrawingSurfaceMaxY_MM = 800
+	Settings.PenWidth_MM = 0.5
+
+	plotCoords := make(chan Coordinate, 5)
+	plotCoords <- Coordinate{X: 10, Y: 0, PenUp: true}
+	plotCoords <- Coordinate{X: 20, Y: 0}
+	plotCoords <- Coordinate{X: 20, Y: 10}
+	plotCoords <- Coordinate{X: 30, Y: 10, PenUp: true}
+	plotCoords <- Coordinate{X: 40, Y: 10}
+	close(plotCoords)
+
+	buffer := new(bytes.Buffer)
+	WriteSvgPreview(buffer, plotCoords)
+	svg := buffer.String()
+
+	// travel from the start and between strokes, strokes continue from where the travel ended
+	expected := []string{
+		`<polyline points="0.000,0.000 10.000,0.000"/>`,
+		`<polyline points="20.000,10.000 30.000,10.000"/>`,
+		`<polyline points="10.000,0.000 20.000,0.000 20.000,10.000"/>`,
+		`<polyline points="30.000,10.000 40.000,10.000"/>`,
+		// surface is relative to the start at 400, 300
+		`<rect x="-300.000" y="-200.000" width="600.000" height="700.000"`,
+		`<circle cx="40.000" cy="10.000"`,
+	}
+	for _, text := range expected {
+		if !strings.Contains(svg, text) {
+			t.Error("Expected svg to contain", text)
+		}
+	}
+	if strings.Index(svg, `id="travel"`) > strings.Index(svg, expected[1]) || strings.Index(svg, `id="strokes"`) > strings.Index(svg, expected[2]) {
+		t.Error("Expected travel and strokes on separate layers", svg)
+	}
+}
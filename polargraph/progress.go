@@ -0,0 +1,295 @@
+package polargraph
+
+// Tracks how far through a plot the arduino is and logs the session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// pattern for the temporary file step data is buffered to while counting it, each plot gets its own file
+var stepBufferPattern string = "gocupi-*.buffer"
+
+// name of the file plot sessions are logged to, each plot is added to the end so earlier jobs keep their logs
+var plotLogFile string = "plot_log.txt"
+
+// Total time of a plot that is sent while it is still being generated, so its length isn't known
+const unknownTotalTime_US float64 = -1
+
+// Write all of stepData to a temporary file so the length of the job is known before it starts
+// returns a channel that streams the buffered data back and the time the arduino will take to draw it,
+// the file is closed once all of it has been read or stop is called, which must happen if the reading stops early
+func BufferSteps(stepData <-chan int8) (bufferedData <-chan int8, totalTime_US float64, totalSlices int, stop func()) {
+
+	file, err := os.CreateTemp("", stepBufferPattern)
+	if err != nil {
+		panic(err)
+	}
+
+	// the name is removed straight away so nothing is left behind however the plot ends, the open file keeps the data
+	os.Remove(file.Name())
+	reading := false
+	defer func() {
+		if !reading {
+			file.Close()
+		}
+	}()
+
+	writer := bufio.NewWriter(file)
+	replay := NewStepReplay()
+	for frame, ok := ReadStepFrame(stepData); ok; frame, ok = ReadStepFrame(stepData) {
+		replay.Apply(frame)
+		if frame.IsSlice() {
+			totalSlices++
+		}
+		for _, value := range frame.Raw {
+			writer.WriteByte(byte(value))
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		panic(err)
+	}
+
+	buffered := make(chan int8, 1024)
+	done := make(chan struct{})
+	reading = true
+	go func() {
+		defer close(buffered)
+		defer file.Close()
+
+		reader := bufio.NewReader(file)
+		for {
+			value, err := reader.ReadByte()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				panic(err)
+			}
+			select {
+			case buffered <- int8(value):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var stopOnce sync.Once
+	stop = func() {
+		stopOnce.Do(func() { close(done) })
+	}
+	return buffered, replay.Elapsed_US, totalSlices, stop
+}
+
+// Snapshot of a plot's progress that is published while plotting
+type PlotUpdate struct {
+	// Percentage of the estimated time that the arduino has drawn, data still in its buffer isn't counted once it reports status
+	// -1 when the length of the plot isn't known
+	Percent float64
+
+	// Time since the plot started and estimated time until it finishes, Remaining_S is -1 when the length isn't known
+	Elapsed_S, Remaining_S float64
+
+	// Number of pen down strokes started so far
+	Stroke int
+
+	// Location of the pen relative to where the plot started
+	X, Y  float64
+	PenUp bool
+
+	// True while the plot is paused
+	Paused bool
+
+	// Bytes waiting in the arduino's buffer as of the last status report
+	BufferLength int
+}
+
+// Progress of a plot that is being sent to the arduino
+type plotProgress struct {
+	// replay of everything sent so far
+	replay *StepReplay
+
+	// location of the pen when the plot started, so positions are shown relative to the drawing
+	origin Coordinate
+
+	totalTime_US float64
+	totalSlices  int
+	sentSlices   int
+
+	// number of pen down strokes started so far
+	stroke int
+
+	// bytes waiting in the arduino's buffer as of the last status report
+	bufferLength int
+
+	// set by plotController while the plot is paused
+	paused bool
+
+	// updates are published here when not nil
+	updates chan<- PlotUpdate
+
+	startTime time.Time
+	logFile   *os.File
+	log       *log.Logger
+}
+
+// Start tracking a plot of the given length and add a session to the log, updates can be nil
+// totalTime_US is unknownTotalTime_US for a plot sent while it is being generated
+func newPlotProgress(totalTime_US float64, totalSlices int, updates chan<- PlotUpdate) *plotProgress {
+	logFile, err := os.OpenFile(plotLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+
+	progress := &plotProgress{
+		replay:       NewStepReplay(),
+		totalTime_US: totalTime_US,
+		totalSlices:  totalSlices,
+		updates:      updates,
+		startTime:    time.Now(),
+		logFile:      logFile,
+		log:          log.New(logFile, "", log.LstdFlags),
+	}
+	progress.origin = progress.replay.Wall
+	progress.log.Println("==== Plot session", progress.startTime.Format(time.RFC3339), "====")
+	if progress.knownLength() {
+		progress.log.Println("Plot started,", totalSlices, "slices, estimated time", time.Duration(totalTime_US)*time.Microsecond)
+	} else {
+		progress.log.Println("Plot started while it is being generated, its length isn't known")
+	}
+	return progress
+}
+
+// True if the length of the plot was counted before it started
+func (progress *plotProgress) knownLength() bool {
+	return progress.totalTime_US != unknownTotalTime_US
+}
+
+// Update the progress with a frame that has been sent to the arduino
+func (progress *plotProgress) Sent(frame StepFrame) {
+	wasPenUp := progress.replay.PenUp
+	progress.replay.Apply(frame)
+
+	if frame.IsSlice() {
+		progress.sentSlices++
+	} else if wasPenUp && !progress.replay.PenUp {
+		progress.stroke++
+		progress.log.Println("Stroke", progress.stroke, "started at", progress.Position())
+	} else if !wasPenUp && progress.replay.PenUp {
+		progress.log.Println("Stroke", progress.stroke, "finished at", progress.Position())
+	}
+}
+
+// Update the position with a frame that was sent for a PlotCommand rather than as part of the plot
+func (progress *plotProgress) Injected(frame StepFrame) {
+	frameTime_US := progress.replay.Apply(frame)
+	progress.replay.Elapsed_US -= frameTime_US
+}
+
+// Record the latest status report from the arduino
+func (progress *plotProgress) Status(status ControllerStatus) {
+	progress.bufferLength = status.BufferLength
+	if status.Error {
+		progress.log.Println("Arduino reported dropped data:", status)
+	}
+}
+
+// Add a line to the session log
+func (progress *plotProgress) Log(values ...interface{}) {
+	progress.log.Println(values...)
+}
+
+// Location of the pen relative to where the plot started, based on what has been sent
+func (progress *plotProgress) Position() Coordinate {
+	position := progress.replay.Wall.Minus(progress.origin)
+	position.PenUp = progress.replay.PenUp
+	return position
+}
+
+// Estimated time the arduino has spent drawing, everything sent minus the data still sitting in its buffer
+// without status reports the buffer length is unknown, so this is the time that has been sent
+func (progress *plotProgress) executed_US() float64 {
+	return math.Max(0, progress.replay.Elapsed_US-float64(progress.bufferLength/2)*TimeSlice_US)
+}
+
+// Estimated time until the arduino finishes, including the data still sitting in its buffer
+func (progress *plotProgress) Remaining() time.Duration {
+	remaining_US := progress.totalTime_US - progress.executed_US()
+	return time.Duration(remaining_US) * time.Microsecond
+}
+
+// Percentage of the estimated time that the arduino has drawn, -1 when the length isn't known
+func (progress *plotProgress) Percent() float64 {
+	if !progress.knownLength() {
+		return -1
+	}
+	if progress.totalTime_US > 0 {
+		return 100.0 * progress.executed_US() / progress.totalTime_US
+	}
+	return 100.0
+}
+
+// Current progress as a PlotUpdate
+func (progress *plotProgress) Update() PlotUpdate {
+	position := progress.Position()
+	remaining_S := -1.0
+	if progress.knownLength() {
+		remaining_S = progress.Remaining().Seconds()
+	}
+	return PlotUpdate{
+		Percent:      progress.Percent(),
+		Elapsed_S:    time.Since(progress.startTime).Seconds(),
+		Remaining_S:  remaining_S,
+		Stroke:       progress.stroke,
+		X:            position.X,
+		Y:            position.Y,
+		PenUp:        position.PenUp,
+		Paused:       progress.paused,
+		BufferLength: progress.bufferLength,
+	}
+}
+
+// Send the current progress to updates without waiting if nothing is reading it
+func (progress *plotProgress) Publish() {
+	if progress.updates == nil {
+		return
+	}
+	select {
+	case progress.updates <- progress.Update():
+	default:
+	}
+}
+
+// plotProgress ToString
+func (progress *plotProgress) String() string {
+	position := progress.Position()
+	elapsed := time.Since(progress.startTime) / time.Second * time.Second
+	if !progress.knownLength() {
+		return fmt.Sprintf("Sent %d slices  Elapsed %v  Stroke %d  X %.1f Y %.1f", progress.sentSlices, elapsed, progress.stroke, position.X, position.Y)
+	}
+	return fmt.Sprintf("%5.1f%%  Elapsed %v  ETA %v  Stroke %d  X %.1f Y %.1f",
+		progress.Percent(),
+		elapsed,
+		progress.Remaining()/time.Second*time.Second,
+		progress.stroke,
+		position.X, position.Y)
+}
+
+// Log the end of the plot and close the log file
+func (progress *plotProgress) Close() {
+	progress.Publish()
+	if progress.knownLength() {
+		progress.log.Println("Plot finished after", time.Since(progress.startTime), "sent", progress.sentSlices, "of", progress.totalSlices, "slices")
+	} else {
+		progress.log.Println("Plot finished after", time.Since(progress.startTime), "sent", progress.sentSlices, "slices")
+	}
+	progress.logFile.Close()
+}
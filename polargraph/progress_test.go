@@ -0,0 +1,134 @@
+package polargraph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufferSteps(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.StepSize_MM = 0.1
+
+	stepData := make(chan int8, 1024)
+	SendPenDown(stepData)
+	encodeSlice(-32, 32, stepData)
+	encodeSlice(5, -7, stepData)
+	SendDwell(100, stepData)
+	close(stepData)
+
+	expected := []int8{CommandPrefix, int8(PenDownCommand), -32, 32, 5, -7, CommandPrefix, int8(DwellCommand), 0, 100}
+
+	buffered, totalTime_US, totalSlices, stop := BufferSteps(stepData)
+	defer stop()
+	for index, value := range expected {
+		if actual := <-buffered; actual != value {
+			t.Error("Value", index, "expected", value, "got", actual)
+		}
+	}
+	if _, ok := <-buffered; ok {
+		t.Error("Expected buffered data to be closed")
+	}
+
+	if totalSlices != 2 {
+		t.Error("Expected 2 slices, got", totalSlices)
+	}
+	if expectedTime_US := 2*TimeSlice_US + float64(DefaultPenDelay_MS+100)*1000; totalTime_US != expectedTime_US {
+		t.Error("Expected time", expectedTime_US, "got", totalTime_US)
+	}
+}
+
+// the file is never left behind, even when the steps can't be read or the reading stops part way through
+func TestBufferStepsStop(t *testing.T) {
+	defer func(saved string) { stepBufferPattern = saved }(stepBufferPattern)
+	stepBufferPattern = "gocupi_test_*.buffer"
+	leftBehind := func() bool {
+		files, _ := filepath.Glob(filepath.Join(os.TempDir(), "gocupi_test_*.buffer"))
+		return len(files) > 0
+	}
+
+	stepData := make(chan int8, 4096)
+	for i := 0; i < 2000; i++ {
+		encodeSlice(1, 1, stepData)
+	}
+	close(stepData)
+
+	buffered, _, _, stop := BufferSteps(stepData)
+	if leftBehind() {
+		t.Error("Expected the buffer file to be removed before it is read")
+	}
+	<-buffered
+	stop()
+	for range buffered {
+	}
+
+	// step data that ends in the middle of a command panics while buffering
+	stepData = make(chan int8, 2)
+	stepData <- CommandPrefix
+	stepData <- int8(DwellCommand)
+	close(stepData)
+	func() {
+		defer func() { recover() }()
+		BufferSteps(stepData)
+		t.Error("Expected truncated step data to panic")
+	}()
+	if leftBehind() {
+		t.Error("Expected the buffer file to be removed after a panic")
+	}
+}
+
+func TestPlotProgressPercent(t *testing.T) {
+	plotLogFile = filepath.Join(os.TempDir(), "gocupi_test_plot_log.txt")
+	defer os.Remove(plotLogFile)
+
+	progress := newPlotProgress(10*TimeSlice_US, 10, nil)
+	defer progress.Close()
+	for i := 0; i < 10; i++ {
+		progress.Sent(StepFrame{Raw: []int8{0, 0}})
+	}
+	if percent := progress.Percent(); percent != 100 {
+		t.Error("Expected everything sent to count without a status report, got", percent)
+	}
+
+	// 4 slices are still waiting in the arduino's buffer
+	progress.Status(ControllerStatus{BufferLength: 8})
+	if percent := progress.Percent(); percent != 60 {
+		t.Error("Expected buffered slices not to count, got", percent)
+	}
+	if remaining := progress.Remaining(); remaining != time.Duration(4*TimeSlice_US)*time.Microsecond {
+		t.Error("Expected 4 slices remaining, got", remaining)
+	}
+	// a plot sent while it is being generated has no percentage or ETA
+	streamed := newPlotProgress(unknownTotalTime_US, 0, nil)
+	defer streamed.Close()
+	streamed.Sent(StepFrame{Raw: []int8{0, 0}})
+	if update := streamed.Update(); update.Percent != -1 || update.Remaining_S != -1 {
+		t.Error("Expected the percentage and ETA to be unknown, got", update)
+	}
+}
+
+// every plot adds to the log so the logs of earlier jobs are kept
+func TestPlotProgressLogAppends(t *testing.T) {
+	defer func(saved string) { plotLogFile = saved }(plotLogFile)
+	plotLogFile = filepath.Join(os.TempDir(), "gocupi_test_append_plot_log.txt")
+	os.Remove(plotLogFile)
+	defer os.Remove(plotLogFile)
+
+	for job := 0; job < 2; job++ {
+		progress := newPlotProgress(10*TimeSlice_US, 10, nil)
+		progress.Log("Job", job)
+		progress.Close()
+	}
+
+	data, err := ioutil.ReadFile(plotLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	if strings.Count(log, "Plot session") != 2 || !strings.Contains(log, "Job 0") || !strings.Contains(log, "Job 1") {
+		t.Error("Expected both plots to be logged, got", log)
+	}
+}
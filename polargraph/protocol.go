@@ -0,0 +1,279 @@
+package polargraph
+
+// Encodes and decodes the step data that is sent to the arduino
+
+import (
+	"fmt"
+	"math"
+)
+
+// Commands that can be sent in place of a time slice, the values are also set in StepperDriver.ino
+// Each command is sent as CommandPrefix, the command, then each argument split into two 7 bit values
+type StepCommand int8
+
+const (
+	// Not a command, the frame is a movement slice
+	NoCommand StepCommand = 0
+
+	// A slice with values too large for a single byte, args: left steps, right steps
+	WideSliceCommand StepCommand = 1
+
+	// Move the pen servo to an angle, args: angle in degrees, 1 if this angle lifts the pen off the surface
+	PenHeightCommand StepCommand = 2
+
+	// Stop moving for a period of time, args: milliseconds
+	DwellCommand StepCommand = 3
+
+	// Turn the stepper drivers on or off, args: 1 to enable, 0 to disable
+	MotorEnableCommand StepCommand = 4
+
+	// Overwrite the arduino's spool positions, args: high and low 14 bits of the left position, then of the right position
+	SetPositionCommand StepCommand = 5
+
+	// Set how long to wait for the pen servo, args: milliseconds after lifting, milliseconds after dropping
+	PenTimingCommand StepCommand = 6
+
+	// Pause until the plot is resumed so the pen can be changed, args: pen number
+	// only used by gocupi, the plot controller pauses on it and it is never sent to the arduino
+	PenChangeCommand StepCommand = 7
+
+	// Raise the pen, the same value as CommandPrefix so the frame matches the original pen up encoding
+	PenUpCommand StepCommand = -127
+
+	// Lower the pen
+	PenDownCommand StepCommand = 127
+)
+
+// Largest value that can be sent as a single argument
+const commandArgMaxValue int = 8191
+
+// Number of arguments sent with each command
+var commandArgCount = map[StepCommand]int{
+	WideSliceCommand:   2,
+	PenHeightCommand:   2,
+	DwellCommand:       1,
+	MotorEnableCommand: 1,
+	SetPositionCommand: 4,
+	PenTimingCommand:   2,
+	PenChangeCommand:   1,
+}
+
+// StepCommand ToString
+func (command StepCommand) String() string {
+	switch command {
+	case NoCommand:
+		return "NoCommand"
+	case WideSliceCommand:
+		return "WideSlice"
+	case PenHeightCommand:
+		return "PenHeight"
+	case DwellCommand:
+		return "Dwell"
+	case MotorEnableCommand:
+		return "MotorEnable"
+	case SetPositionCommand:
+		return "SetPosition"
+	case PenTimingCommand:
+		return "PenTiming"
+	case PenChangeCommand:
+		return "PenChange"
+	case PenUpCommand:
+		return "PenUp"
+	case PenDownCommand:
+		return "PenDown"
+	}
+	return "UNKNOWN"
+}
+
+// A single decoded time slice or command from the step data
+type StepFrame struct {
+	// Steps moved by each spool during the slice, multiplied by StepsFixedPointFactor, in the order they are sent to the arduino
+	// For SetPositionCommand these are the new absolute positions
+	Left, Right int
+
+	// NoCommand for a movement slice
+	Command StepCommand
+
+	// Decoded arguments of the command
+	Args []int
+
+	// The encoded values exactly as they will be sent over serial
+	Raw []int8
+}
+
+// True if the frame is a movement slice rather than a command
+func (frame StepFrame) IsSlice() bool {
+	return frame.Command == NoCommand
+}
+
+// For commands that move the pen returns true and whether the pen ends up off the surface
+func (frame StepFrame) PenState() (movesPen, penUp bool) {
+	switch frame.Command {
+	case PenUpCommand:
+		return true, true
+	case PenDownCommand:
+		return true, false
+	case PenHeightCommand:
+		return true, frame.Args[1] != 0
+	}
+	return false, false
+}
+
+// Send the steps for a single time slice, values that don't fit in a single byte are sent as a wide slice
+func encodeSlice(left, right int, stepData chan<- int8) {
+	if math.Abs(float64(left)) <= StepsMaxValue && math.Abs(float64(right)) <= StepsMaxValue {
+		stepData <- int8(left)
+		stepData <- int8(right)
+		return
+	}
+
+	if !Settings.WideSteps || math.Abs(float64(left)) > WideStepsMaxValue || math.Abs(float64(right)) > WideStepsMaxValue {
+		panic(fmt.Sprint("Slice of ", left, ", ", right, " steps is outside the range that can be sent to the arduino"))
+	}
+
+	encodeCommand(WideSliceCommand, stepData, left, right)
+}
+
+// Send a command and its arguments
+func encodeCommand(command StepCommand, stepData chan<- int8, args ...int) {
+	if len(args) != commandArgCount[command] {
+		panic(fmt.Sprint(command, " expects ", commandArgCount[command], " arguments and was given ", len(args)))
+	}
+
+	stepData <- CommandPrefix
+	stepData <- int8(command)
+	for _, arg := range args {
+		if arg > commandArgMaxValue || arg < -commandArgMaxValue-1 {
+			panic(fmt.Sprint(command, " argument ", arg, " is outside the range that can be sent to the arduino"))
+		}
+		high, low := splitWideValue(arg)
+		stepData <- high
+		stepData <- low
+	}
+}
+
+// Raise the pen
+func SendPenUp(stepData chan<- int8) {
+	encodeCommand(PenUpCommand, stepData)
+}
+
+// Lower the pen
+func SendPenDown(stepData chan<- int8) {
+	encodeCommand(PenDownCommand, stepData)
+}
+
+// Move the pen servo to the given angle in degrees, penUp tells the arduino if this angle lifts the pen off the surface
+func SendPenHeight(angle int, penUp bool, stepData chan<- int8) {
+	if penUp {
+		encodeCommand(PenHeightCommand, stepData, angle, 1)
+	} else {
+		encodeCommand(PenHeightCommand, stepData, angle, 0)
+	}
+}
+
+// Set how many milliseconds the arduino waits after lifting and after dropping the pen, lasts until the next ResetCommand
+func SendPenTiming(liftDelay_MS, dropDelay_MS int, stepData chan<- int8) {
+	encodeCommand(PenTimingCommand, stepData, liftDelay_MS, dropDelay_MS)
+}
+
+// Stop moving for the given number of milliseconds, long dwells are split into several commands
+func SendDwell(milliseconds int, stepData chan<- int8) {
+	for milliseconds > 0 {
+		dwell := milliseconds
+		if dwell > commandArgMaxValue {
+			dwell = commandArgMaxValue
+		}
+		encodeCommand(DwellCommand, stepData, dwell)
+		milliseconds -= dwell
+	}
+}
+
+// Pause the plot so the pen can be changed to the given pen number
+func SendPenChange(pen int, stepData chan<- int8) {
+	encodeCommand(PenChangeCommand, stepData, pen)
+}
+
+// Turn the stepper drivers on or off, the spools are free to turn while disabled
+func SendMotorEnable(enabled bool, stepData chan<- int8) {
+	if enabled {
+		encodeCommand(MotorEnableCommand, stepData, 1)
+	} else {
+		encodeCommand(MotorEnableCommand, stepData, 0)
+	}
+}
+
+// Overwrite the arduino's spool positions, in steps multiplied by StepsFixedPointFactor
+func SendSetPosition(left, right int, stepData chan<- int8) {
+	leftHigh, leftLow := splitPosition(left)
+	rightHigh, rightLow := splitPosition(right)
+	encodeCommand(SetPositionCommand, stepData, leftHigh, leftLow, rightHigh, rightLow)
+}
+
+// Split a position into its high and low 14 bits, the low bits are sent as a signed value so every argument uses the same encoding
+func splitPosition(position int) (high, low int) {
+	low = position & 0x3FFF
+	if low&0x2000 != 0 {
+		low -= 0x4000
+	}
+	return position >> 14, low
+}
+
+// Split a value into the high and low 7 bits of a 14 bit two's complement number, so no byte can be mistaken for ResetCommand
+func splitWideValue(value int) (high, low int8) {
+	return int8((value >> 7) & 0x7F), int8(value & 0x7F)
+}
+
+// Combine the two 7 bit halves created by splitWideValue
+func joinWideValue(high, low int8) int {
+	value := int(high)<<7 | int(low)
+	if value&0x2000 != 0 {
+		value -= 0x4000
+	}
+	return value
+}
+
+// Read the next frame from stepData, returns false once stepData is closed
+func ReadStepFrame(stepData <-chan int8) (frame StepFrame, ok bool) {
+
+	var left, right int8
+	if left, ok = <-stepData; !ok {
+		return
+	}
+	if right, ok = <-stepData; !ok {
+		return
+	}
+	frame.Raw = []int8{left, right}
+
+	switch left {
+	case CommandPrefix:
+		frame.Command = StepCommand(right)
+		for argIndex := 0; argIndex < commandArgCount[frame.Command]; argIndex++ {
+			high, highOk := <-stepData
+			low, lowOk := <-stepData
+			if !highOk || !lowOk {
+				panic(fmt.Sprint("Step data ended in the middle of a ", frame.Command, " command"))
+			}
+			frame.Raw = append(frame.Raw, high, low)
+			frame.Args = append(frame.Args, joinWideValue(high, low))
+		}
+
+		switch frame.Command {
+		case WideSliceCommand:
+			frame.Command = NoCommand
+			frame.Left = frame.Args[0]
+			frame.Right = frame.Args[1]
+		case SetPositionCommand:
+			frame.Left = frame.Args[0]<<14 | frame.Args[1]&0x3FFF
+			frame.Right = frame.Args[2]<<14 | frame.Args[3]&0x3FFF
+		}
+
+	case LegacyPenDown:
+		frame.Command = PenDownCommand
+
+	default:
+		frame.Left = int(left)
+		frame.Right = int(right)
+	}
+
+	return frame, true
+}
@@ -0,0 +1,75 @@
+package polargraph
+
+// Tests for encoding and decoding step data
+
+import (
+	"testing"
+)
+
+// Wide values should survive being split into two 7 bit bytes
+func TestWideValueRoundTrip(t *testing.T) {
+	for _, value := range []int{0, 1, -1, 127, -127, 768, -768, 8191, -8192} {
+		high, low := splitWideValue(value)
+		if high < 0 || low < 0 {
+			t.Error("Wide value bytes must not be negative", value, high, low)
+		}
+		if result := joinWideValue(high, low); result != value {
+			t.Error("Expected", value, "and got", result)
+		}
+	}
+}
+
+// Slices and commands should decode to the same values that were encoded, using the wide encoding only when needed
+func TestEncodeSlice(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.WideSteps = true
+
+	stepData := make(chan int8, 64)
+	encodeSlice(12, -126, stepData)
+	encodeSlice(-500, 3, stepData)
+	SendPenDown(stepData)
+	SendSetPosition(-100000, 9000, stepData)
+	stepData <- LegacyPenDown
+	stepData <- LegacyPenDown
+	close(stepData)
+
+	frame, ok := ReadStepFrame(stepData)
+	if !ok || !frame.IsSlice() || frame.Left != 12 || frame.Right != -126 || len(frame.Raw) != 2 {
+		t.Error("Unexpected narrow slice", frame)
+	}
+
+	frame, ok = ReadStepFrame(stepData)
+	if !ok || !frame.IsSlice() || frame.Left != -500 || frame.Right != 3 || len(frame.Raw) != 6 {
+		t.Error("Unexpected wide slice", frame)
+	}
+
+	frame, ok = ReadStepFrame(stepData)
+	if !ok || frame.Command != PenDownCommand || len(frame.Raw) != 2 {
+		t.Error("Unexpected command", frame)
+	}
+
+	frame, ok = ReadStepFrame(stepData)
+	if !ok || frame.Command != SetPositionCommand || frame.Left != -100000 || frame.Right != 9000 || len(frame.Raw) != 10 {
+		t.Error("Unexpected set position", frame)
+	}
+
+	frame, ok = ReadStepFrame(stepData)
+	if !ok || frame.Command != PenDownCommand {
+		t.Error("Expected legacy pen down to decode as PenDownCommand", frame)
+	}
+
+	if _, ok = ReadStepFrame(stepData); ok {
+		t.Error("Expected end of step data")
+	}
+}
+
+func TestPenAngle(t *testing.T) {
+	settings := SettingsData{PenUpAngle: 40, PenDownAngle: 140, PenLightAngle: 120}
+
+	tests := map[float64]int{0: 140, 0.5: 130, 1: 120, -1: 140, 2: 120}
+	for height, expected := range tests {
+		if angle := settings.PenAngle(height); angle != expected {
+			t.Error("PenAngle", height, "expected", expected, "got", angle)
+		}
+	}
+}
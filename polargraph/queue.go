@@ -0,0 +1,427 @@
+package polargraph
+
+// Queue of drawings that is stored on disk so it survives restarts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// name of the file the job queue is stored in
+var jobQueueFile string = "job_queue.json"
+
+// Starts generating the coordinates for a job, args are a command and its parameters as given on the command line
+// goroutines that generate the coordinates must be started with generation.Go so a failure can't end the program
+type PlotJobGenerator func(args []string, generation *Generation) (<-chan Coordinate, error)
+
+// States a job can be in
+const (
+	JobQueued      string = "queued"
+	JobWaiting     string = "waiting" // next to run, waiting for the paper and pen to be changed
+	JobRunning     string = "running"
+	JobDone        string = "done"
+	JobAborted     string = "aborted"
+	JobFailed      string = "failed"
+	JobInterrupted string = "interrupted" // was running when gocupi stopped
+)
+
+// A drawing in the queue
+type PlotJob struct {
+	Id int
+
+	// Command and parameters, as they would be given on the command line
+	Args []string
+
+	// Input file the command reads, empty if the command doesn't need one
+	File string
+
+	// Sha256 of File when the job was queued, used to detect the file changing before the job runs
+	FileHash string
+
+	// Where the drawing is placed relative to the starting position of the pen
+	OffsetX_MM, OffsetY_MM float64
+
+	// One of the Job states
+	State string
+
+	// Reason the job failed
+	Error string
+
+	Created, Started, Finished time.Time
+}
+
+// Jobs and the file they are stored in
+type JobQueue struct {
+	mutex    sync.Mutex
+	fileName string
+
+	Jobs   []*PlotJob
+	NextId int
+
+	// called with a copy of a job every time it changes, can be nil
+	OnChange func(job PlotJob) `json:"-"`
+}
+
+// Load the queue from fileName, or create an empty queue if the file doesn't exist
+func LoadJobQueue(fileName string) *JobQueue {
+	queue := &JobQueue{fileName: fileName, NextId: 1}
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return queue
+	} else if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(data, queue); err != nil {
+		panic(fmt.Sprint("Unable to read job queue ", fileName, ": ", err))
+	}
+
+	// anything still running was stopped part way through
+	for _, job := range queue.Jobs {
+		switch job.State {
+		case JobRunning:
+			job.State = JobInterrupted
+		case JobWaiting:
+			job.State = JobQueued
+		}
+	}
+	queue.save()
+	return queue
+}
+
+// Load the queue gocupi uses from jobQueueFile
+func OpenJobQueue() *JobQueue {
+	return LoadJobQueue(jobQueueFile)
+}
+
+// Write the queue to its file, mutex must be held
+func (queue *JobQueue) save() {
+	data, err := json.MarshalIndent(queue, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+
+	// write to a temporary file first so the queue is never left half written
+	if err := ioutil.WriteFile(queue.fileName+".tmp", data, 0666); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(queue.fileName+".tmp", queue.fileName); err != nil {
+		panic(err)
+	}
+}
+
+// Calculate the sha256 of a file, which must be one OpenInput allows
+func hashFile(fileName string) (string, error) {
+	file, err := OpenInput(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// The first argument that names an existing file, which is the input file for commands like svg and imagearc
+// arguments outside of InputDirectories are skipped without being looked at, so a job can't find out what files exist
+func findInputFile(args []string) string {
+	for _, arg := range args[1:] {
+		if len(InputDirectories) > 0 && checkInputDirectory(arg) != nil {
+			continue
+		}
+		if info, err := os.Stat(arg); err == nil && !info.IsDir() {
+			return arg
+		}
+	}
+	return ""
+}
+
+// Add a job to the end of the queue, file is the job's input file or empty to look for one in args
+func (queue *JobQueue) Add(args []string, file string, offset Coordinate) (PlotJob, error) {
+	if len(args) == 0 {
+		return PlotJob{}, errors.New("A job needs a command")
+	}
+	if ReadsStdin(args) {
+		return PlotJob{}, errors.New("A job can't read from stdin, it may run after gocupi restarts")
+	}
+
+	job := &PlotJob{
+		Args:       args,
+		File:       file,
+		OffsetX_MM: offset.X,
+		OffsetY_MM: offset.Y,
+		State:      JobQueued,
+		Created:    time.Now(),
+	}
+	if job.File == "" {
+		job.File = findInputFile(args)
+	}
+	if job.File != "" {
+		var err error
+		if job.FileHash, err = hashFile(job.File); err != nil {
+			return PlotJob{}, err
+		}
+	}
+
+	queue.mutex.Lock()
+	job.Id = queue.NextId
+	queue.NextId++
+	queue.Jobs = append(queue.Jobs, job)
+	queue.save()
+	added := *job
+	queue.mutex.Unlock()
+
+	queue.changed(added)
+	return added, nil
+}
+
+// Copy of all jobs
+func (queue *JobQueue) List() []PlotJob {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	jobs := make([]PlotJob, len(queue.Jobs))
+	for index, job := range queue.Jobs {
+		jobs[index] = *job
+	}
+	return jobs
+}
+
+// Copy of a single job
+func (queue *JobQueue) Get(id int) (PlotJob, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if job := queue.find(id); job != nil {
+		return *job, true
+	}
+	return PlotJob{}, false
+}
+
+// Find a job, mutex must be held
+func (queue *JobQueue) find(id int) *PlotJob {
+	for _, job := range queue.Jobs {
+		if job.Id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// The oldest job that is queued
+func (queue *JobQueue) NextQueued() (PlotJob, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for _, job := range queue.Jobs {
+		if job.State == JobQueued {
+			return *job, true
+		}
+	}
+	return PlotJob{}, false
+}
+
+// Remove a job that isn't running
+func (queue *JobQueue) Remove(id int) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for index, job := range queue.Jobs {
+		if job.Id != id {
+			continue
+		}
+		if job.State == JobRunning || job.State == JobWaiting {
+			return errors.New("Can't remove a running job, abort it first")
+		}
+		queue.Jobs = append(queue.Jobs[:index], queue.Jobs[index+1:]...)
+		queue.save()
+		return nil
+	}
+	return errors.New(fmt.Sprint("No job ", id))
+}
+
+// Put a job that didn't finish back in the queue
+func (queue *JobQueue) Retry(id int) error {
+	return queue.setState(id, JobQueued, "", func(job *PlotJob) error {
+		if job.State == JobRunning || job.State == JobWaiting || job.State == JobQueued {
+			return errors.New(fmt.Sprint("Job ", id, " is ", job.State))
+		}
+		job.Error = ""
+		job.Started = time.Time{}
+		job.Finished = time.Time{}
+		return nil
+	})
+}
+
+// Change the state of a job, check can refuse the change by returning an error
+func (queue *JobQueue) setState(id int, state, errorText string, check func(job *PlotJob) error) error {
+	queue.mutex.Lock()
+	job := queue.find(id)
+	if job == nil {
+		queue.mutex.Unlock()
+		return errors.New(fmt.Sprint("No job ", id))
+	}
+	if check != nil {
+		if err := check(job); err != nil {
+			queue.mutex.Unlock()
+			return err
+		}
+	}
+
+	job.State = state
+	job.Error = errorText
+	switch state {
+	case JobRunning:
+		job.Started = time.Now()
+	case JobDone, JobAborted, JobFailed:
+		job.Finished = time.Now()
+	}
+	queue.save()
+	changed := *job
+	queue.mutex.Unlock()
+
+	queue.changed(changed)
+	return nil
+}
+
+// Tell OnChange about a job
+func (queue *JobQueue) changed(job PlotJob) {
+	if queue.OnChange != nil {
+		queue.OnChange(job)
+	}
+}
+
+// Run the generator for a job, turning any panic from loading its files into an error
+// generation has the error for anything that fails after the coordinates have started to be generated
+func generateJob(job PlotJob, generator PlotJobGenerator) (plotCoords <-chan Coordinate, generation *Generation, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprint(r))
+		}
+	}()
+
+	if job.File != "" {
+		hash, err := hashFile(job.File)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hash != job.FileHash {
+			return nil, nil, errors.New(fmt.Sprint(job.File, " has changed since the job was queued"))
+		}
+	}
+
+	generation = NewGeneration()
+	plotCoords, err = generator(job.Args, generation)
+	return plotCoords, generation, err
+}
+
+// Move each coordinate by the job's offset, then return to the starting position so the next job starts from the same place
+func offsetPlotCoords(job PlotJob, plotCoords <-chan Coordinate) <-chan Coordinate {
+	offset := Coordinate{X: job.OffsetX_MM, Y: job.OffsetY_MM}
+	offsetCoords := make(chan Coordinate, 1024)
+
+	go func() {
+		defer close(offsetCoords)
+		for coord := range plotCoords {
+			moved := coord.Add(offset)
+			moved.PenUp = coord.PenUp
+			moved.PenHeight = coord.PenHeight
+			offsetCoords <- moved
+		}
+		offsetCoords <- Coordinate{X: 0, Y: 0, PenUp: true}
+	}()
+
+	return offsetCoords
+}
+
+// Plot queued jobs back to back until none are left or one is aborted, or only job id if it isn't 0
+// when waitBetween is set, each job after the first waits for a ResumeAction on controls so the paper and pen can be changed
+func (queue *JobQueue) Run(id int, generator PlotJobGenerator, waitBetween bool, controls <-chan PlotCommand, updates chan<- PlotUpdate) error {
+
+	for first := true; ; first = false {
+		var job PlotJob
+		var ok bool
+		if id != 0 {
+			if !first {
+				return nil
+			}
+			if job, ok = queue.Get(id); !ok || (job.State != JobQueued && job.State != JobInterrupted) {
+				return errors.New(fmt.Sprint("Job ", id, " is not queued"))
+			}
+		} else if job, ok = queue.NextQueued(); !ok {
+			fmt.Println("No more jobs are queued")
+			return nil
+		}
+
+		if waitBetween && !first {
+			queue.setState(job.Id, JobWaiting, "", nil)
+			if !waitForResume(job, controls) {
+				queue.setState(job.Id, JobQueued, "", nil)
+				return nil
+			}
+		}
+
+		if queue.runJob(job, generator, controls, updates) != JobDone {
+			return nil
+		}
+	}
+}
+
+// Wait for the next job to be confirmed, returns false if the queue was aborted instead
+func waitForResume(job PlotJob, controls <-chan PlotCommand) bool {
+	fmt.Println()
+	fmt.Println("Change the paper and pen for job", job.Id, job.Args, "then enter resume, or abort to stop the queue")
+
+	for command := range controls {
+		switch command.Action {
+		case ResumeAction:
+			return true
+		case AbortAction:
+			return false
+		}
+	}
+	return false
+}
+
+// Plot a single job, returns the state it finished in
+func (queue *JobQueue) runJob(job PlotJob, generator PlotJobGenerator, controls <-chan PlotCommand, updates chan<- PlotUpdate) (state string) {
+
+	fmt.Println("Starting job", job.Id, job.Args)
+	plotCoords, generation, err := generateJob(job, generator)
+	if err != nil {
+		fmt.Println("ERROR: Job", job.Id, "failed:", err)
+		queue.setState(job.Id, JobFailed, err.Error(), nil)
+		return JobFailed
+	}
+	queue.setState(job.Id, JobRunning, "", nil)
+
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("ERROR: Job", job.Id, "failed:", r)
+			state = JobFailed
+			queue.setState(job.Id, JobFailed, fmt.Sprint(r), nil)
+		}
+	}()
+
+	stepData := make(chan int8, 1024)
+	offsetCoords := offsetPlotCoords(job, plotCoords)
+	generation.Go(func() { GenerateSteps(offsetCoords, stepData) })
+	if WriteStepsToSerial(stepData, generation, false, controls, updates) {
+		state = JobAborted
+	} else {
+		state = JobDone
+	}
+	queue.setState(job.Id, state, "", nil)
+	return state
+}
@@ -0,0 +1,216 @@
+package polargraph
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJobQueuePersistence(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gocupi_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	inputFile := filepath.Join(directory, "drawing.svg")
+	if err := ioutil.WriteFile(inputFile, []byte("<svg></svg>"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	queueFile := filepath.Join(directory, "job_queue.json")
+
+	queue := LoadJobQueue(queueFile)
+	first, err := queue.Add([]string{"svg", "100", inputFile}, "", Coordinate{X: 10, Y: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Id != 1 || first.File != inputFile || first.FileHash == "" || first.OffsetX_MM != 10 || first.OffsetY_MM != 20 {
+		t.Error("Unexpected job", first)
+	}
+	second, _ := queue.Add([]string{"spiral", "10", "5"}, "", Coordinate{})
+	if second.Id != 2 || second.File != "" {
+		t.Error("Unexpected job", second)
+	}
+	if _, err := queue.Add(nil, "", Coordinate{}); err == nil {
+		t.Error("Expected a job without a command to fail")
+	}
+	if _, err := queue.Add([]string{"svg", "100", "-"}, "", Coordinate{}); err == nil {
+		t.Error("Expected a job reading stdin to fail")
+	}
+
+	// a job that was running when gocupi stopped is interrupted after reloading
+	queue.setState(first.Id, JobRunning, "", nil)
+	queue = LoadJobQueue(queueFile)
+	jobs := queue.List()
+	if len(jobs) != 2 || jobs[0].State != JobInterrupted || jobs[1].State != JobQueued || queue.NextId != 3 {
+		t.Fatal("Unexpected jobs after reloading", jobs)
+	}
+	if next, ok := queue.NextQueued(); !ok || next.Id != 2 {
+		t.Error("Expected job 2 to be next, got", next)
+	}
+
+	if err := queue.Retry(second.Id); err == nil {
+		t.Error("Expected retrying a queued job to fail")
+	}
+	if err := queue.Retry(first.Id); err != nil {
+		t.Error(err)
+	}
+	if next, ok := queue.NextQueued(); !ok || next.Id != 1 {
+		t.Error("Expected job 1 to be next after retrying, got", next)
+	}
+
+	if err := queue.Remove(second.Id); err != nil || len(queue.List()) != 1 {
+		t.Error("Expected job 2 to be removed", err)
+	}
+	if err := queue.Remove(second.Id); err == nil {
+		t.Error("Expected removing a missing job to fail")
+	}
+
+	// changing the input file stops the job from being generated
+	generator := func(args []string, generation *Generation) (<-chan Coordinate, error) {
+		plotCoords := make(chan Coordinate)
+		close(plotCoords)
+		return plotCoords, nil
+	}
+	job, _ := queue.Get(first.Id)
+	if _, _, err := generateJob(job, generator); err != nil {
+		t.Error(err)
+	}
+	ioutil.WriteFile(inputFile, []byte("<svg>changed</svg>"), 0666)
+	if _, _, err := generateJob(job, generator); err == nil {
+		t.Error("Expected a changed input file to be detected")
+	}
+}
+
+// jobs only look at files inside InputDirectories, others aren't found or hashed
+func TestJobQueueInputDirectories(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gocupi_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	allowed := filepath.Join(directory, "jobs")
+	os.Mkdir(allowed, 0777)
+	inside := filepath.Join(allowed, "drawing.svg")
+	outside := filepath.Join(directory, "secret.svg")
+	ioutil.WriteFile(inside, []byte("<svg></svg>"), 0666)
+	ioutil.WriteFile(outside, []byte("<svg></svg>"), 0666)
+
+	defer func(saved []string) { InputDirectories = saved }(InputDirectories)
+	InputDirectories = []string{allowed}
+	queue := LoadJobQueue(filepath.Join(directory, "job_queue.json"))
+
+	if job, err := queue.Add([]string{"svg", "100", outside}, "", Coordinate{}); err != nil || job.File != "" || job.FileHash != "" {
+		t.Error("Expected a file outside the directories to be ignored, got", job.File, job.FileHash, err)
+	}
+	if job, err := queue.Add([]string{"svg", "100", inside}, "", Coordinate{}); err != nil || job.File != inside || job.FileHash == "" {
+		t.Error("Expected the file inside the directories to be hashed, got", job.File, job.FileHash, err)
+	}
+	if _, err := queue.Add([]string{"svg", "100", "{file}"}, outside, Coordinate{}); err == nil {
+		t.Error("Expected a job file outside the directories to be refused")
+	}
+}
+
+func TestOffsetPlotCoords(t *testing.T) {
+	plotCoords := make(chan Coordinate, 2)
+	plotCoords <- Coordinate{X: 0, Y: 0, PenUp: true}
+	plotCoords <- Coordinate{X: 5, Y: 5, PenHeight: 0.5}
+	close(plotCoords)
+
+	expected := []Coordinate{
+		{X: 10, Y: 20, PenUp: true},
+		{X: 15, Y: 25, PenHeight: 0.5},
+		{X: 0, Y: 0, PenUp: true},
+	}
+	index := 0
+	for coord := range offsetPlotCoords(PlotJob{OffsetX_MM: 10, OffsetY_MM: 20}, plotCoords) {
+		if index >= len(expected) || !coord.Equals(expected[index]) || coord.PenUp != expected[index].PenUp {
+			t.Error("Unexpected coordinate", index, coord)
+		}
+		index++
+	}
+	if index != len(expected) {
+		t.Error("Expected", len(expected), "coordinates, got", index)
+	}
+}
+
+// Serial port that fails the test if it is read from or written to
+type unusedPort struct {
+	t *testing.T
+}
+
+func (port *unusedPort) Read(data []byte) (int, error) {
+	port.t.Error("Expected nothing to be read from the port")
+	return 0, io.EOF
+}
+
+func (port *unusedPort) Write(data []byte) (int, error) {
+	port.t.Error("Expected nothing to be sent, got", data)
+	return len(data), nil
+}
+
+func (port *unusedPort) Close() error {
+	return nil
+}
+
+// a generator that panics in its own goroutine, or gcode that can't be parsed part way through, fails the job before
+// anything is sent instead of ending the program or plotting part of the drawing
+func TestRunJobGenerationFailure(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 1000
+	Settings.StartingLeftDist_MM = 600
+	Settings.StartingRightDist_MM = 600
+	Settings.StepSize_MM = 0.1
+	Settings.MaxSpeed_MM_S = 100
+	Settings.Acceleration_MM_S2 = 500
+
+	// the port opens before the job is generated, so stand in for the arduino and fail if anything is sent to it
+	defer func(saved func() (io.ReadWriteCloser, error)) { openSerialPort = saved }(openSerialPort)
+	openSerialPort = func() (io.ReadWriteCloser, error) {
+		return &unusedPort{t: t}, nil
+	}
+
+	directory, err := ioutil.TempDir("", "gocupi_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	queue := LoadJobQueue(filepath.Join(directory, "job_queue.json"))
+
+	generators := map[string]PlotJobGenerator{
+		"index out of range": func(args []string, generation *Generation) (<-chan Coordinate, error) {
+			plotCoords := make(chan Coordinate)
+			generation.Go(func() {
+				defer close(plotCoords)
+				plotCoords <- Coordinate{X: 10, Y: 10}
+				LoadImage(args[3])
+			})
+			return plotCoords, nil
+		},
+		"line 3": func(args []string, generation *Generation) (<-chan Coordinate, error) {
+			plotCoords := make(chan Coordinate)
+			generation.Go(func() {
+				reader := strings.NewReader("G0 X1 Y1 Z50\nG1 Z0\nG1 X=3\nG1 X4")
+				if err := StreamGcode(reader, GcodeOptions{PenMode: GcodePenMode{Rule: GcodePenZ50}}, 1, plotCoords); err != nil {
+					generation.Fail(err)
+				}
+			})
+			return plotCoords, nil
+		},
+	}
+	for expectedError, generator := range generators {
+		job, err := queue.Add([]string{"imagearc", "100", "5"}, "", Coordinate{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state := queue.runJob(job, generator, nil, nil); state != JobFailed {
+			t.Error("Expected the job to fail, got", state)
+		}
+		if job, _ = queue.Get(job.Id); job.State != JobFailed || !strings.Contains(job.Error, "nothing was sent") || !strings.Contains(job.Error, expectedError) {
+			t.Error("Expected the job to be marked failed with", expectedError, "got", job.State, job.Error)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package polargraph
+
+// Renders a realistic preview of a drawing, showing the ink on the paper as it will look on the wall
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Border around the spools and drawing surface in realistic previews, in mm
+const renderBorder_MM float64 = 30
+
+// Colours used for the parts of the machine in realistic previews
+var (
+	renderWallColor    = color.RGBA{210, 205, 195, 255}
+	renderPaperColor   = color.RGBA{255, 255, 255, 255}
+	renderSpoolColor   = color.RGBA{60, 60, 60, 255}
+	renderStringColor  = color.RGBA{120, 120, 120, 255}
+	renderGondolaColor = color.RGBA{200, 40, 40, 255}
+)
+
+// Coverage of each pixel from 0 to 255, shapes are combined by keeping the highest coverage so overlapping strokes don't darken
+type coverageMask struct {
+	width, height int
+	values        []uint8
+
+	// wall coordinate of the top left corner of the image
+	origin Coordinate
+
+	// resolution of the image
+	pixelsPerMM float64
+}
+
+// Create an empty mask covering the given area of the wall
+func newCoverageMask(width, height int, origin Coordinate, pixelsPerMM float64) *coverageMask {
+	return &coverageMask{width: width, height: height, values: make([]uint8, width*height), origin: origin, pixelsPerMM: pixelsPerMM}
+}
+
+// Cover a line between two wall coordinates with round ends, opacity scales the coverage from 0 to 1
+func (mask *coverageMask) Line(start, end Coordinate, width_MM, opacity float64) {
+	halfWidth := width_MM * mask.pixelsPerMM / 2
+	start = start.Minus(mask.origin).Scaled(mask.pixelsPerMM)
+	end = end.Minus(mask.origin).Scaled(mask.pixelsPerMM)
+
+	// fill the bounding box of short pieces of the line so long diagonal lines don't visit every pixel in their bounds
+	length := end.Minus(start).Len()
+	pieces := int(math.Ceil(length/4)) + 1
+	for piece := 0; piece < pieces; piece++ {
+		pieceStart := start.Add(end.Minus(start).Scaled(float64(piece) / float64(pieces)))
+		pieceEnd := start.Add(end.Minus(start).Scaled(float64(piece+1) / float64(pieces)))
+
+		minX := int(math.Max(0, math.Floor(math.Min(pieceStart.X, pieceEnd.X)-halfWidth-1)))
+		maxX := int(math.Min(float64(mask.width-1), math.Ceil(math.Max(pieceStart.X, pieceEnd.X)+halfWidth+1)))
+		minY := int(math.Max(0, math.Floor(math.Min(pieceStart.Y, pieceEnd.Y)-halfWidth-1)))
+		maxY := int(math.Min(float64(mask.height-1), math.Ceil(math.Max(pieceStart.Y, pieceEnd.Y)+halfWidth+1)))
+
+		for y := minY; y <= maxY; y++ {
+			for x := minX; x <= maxX; x++ {
+				distance := distanceToSegment(Coordinate{X: float64(x) + 0.5, Y: float64(y) + 0.5}, start, end)
+
+				// pixels partly inside the edge of the line are partly covered, which anti-aliases it
+				coverage := math.Min(1, math.Max(0, halfWidth+0.5-distance)) * opacity
+				value := uint8(coverage*255 + 0.5)
+				if index := y*mask.width + x; value > mask.values[index] {
+					mask.values[index] = value
+				}
+			}
+		}
+	}
+}
+
+// Cover a filled circle
+func (mask *coverageMask) Circle(center Coordinate, radius_MM, opacity float64) {
+	mask.Line(center, center, radius_MM*2, opacity)
+}
+
+// Cover a rectangle between two wall coordinates
+func (mask *coverageMask) Rectangle(min, max Coordinate) {
+	min = min.Minus(mask.origin).Scaled(mask.pixelsPerMM)
+	max = max.Minus(mask.origin).Scaled(mask.pixelsPerMM)
+	for y := int(math.Max(0, min.Y)); y < int(math.Min(float64(mask.height), max.Y)); y++ {
+		for x := int(math.Max(0, min.X)); x < int(math.Min(float64(mask.width), max.X)); x++ {
+			mask.values[y*mask.width+x] = 255
+		}
+	}
+}
+
+// Blend a colour into the image wherever the mask is covered
+func (mask *coverageMask) Composite(target *image.RGBA, fill color.RGBA) {
+	for y := 0; y < mask.height; y++ {
+		for x := 0; x < mask.width; x++ {
+			coverage := uint32(mask.values[y*mask.width+x])
+			if coverage == 0 {
+				continue
+			}
+			current := target.RGBAAt(x, y)
+			blend := func(from, to uint8) uint8 {
+				return uint8((uint32(from)*(255-coverage) + uint32(to)*coverage + 127) / 255)
+			}
+			target.SetRGBA(x, y, color.RGBA{blend(current.R, fill.R), blend(current.G, fill.G), blend(current.B, fill.B), 255})
+		}
+	}
+}
+
+// Distance from point to the closest point on the segment between start and end
+func distanceToSegment(point, start, end Coordinate) float64 {
+	segment := end.Minus(start)
+	lengthSquared := segment.DotProduct(segment)
+	if lengthSquared == 0 {
+		return point.Minus(start).Len()
+	}
+	along := math.Min(1, math.Max(0, point.Minus(start).DotProduct(segment)/lengthSquared))
+	return point.Minus(start.Add(segment.Scaled(along))).Len()
+}
+
+// Parse a colour written as #RRGGBB
+func parseHexColor(text string) (color.RGBA, error) {
+	text = strings.TrimPrefix(strings.TrimSpace(text), "#")
+	if len(text) != 6 {
+		return color.RGBA{}, errors.New(fmt.Sprint("Expected a colour like #RRGGBB, got ", text))
+	}
+	value, err := strconv.ParseUint(text, 16, 32)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}, nil
+}
+
+// Render coordinates as they will look on the wall, with strokes at the pen's width and colour on the drawing surface
+// along with the spools, strings and the starting position of the gondola
+func RenderRealisticImage(plotCoords <-chan Coordinate, pixelsPerMM float64) *image.RGBA {
+
+	penColor, err := parseHexColor(Settings.PenColor)
+	if err != nil {
+		panic(err)
+	}
+	penWidth := Settings.PenWidth_MM
+	if penWidth <= 0 {
+		penWidth = 0.5
+	}
+
+	// plot coordinates are relative to the starting position, everything is drawn in wall coordinates with the left spool at 0,0
+	polarSystem := PolarSystemFromSettings()
+	startingLocation := PolarCoordinate{LeftDist: Settings.StartingLeftDist_MM, RightDist: Settings.StartingRightDist_MM}.ToCoord(polarSystem)
+	if startingLocation.IsNaN() {
+		panic(fmt.Sprint("Starting location is not a valid number, setup has impossible values"))
+	}
+	rightSpool := Coordinate{X: Settings.SpoolHorizontalDistance_MM, Y: 0}
+	spoolRadius := Settings.SpoolCircumference_MM / (2 * math.Pi)
+
+	points := []Coordinate{startingLocation}
+	minPoint := Coordinate{X: 0, Y: 0}
+	maxPoint := Coordinate{X: rightSpool.X, Y: Settings.DrawingSurfaceMaxY_MM}
+	for point := range plotCoords {
+		wallPoint := point.Add(startingLocation)
+		wallPoint.PenUp = point.PenUp
+		wallPoint.PenHeight = point.PenHeight
+		points = append(points, wallPoint)
+
+		minPoint.X = math.Min(minPoint.X, wallPoint.X)
+		minPoint.Y = math.Min(minPoint.Y, wallPoint.Y)
+		maxPoint.X = math.Max(maxPoint.X, wallPoint.X)
+		maxPoint.Y = math.Max(maxPoint.Y, wallPoint.Y)
+	}
+	minPoint = minPoint.Minus(Coordinate{X: renderBorder_MM, Y: renderBorder_MM})
+	maxPoint = maxPoint.Add(Coordinate{X: renderBorder_MM, Y: renderBorder_MM})
+	size := maxPoint.Minus(minPoint).Scaled(pixelsPerMM)
+	width, height := int(math.Ceil(size.X)), int(math.Ceil(size.Y))
+
+	fmt.Println("Rendering", width, "x", height, "preview of the wall from", minPoint, "to", maxPoint)
+
+	rendered := image.NewRGBA(image.Rect(0, 0, width, height))
+	wall := newCoverageMask(width, height, minPoint, pixelsPerMM)
+	wall.Rectangle(minPoint, maxPoint)
+	wall.Composite(rendered, renderWallColor)
+
+	paper := newCoverageMask(width, height, minPoint, pixelsPerMM)
+	paper.Rectangle(Coordinate{X: Settings.DrawingSurfaceMinX_MM, Y: Settings.DrawingSurfaceMinY_MM}, Coordinate{X: Settings.DrawingSurfaceMaxX_MM, Y: Settings.DrawingSurfaceMaxY_MM})
+	paper.Composite(rendered, renderPaperColor)
+
+	// a move is drawn when the point it ends at has the pen down, lighter pressure leaves a lighter line
+	ink := newCoverageMask(width, height, minPoint, pixelsPerMM)
+	for index := 1; index < len(points); index++ {
+		if !points[index].PenUp {
+			ink.Line(points[index-1], points[index], penWidth, 1-0.6*math.Min(1, math.Max(0, points[index].PenHeight)))
+		}
+	}
+	ink.Composite(rendered, penColor)
+
+	spoolStrings := newCoverageMask(width, height, minPoint, pixelsPerMM)
+	spoolStrings.Line(Coordinate{X: 0, Y: 0}, startingLocation, 0.5, 0.7)
+	spoolStrings.Line(rightSpool, startingLocation, 0.5, 0.7)
+	spoolStrings.Composite(rendered, renderStringColor)
+
+	spools := newCoverageMask(width, height, minPoint, pixelsPerMM)
+	spools.Circle(Coordinate{X: 0, Y: 0}, spoolRadius, 1)
+	spools.Circle(rightSpool, spoolRadius, 1)
+	spools.Composite(rendered, renderSpoolColor)
+
+	gondola := newCoverageMask(width, height, minPoint, pixelsPerMM)
+	gondola.Circle(startingLocation, 15, 0.25)
+	gondola.Circle(startingLocation, 1.5, 1)
+	gondola.Composite(rendered, renderGondolaColor)
+
+	return rendered
+}
+
+// Render a realistic preview of coordinates at the resolution and in the format given by options
+func DrawRealisticImage(options OutputOptions, plotCoords <-chan Coordinate) {
+	SaveImage(options, RenderRealisticImage(plotCoords, options.PixelsPerMM))
+}
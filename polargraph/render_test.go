@@ -0,0 +1,57 @@
+package polargraph
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestRenderRealisticImage(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 200
+	Settings.SpoolCircumference_MM = 60
+	Settings.StartingLeftDist_MM = 125
+	Settings.StartingRightDist_MM = 125
+	Settings.DrawingSurfaceMinX_MM = 20
+	Settings.DrawingSurfaceMaxX_MM = 180
+	Settings.DrawingSurfaceMinY_MM = 20
+	Settings.DrawingSurfaceMaxY_MM = 180
+	Settings.PenWidth_MM = 0.75
+	Settings.PenColor = "#102030"
+
+	// starts at 100, 75 on the wall
+	plotCoords := make(chan Coordinate, 3)
+	plotCoords <- Coordinate{X: 0, Y: 0}
+	plotCoords <- Coordinate{X: 40, Y: 0}
+	plotCoords <- Coordinate{X: 40, Y: 40, PenUp: true}
+	close(plotCoords)
+
+	pixelsPerMM := 4.0
+	rendered := RenderRealisticImage(plotCoords, pixelsPerMM)
+
+	// wall coordinates to pixels, the image starts a border above and left of the left spool
+	pixel := func(x, y float64) color.RGBA {
+		return rendered.RGBAAt(int((x+renderBorder_MM)*pixelsPerMM), int((y+renderBorder_MM)*pixelsPerMM))
+	}
+
+	if size := rendered.Bounds().Size(); size.X != int((200+2*renderBorder_MM)*pixelsPerMM) || size.Y != int((180+2*renderBorder_MM)*pixelsPerMM) {
+		t.Error("Unexpected image size", size)
+	}
+	if ink := pixel(125, 75); ink != (color.RGBA{0x10, 0x20, 0x30, 255}) {
+		t.Error("Expected ink in the middle of the stroke, got", ink)
+	}
+	if edge := pixel(125, 75.25); edge == renderPaperColor || edge == (color.RGBA{0x10, 0x20, 0x30, 255}) {
+		t.Error("Expected the edge of the stroke to be anti-aliased, got", edge)
+	}
+	if paper := pixel(140, 100); paper != renderPaperColor {
+		t.Error("Expected pen up travel not to be drawn, got", paper)
+	}
+	if wall := pixel(10, 100); wall != renderWallColor {
+		t.Error("Expected wall outside the drawing surface, got", wall)
+	}
+	if spool := pixel(200, 0); spool != renderSpoolColor {
+		t.Error("Expected the right spool, got", spool)
+	}
+	if _, err := parseHexColor("blue"); err == nil {
+		t.Error("Expected an invalid colour to fail")
+	}
+}
@@ -0,0 +1,84 @@
+package polargraph
+
+// Replays step data to work out where the arduino will move the pen and how long it will take
+
+// State of the arduino after working through some amount of step data
+type StepReplay struct {
+	// Current length of each string
+	Polar PolarCoordinate
+
+	// Current pen location relative to the left motor
+	Wall Coordinate
+
+	// True while the pen is raised
+	PenUp bool
+
+	// Angle the pen servo was last moved to
+	PenAngle int
+
+	// Total time the arduino has spent on the step data so far
+	Elapsed_US float64
+
+	// Spool distances the arduino started from
+	startingPolar PolarCoordinate
+
+	// Pen delays the arduino is currently using
+	liftDelay_MS, dropDelay_MS int
+
+	polarSystem PolarSystem
+}
+
+// Create a replay starting from the location and state the arduino is in after a ResetCommand
+func NewStepReplay() *StepReplay {
+	replay := &StepReplay{
+		Polar:        PolarCoordinate{LeftDist: Settings.StartingLeftDist_MM, RightDist: Settings.StartingRightDist_MM},
+		PenUp:        true,
+		PenAngle:     Settings.PenUpAngle,
+		liftDelay_MS: DefaultPenDelay_MS,
+		dropDelay_MS: DefaultPenDelay_MS,
+		polarSystem:  PolarSystemFromSettings(),
+	}
+	replay.startingPolar = replay.Polar
+	replay.Wall = replay.Polar.ToCoord(replay.polarSystem)
+	replay.Wall.PenUp = true
+	return replay
+}
+
+// Update the state with the next frame, returns the amount of time the arduino spends on the frame
+func (replay *StepReplay) Apply(frame StepFrame) (frameTime_US float64) {
+	stepScale := Settings.StepSize_MM / StepsFixedPointFactor
+
+	if movesPen, penUp := frame.PenState(); movesPen {
+		if penUp && !replay.PenUp {
+			frameTime_US = float64(replay.liftDelay_MS) * 1000
+		} else if !penUp && replay.PenUp {
+			frameTime_US = float64(replay.dropDelay_MS) * 1000
+		}
+		replay.PenUp = penUp
+	}
+
+	switch frame.Command {
+	case PenUpCommand:
+		replay.PenAngle = Settings.PenUpAngle
+	case PenDownCommand:
+		replay.PenAngle = Settings.PenDownAngle
+	case PenHeightCommand:
+		replay.PenAngle = frame.Args[0]
+	case NoCommand:
+		replay.Polar.LeftDist -= float64(frame.Left) * stepScale
+		replay.Polar.RightDist += float64(frame.Right) * stepScale
+		frameTime_US = TimeSlice_US
+	case DwellCommand:
+		frameTime_US = float64(frame.Args[0]) * 1000
+	case PenTimingCommand:
+		replay.liftDelay_MS, replay.dropDelay_MS = frame.Args[0], frame.Args[1]
+	case SetPositionCommand:
+		replay.Polar.LeftDist = replay.startingPolar.LeftDist - float64(frame.Left)*stepScale
+		replay.Polar.RightDist = replay.startingPolar.RightDist + float64(frame.Right)*stepScale
+	}
+
+	replay.Polar.PenUp = replay.PenUp
+	replay.Wall = replay.Polar.ToCoord(replay.polarSystem)
+	replay.Elapsed_US += frameTime_US
+	return
+}
@@ -0,0 +1,148 @@
+package polargraph
+
+// Summarizes the work the arduino will do for a job
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// name of the file the json version of the report is written to
+var reportFile string = "report.json"
+
+// Breakdown of a job, distances and bounds are in wall coordinates where 0,0 is the left motor
+type JobReport struct {
+	// Number of separate pen down lines drawn
+	Strokes int
+
+	// Number of times the pen is raised
+	Lifts int
+
+	// Distance the pen travels while drawing and while raised
+	PenDownDistance_MM, PenUpDistance_MM float64
+
+	// Time spent drawing, traveling with the pen raised, waiting for the pen servo, and dwelling
+	DrawTime_S, TravelTime_S, PenTime_S, DwellTime_S float64
+
+	// Total time the job will take
+	TotalTime_S float64
+
+	// Pen width used to estimate the ink
+	PenWidth_MM float64
+
+	// Area covered with ink, pen down distance multiplied by the pen width
+	InkArea_MM2 float64
+
+	// Bounding box of all pen movement
+	MinX_MM, MinY_MM, MaxX_MM, MaxY_MM float64
+
+	// Fastest speed each spool turns at
+	PeakLeftSpeed_MM_S, PeakRightSpeed_MM_S float64
+}
+
+// Replay stepData to build a report of the job
+func BuildJobReport(stepData <-chan int8) JobReport {
+	replay := NewStepReplay()
+	report := JobReport{
+		PenWidth_MM: Settings.PenWidth_MM,
+		MinX_MM:     replay.Wall.X,
+		MinY_MM:     replay.Wall.Y,
+		MaxX_MM:     replay.Wall.X,
+		MaxY_MM:     replay.Wall.Y,
+	}
+
+	strokeStarted := false
+	for frame, ok := ReadStepFrame(stepData); ok; frame, ok = ReadStepFrame(stepData) {
+		previous := replay.Wall
+		previousPolar := replay.Polar
+		wasPenUp := replay.PenUp
+
+		frameTime_S := replay.Apply(frame) / 1000000
+
+		switch {
+		case frame.IsSlice():
+			distance := replay.Wall.Minus(previous).Len()
+			if replay.PenUp {
+				report.PenUpDistance_MM += distance
+				report.TravelTime_S += frameTime_S
+			} else {
+				report.PenDownDistance_MM += distance
+				report.DrawTime_S += frameTime_S
+				if !strokeStarted && distance > 0 {
+					strokeStarted = true
+					report.Strokes++
+				}
+			}
+
+			sliceTime_S := TimeSlice_US / 1000000
+			report.PeakLeftSpeed_MM_S = math.Max(report.PeakLeftSpeed_MM_S, math.Abs(replay.Polar.LeftDist-previousPolar.LeftDist)/sliceTime_S)
+			report.PeakRightSpeed_MM_S = math.Max(report.PeakRightSpeed_MM_S, math.Abs(replay.Polar.RightDist-previousPolar.RightDist)/sliceTime_S)
+
+		case frame.Command == DwellCommand:
+			report.DwellTime_S += frameTime_S
+
+		default:
+			report.PenTime_S += frameTime_S
+			if replay.PenUp && !wasPenUp {
+				report.Lifts++
+			} else if !replay.PenUp && wasPenUp {
+				strokeStarted = false
+			}
+		}
+
+		report.MinX_MM = math.Min(report.MinX_MM, replay.Wall.X)
+		report.MinY_MM = math.Min(report.MinY_MM, replay.Wall.Y)
+		report.MaxX_MM = math.Max(report.MaxX_MM, replay.Wall.X)
+		report.MaxY_MM = math.Max(report.MaxY_MM, replay.Wall.Y)
+	}
+
+	report.TotalTime_S = replay.Elapsed_US / 1000000
+	report.InkArea_MM2 = report.PenDownDistance_MM * report.PenWidth_MM
+	return report
+}
+
+// JobReport ToString
+func (report JobReport) String() string {
+	seconds := func(value float64) time.Duration {
+		return time.Duration(value*1000) * time.Millisecond
+	}
+
+	return fmt.Sprintf(`Strokes      %d
+Lifts        %d
+Pen Down     %.1f mm in %v
+Pen Up       %.1f mm in %v
+Pen Servo    %v
+Dwell        %v
+Total Time   %v
+Ink          %.0f mm^2 with a %.2f mm pen
+Bounds       X %.1f to %.1f mm, Y %.1f to %.1f mm
+Peak Speed   Left %.1f mm/s, Right %.1f mm/s`,
+		report.Strokes,
+		report.Lifts,
+		report.PenDownDistance_MM, seconds(report.DrawTime_S),
+		report.PenUpDistance_MM, seconds(report.TravelTime_S),
+		seconds(report.PenTime_S),
+		seconds(report.DwellTime_S),
+		seconds(report.TotalTime_S),
+		report.InkArea_MM2, report.PenWidth_MM,
+		report.MinX_MM, report.MaxX_MM, report.MinY_MM, report.MaxY_MM,
+		report.PeakLeftSpeed_MM_S, report.PeakRightSpeed_MM_S)
+}
+
+// Print a report of the job in stepData and write it as json to reportFile
+func ReportSteps(stepData <-chan int8) {
+	report := BuildJobReport(stepData)
+	fmt.Println(report)
+
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(reportFile, data, 0666); err != nil {
+		panic(err)
+	}
+	fmt.Println("Report written to", reportFile)
+}
@@ -0,0 +1,48 @@
+package polargraph
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBuildJobReport(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 1000
+	Settings.StartingLeftDist_MM = 600
+	Settings.StartingRightDist_MM = 600
+	Settings.StepSize_MM = 0.1
+	Settings.PenWidth_MM = 0.5
+
+	stepData := make(chan int8, 1024)
+	SendPenDown(stepData)
+	for i := 0; i < 10; i++ {
+		encodeSlice(-32, 32, stepData)
+	}
+	SendPenUp(stepData)
+	SendDwell(500, stepData)
+	encodeSlice(32, -32, stepData)
+	close(stepData)
+
+	report := BuildJobReport(stepData)
+
+	if report.Strokes != 1 || report.Lifts != 1 {
+		t.Error("Expected 1 stroke and 1 lift, got", report.Strokes, report.Lifts)
+	}
+	// both strings lengthen by 1mm so the pen moves straight down
+	expectedDistance := math.Sqrt(601*601-500*500) - math.Sqrt(600*600-500*500)
+	if math.Abs(report.PenDownDistance_MM-expectedDistance) > 0.001 {
+		t.Error("Expected pen down distance", expectedDistance, "got", report.PenDownDistance_MM)
+	}
+	if math.Abs(report.PenUpDistance_MM-expectedDistance/10) > 0.01 {
+		t.Error("Expected pen up distance", expectedDistance/10, "got", report.PenUpDistance_MM)
+	}
+	if report.DwellTime_S != 0.5 || report.PenTime_S != 2.5 {
+		t.Error("Expected 0.5s dwell and 2.5s of pen transitions, got", report.DwellTime_S, report.PenTime_S)
+	}
+	if math.Abs(report.PeakLeftSpeed_MM_S-0.1/(TimeSlice_US/1000000)) > 0.001 {
+		t.Error("Unexpected peak left speed", report.PeakLeftSpeed_MM_S)
+	}
+	if math.Abs(report.InkArea_MM2-expectedDistance*0.5) > 0.001 {
+		t.Error("Unexpected ink area", report.InkArea_MM2)
+	}
+}
@@ -0,0 +1,652 @@
+package polargraph
+
+// Http server that queues plot jobs and lets them be previewed, started and controlled from a browser or script
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// directory uploaded job files are saved to
+var uploadDirectory string = "uploads"
+
+// directory jobs run by the server can read files from besides uploadDirectory, for files that are too big to upload
+var jobsDirectory string = "jobs"
+
+// Placeholder in a job's args that is replaced with the path of the uploaded file
+const jobFilePlaceholder string = "{file}"
+
+// Message sent to websocket clients whenever a job changes or makes progress
+type serverMessage struct {
+	Job      PlotJob
+	Progress *PlotUpdate `json:",omitempty"`
+}
+
+// State of the plot server
+type plotServer struct {
+	mutex     sync.Mutex
+	generator PlotJobGenerator
+	queue     *JobQueue
+
+	// channel used to control the jobs being run, nil when idle
+	controls chan PlotCommand
+
+	// job that progress updates belong to
+	current PlotJob
+
+	// websocket clients waiting for messages
+	listeners map[chan []byte]bool
+
+	// when set every request must include it
+	token string
+
+	// only accept requests addressed to localhost, so other sites can't reach the server through dns rebinding
+	localOnly bool
+}
+
+// Serve the plot api on address using the jobs stored in jobQueueFile, does not return
+// when token isn't empty every request must include it, jobs can only read files in uploadDirectory and jobsDirectory
+func ServePlotJobs(address, token string, generator PlotJobGenerator) {
+	server := newPlotServer(OpenJobQueue(), generator)
+	server.token = token
+	server.localOnly = isLoopbackAddress(address)
+	InputDirectories = []string{uploadDirectory, jobsDirectory}
+
+	if !server.localOnly && token == "" {
+		fmt.Println("WARNING: Serving on", address, "without a token, anyone who can reach it can plot")
+	}
+	fmt.Println("Serving plot jobs on", address, "reading job files from", strings.Join(InputDirectories, " and "))
+	if err := http.ListenAndServe(address, server.Handler()); err != nil {
+		panic(err)
+	}
+}
+
+// True if address only listens on the loopback interface
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	return isLoopbackHost(host)
+}
+
+// True for localhost and loopback ips
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Create a server for the jobs in queue
+func newPlotServer(queue *JobQueue, generator PlotJobGenerator) *plotServer {
+	server := &plotServer{
+		generator: generator,
+		queue:     queue,
+		listeners: make(map[chan []byte]bool),
+	}
+	queue.OnChange = server.jobChanged
+	return server
+}
+
+// Routes for the api, if the server has a token it must be sent as ?token=TOKEN or an Authorization: Bearer TOKEN header
+// requests other than GET from a page on another site are rejected
+//
+//	GET  /                  browser page to submit and control jobs
+//	GET  /jobs              list all jobs
+//	POST /jobs              submit a job, multipart form with args, an optional file and optional x and y offsets in mm, use {file} in args for the file's path
+//	GET  /jobs/ID           a single job
+//	DELETE /jobs/ID         remove a job that isn't running
+//	GET  /jobs/ID/preview   png of the job
+//	POST /jobs/ID/start     start plotting the job
+//	POST /jobs/ID/retry     queue a job that failed, was aborted or interrupted again
+//	POST /start             start the oldest queued job
+//	POST /run?wait=1        plot every queued job back to back, with wait set each job waits for /resume before starting
+//	POST /pause, /resume, /abort, /nudge?x=DX&y=DY   control the running job
+//	GET  /progress          websocket of job changes and progress, text messages sent to it are treated as control commands
+func (server *plotServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleIndex)
+	mux.HandleFunc("/jobs", server.handleJobs)
+	mux.HandleFunc("/jobs/", server.handleJob)
+	mux.HandleFunc("/start", server.handleStartNext)
+	mux.HandleFunc("/run", server.handleRunQueue)
+	mux.HandleFunc("/pause", server.handleControl(PlotCommand{Action: PauseAction}))
+	mux.HandleFunc("/resume", server.handleControl(PlotCommand{Action: ResumeAction}))
+	mux.HandleFunc("/abort", server.handleControl(PlotCommand{Action: AbortAction}))
+	mux.HandleFunc("/nudge", server.handleNudge)
+	mux.HandleFunc("/progress", server.handleProgress)
+	return server.authorize(mux)
+}
+
+// Reject requests that are missing the token, are for another host, or change anything from a page on another site
+func (server *plotServer) authorize(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.localOnly {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			if !isLoopbackHost(host) {
+				http.Error(w, "Expected a request for localhost", http.StatusForbidden)
+				return
+			}
+		}
+		if server.token != "" && !server.hasToken(r) {
+			http.Error(w, "Expected the server's token as ?token=TOKEN or an Authorization: Bearer TOKEN header", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && !sameOrigin(r) {
+			http.Error(w, "Requests from other sites are not allowed", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// True if the request includes the server's token
+func (server *plotServer) hasToken(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		token = strings.TrimPrefix(bearer, "Bearer ")
+	}
+	return matchesToken(token, server.token)
+}
+
+// True if sent is the token, taking the same time however much of it matches
+func matchesToken(sent, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+// Write value as the json response
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		fmt.Println("WARNING: Unable to write response", err)
+	}
+}
+
+// GET / serves the browser page
+func (server *plotServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	io.WriteString(w, serverIndexPage)
+}
+
+// GET /jobs lists the jobs, POST /jobs submits a new one
+func (server *plotServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJson(w, server.queue.List())
+
+	case "POST":
+		job, err := server.submit(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJson(w, job)
+
+	default:
+		http.Error(w, "Expected GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// Requests for a single job
+func (server *plotServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	job, ok := server.queue.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		writeJson(w, job)
+
+	case action == "" && r.Method == "DELETE":
+		if err := server.remove(job); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "preview" && r.Method == "GET":
+		server.writePreview(w, r, job)
+
+	case action == "start" && r.Method == "POST":
+		if err := server.start(id); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		job, _ = server.queue.Get(id)
+		writeJson(w, job)
+
+	case action == "retry" && r.Method == "POST":
+		if err := server.queue.Retry(id); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		job, _ = server.queue.Get(id)
+		writeJson(w, job)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// POST /start starts the oldest queued job
+func (server *plotServer) handleStartNext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, ok := server.queue.NextQueued()
+	if !ok {
+		http.Error(w, "No jobs are queued", http.StatusConflict)
+		return
+	}
+	if err := server.start(job.Id); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	job, _ = server.queue.Get(job.Id)
+	writeJson(w, job)
+}
+
+// POST /run plots every queued job
+func (server *plotServer) handleRunQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := server.queue.NextQueued(); !ok {
+		http.Error(w, "No jobs are queued", http.StatusConflict)
+		return
+	}
+	if err := server.run(0, r.FormValue("wait") != ""); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns a handler that sends command to the running job
+func (server *plotServer) handleControl(command PlotCommand) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := server.control(command); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST /nudge?x=DX&y=DY moves the pen of a paused job
+func (server *plotServer) handleNudge(w http.ResponseWriter, r *http.Request) {
+	command, err := ParsePlotCommand(fmt.Sprint("nudge ", r.FormValue("x"), " ", r.FormValue("y")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	server.handleControl(command)(w, r)
+}
+
+// GET /progress streams messages over a websocket
+func (server *plotServer) handleProgress(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	messages := server.listen()
+	defer server.unlisten(messages)
+
+	// text sent by the client controls the running job
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		for {
+			text, err := ws.ReadText()
+			if err != nil {
+				return
+			}
+			if command, err := ParsePlotCommand(string(text)); err == nil {
+				server.control(command)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case message := <-messages:
+			if err := ws.WriteText(message); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Add a job from a multipart form with args, an optional file and optional x and y offsets
+func (server *plotServer) submit(r *http.Request) (PlotJob, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return PlotJob{}, err
+	}
+	args := strings.Fields(r.FormValue("args"))
+	if len(args) == 0 {
+		return PlotJob{}, errors.New("args is required, ie: svg 500 {file} center")
+	}
+
+	var offset Coordinate
+	for _, field := range []struct {
+		name  string
+		value *float64
+	}{{"x", &offset.X}, {"y", &offset.Y}} {
+		if text := r.FormValue(field.name); text != "" {
+			var err error
+			if *field.value, err = strconv.ParseFloat(text, 64); err != nil {
+				return PlotJob{}, errors.New(fmt.Sprint("Invalid ", field.name, " offset: ", err))
+			}
+		}
+	}
+
+	file := ""
+	upload, header, err := r.FormFile("file")
+	if err == nil {
+		defer upload.Close()
+		if file, err = saveUpload(header.Filename, upload); err != nil {
+			return PlotJob{}, err
+		}
+		for index, arg := range args {
+			args[index] = strings.Replace(arg, jobFilePlaceholder, file, -1)
+		}
+	} else if err != http.ErrMissingFile {
+		return PlotJob{}, err
+	}
+
+	job, err := server.queue.Add(args, file, offset)
+	if err != nil && file != "" {
+		os.Remove(file)
+	}
+	return job, err
+}
+
+// Save an uploaded file into uploadDirectory, returns its path
+func saveUpload(fileName string, upload io.Reader) (string, error) {
+	if err := os.MkdirAll(uploadDirectory, 0777); err != nil {
+		return "", err
+	}
+
+	// prefix the name so uploads with the same name don't replace each other
+	file, err := ioutil.TempFile(uploadDirectory, "*_"+filepath.Base(fileName))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, upload)
+	return file.Name(), err
+}
+
+// Remove a job that isn't running, along with its uploaded file
+func (server *plotServer) remove(job PlotJob) error {
+	if err := server.queue.Remove(job.Id); err != nil {
+		return err
+	}
+	if job.File != "" && filepath.Dir(job.File) == filepath.Clean(uploadDirectory) {
+		os.Remove(job.File)
+	}
+	return nil
+}
+
+// Draw a job to a png and send it
+func (server *plotServer) writePreview(w http.ResponseWriter, r *http.Request, job PlotJob) {
+	plotCoords, generation, err := generateJob(job, server.generator)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	previewFile, err := ioutil.TempFile("", "gocupi_preview")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	previewFile.Close()
+	defer os.Remove(previewFile.Name())
+
+	options := DefaultOutputOptions(previewFile.Name())
+	options.Format = "png"
+	DrawToImage(options, offsetPlotCoords(job, plotCoords))
+	if err := generation.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeFile(w, r, previewFile.Name())
+}
+
+// Start plotting a single job
+func (server *plotServer) start(id int) error {
+	job, ok := server.queue.Get(id)
+	switch {
+	case !ok:
+		return errors.New(fmt.Sprint("No job ", id))
+	case job.State != JobQueued && job.State != JobInterrupted:
+		return errors.New(fmt.Sprint("Job ", id, " is ", job.State))
+	}
+	return server.run(id, false)
+}
+
+// Run job id, or every queued job if id is 0, in the background
+func (server *plotServer) run(id int, waitBetween bool) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.controls != nil {
+		return errors.New("Jobs are already running")
+	}
+	controls := make(chan PlotCommand, 4)
+	server.controls = controls
+
+	go func() {
+		updates := make(chan PlotUpdate, 16)
+		go func() {
+			for update := range updates {
+				update := update
+				server.mutex.Lock()
+				job := server.current
+				server.mutex.Unlock()
+				server.broadcast(job, &update)
+			}
+		}()
+
+		if err := server.queue.Run(id, server.generator, waitBetween, controls, updates); err != nil {
+			fmt.Println("ERROR:", err)
+		}
+		close(updates)
+
+		server.mutex.Lock()
+		server.controls = nil
+		server.mutex.Unlock()
+	}()
+	return nil
+}
+
+// Called by the queue whenever a job changes
+func (server *plotServer) jobChanged(job PlotJob) {
+	if job.State == JobRunning || job.State == JobWaiting {
+		server.mutex.Lock()
+		server.current = job
+		server.mutex.Unlock()
+	}
+	if job.State != JobQueued {
+		fmt.Println("Job", job.Id, job.State)
+	}
+	server.broadcast(job, nil)
+}
+
+// Send a command to the running jobs
+func (server *plotServer) control(command PlotCommand) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.controls == nil {
+		return errors.New("No job is running")
+	}
+
+	select {
+	case server.controls <- command:
+		return nil
+	default:
+		return errors.New("Job is busy, try again")
+	}
+}
+
+// Register a websocket client for messages
+func (server *plotServer) listen() chan []byte {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	messages := make(chan []byte, 16)
+	server.listeners[messages] = true
+	return messages
+}
+
+// Stop sending messages to a websocket client
+func (server *plotServer) unlisten(messages chan []byte) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	delete(server.listeners, messages)
+}
+
+// Send a job change or progress update to every websocket client, clients that aren't keeping up miss messages
+func (server *plotServer) broadcast(job PlotJob, progress *PlotUpdate) {
+	message, err := json.Marshal(serverMessage{Job: job, Progress: progress})
+	if err != nil {
+		panic(err)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for listener := range server.listeners {
+		select {
+		case listener <- message:
+		default:
+		}
+	}
+}
+
+// Page served at / for controlling the server from a browser
+const serverIndexPage string = `<!DOCTYPE html>
+<html>
+<head><title>gocupi</title></head>
+<body>
+<h1>gocupi</h1>
+<form id="submit">
+	<input name="args" size="40" placeholder="svg 500 {file} center">
+	<input name="file" type="file">
+	x <input name="x" size="4" value="0"> y <input name="y" size="4" value="0">
+	<button>Queue</button>
+</form>
+<p>
+	<button onclick="post('/run?wait=1')">Run queue</button>
+	<button onclick="post('/pause')">Pause</button>
+	<button onclick="post('/resume')">Resume</button>
+	<button onclick="post('/abort')">Abort</button>
+</p>
+<pre id="progress"></pre>
+<table id="jobs"></table>
+<img id="preview">
+<script>
+// the token the page was opened with is sent with every request
+var token = new URLSearchParams(location.search).get('token') || '';
+function api(url, options) {
+	options = options || {};
+	if (token) {
+		options.headers = {'Authorization': 'Bearer ' + token};
+	}
+	return fetch(url, options);
+}
+function post(url) { return api(url, {method: 'POST'}).then(refresh); }
+// job args and errors are set as text so they can't add markup to the page
+function addButton(cell, label, onclick) {
+	var button = document.createElement('button');
+	button.textContent = label;
+	button.onclick = onclick;
+	cell.appendChild(button);
+}
+function refresh() {
+	api('/jobs').then(r => r.json()).then(jobs => {
+		var table = document.getElementById('jobs');
+		table.replaceChildren();
+		jobs.forEach(job => {
+			var row = table.insertRow();
+			row.insertCell().textContent = job.Id;
+			row.insertCell().textContent = job.Args.join(' ');
+			row.insertCell().textContent = job.State + ' ' + job.Error;
+			var actions = row.insertCell();
+			addButton(actions, 'Preview', () => document.getElementById('preview').src = '/jobs/' + job.Id + '/preview?token=' + encodeURIComponent(token));
+			addButton(actions, 'Start', () => post('/jobs/' + job.Id + '/start'));
+			addButton(actions, 'Retry', () => post('/jobs/' + job.Id + '/retry'));
+		});
+	});
+}
+document.getElementById('submit').onsubmit = function(event) {
+	event.preventDefault();
+	api('/jobs', {method: 'POST', body: new FormData(this)}).then(refresh);
+};
+var socket = new WebSocket('ws://' + location.host + '/progress?token=' + encodeURIComponent(token));
+socket.onmessage = function(event) {
+	var message = JSON.parse(event.data);
+	if (message.Progress) {
+		var p = message.Progress;
+		var done = p.Percent < 0 ? 'length unknown' : p.Percent.toFixed(1) + '% ETA ' + Math.round(p.Remaining_S) + 's';
+		document.getElementById('progress').textContent = 'Job ' + message.Job.Id + ' ' + done +
+			' Stroke ' + p.Stroke + ' X ' + p.X.toFixed(1) + ' Y ' + p.Y.toFixed(1) + (p.Paused ? ' PAUSED' : '');
+	} else {
+		refresh();
+	}
+};
+refresh();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,145 @@
+package polargraph
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPlotServerJobs(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gocupi_uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	uploadDirectory = directory
+
+	var generatedArgs []string
+	queue := LoadJobQueue(directory + "/job_queue.json")
+	server := newPlotServer(queue, func(args []string, generation *Generation) (<-chan Coordinate, error) {
+		generatedArgs = args
+		plotCoords := make(chan Coordinate, 2)
+		plotCoords <- Coordinate{X: 0, Y: 0}
+		plotCoords <- Coordinate{X: 10, Y: 10}
+		close(plotCoords)
+		return plotCoords, nil
+	})
+	handler := server.Handler()
+
+	// submit a job with a file
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("args", "svg 100 {file} center")
+	form.WriteField("x", "25")
+	fileWriter, _ := form.CreateFormFile("file", "drawing.svg")
+	fileWriter.Write([]byte("<svg></svg>"))
+	form.Close()
+
+	request := httptest.NewRequest("POST", "/jobs", body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusCreated {
+		t.Fatal("Expected job to be created, got", response.Code, response.Body.String())
+	}
+
+	var job PlotJob
+	if err := json.Unmarshal(response.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Id != 1 || job.State != JobQueued || len(job.Args) != 4 || job.Args[2] != job.File || !strings.HasPrefix(job.File, directory) || job.OffsetX_MM != 25 || job.FileHash == "" {
+		t.Error("Unexpected job", job)
+	}
+	if data, err := ioutil.ReadFile(job.File); err != nil || string(data) != "<svg></svg>" {
+		t.Error("Uploaded file was not saved", string(data), err)
+	}
+
+	// list jobs
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest("GET", "/jobs", nil))
+	var jobs []PlotJob
+	if err := json.Unmarshal(response.Body.Bytes(), &jobs); err != nil || len(jobs) != 1 || jobs[0].Id != 1 {
+		t.Error("Unexpected job list", response.Body.String(), err)
+	}
+
+	// preview uses the generator
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest("GET", "/jobs/1/preview", nil))
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "image/png" || len(generatedArgs) != 4 {
+		t.Error("Unexpected preview response", response.Code, response.Header(), generatedArgs)
+	}
+
+	// nothing is running so it can't be paused
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest("POST", "/pause", nil))
+	if response.Code != http.StatusConflict {
+		t.Error("Expected pause to fail when no job is running, got", response.Code)
+	}
+
+	// remove the job and its file
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest("DELETE", "/jobs/1", nil))
+	if response.Code != http.StatusNoContent || len(queue.List()) != 0 {
+		t.Error("Expected job to be removed, got", response.Code, queue.List())
+	}
+	if _, err := os.Stat(job.File); !os.IsNotExist(err) {
+		t.Error("Expected uploaded file to be removed")
+	}
+}
+
+func TestPlotServerAuthorization(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gocupi_uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	server := newPlotServer(LoadJobQueue(directory+"/job_queue.json"), nil)
+	server.token = "secret"
+	server.localOnly = true
+	handler := server.Handler()
+
+	tests := []struct {
+		method, url, host, origin string
+		expected                  int
+	}{
+		{"GET", "/jobs", "localhost:8080", "", http.StatusUnauthorized},
+		{"GET", "/jobs?token=wrong", "localhost:8080", "", http.StatusUnauthorized},
+		{"GET", "/jobs?token=secret", "localhost:8080", "", http.StatusOK},
+		{"GET", "/jobs?token=secret", "evil.example.com:8080", "", http.StatusForbidden},
+		{"POST", "/start?token=secret", "127.0.0.1:8080", "http://evil.example.com", http.StatusForbidden},
+		{"POST", "/start?token=secret", "127.0.0.1:8080", "http://127.0.0.1:8080", http.StatusConflict},
+		{"GET", "/progress?token=secret", "127.0.0.1:8080", "http://evil.example.com", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.url, nil)
+		request.Host = test.host
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		if test.url == "/progress?token=secret" {
+			request.Header.Set("Upgrade", "websocket")
+			request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if response.Code != test.expected {
+			t.Error(test.method, test.url, "for", test.host, "from", test.origin, "expected", test.expected, "got", response.Code)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/jobs", nil)
+	request.Host = "localhost"
+	request.Header.Set("Authorization", "Bearer secret")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Error("Expected bearer token to be accepted, got", response.Code)
+	}
+}
@@ -2,8 +2,10 @@ package polargraph
 
 import (
 	"encoding/xml"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 )
@@ -19,17 +21,26 @@ const (
 	// The factor the steps are multiplied by, needs to be the same as set in the arduino code
 	StepsFixedPointFactor float64 = 32.0
 
-	// Determined because 1 byte is sent per value, so have range -128 to 127, and -128, -127, 127 are reserved values with special meanings
+	// Determined because 1 byte is sent per value, so have range -128 to 127, with the values outside -126 to 126 reserved:
+	// -128 is ResetCommand, -127 is CommandPrefix which starts a command frame of the StepCommand followed by its arguments
+	// as two 7 bit values each, and 127 is LegacyPenDown which the arduino still accepts but is never sent
 	StepsMaxValue float64 = 126.0
 
+	// Largest value that can be sent in a wide slice when WideSteps is enabled, the encoding allows up to 8191 but the arduino can't
+	// pulse the step pins more than about 24 times in a single time slice
+	WideStepsMaxValue float64 = 768.0
+
 	// Special Steps value that when received causes the arduino to flush its buffers and reset its internal state
 	ResetCommand byte = 0x80 // -128
 
-	// Special Steps value that raises the pen
-	PenUpCommand int8 = -127
+	// Special Steps value that marks the start of a command frame, the next value is the StepCommand followed by its arguments
+	CommandPrefix int8 = -127
+
+	// Original encoding of pen down, still understood by the arduino but no longer sent
+	LegacyPenDown int8 = 127
 
-	// Special Steps value that lowers the pen
-	PenDownCommand int8 = 127
+	// Time the arduino waits for the pen to lift or drop until it is sent a PenTimingCommand, matches PENUP_COOLDOWN_US
+	DefaultPenDelay_MS int = 1250
 )
 
 // User configurable settings
@@ -67,6 +78,36 @@ type SettingsData struct {
 	// path to mouse event file, use evtest to find
 	MousePath string
 
+	// Send slices that don't fit in a single byte using the wide encoding, requires arduino code that supports it
+	WideSteps bool
+
+	// Servo angle that holds the pen off the drawing surface
+	PenUpAngle int
+
+	// Servo angle that presses the pen firmly against the drawing surface, used for Coordinate.PenHeight of 0
+	PenDownAngle int
+
+	// Servo angle where the pen only just touches the drawing surface, used for Coordinate.PenHeight of 1
+	PenLightAngle int
+
+	// Time to wait for the pen servo to lift the pen off the surface before moving
+	PenLiftDelay_MS int
+
+	// Time to wait for the pen servo to lower the pen onto the surface before drawing
+	PenDropDelay_MS int
+
+	// Start traveling this long before the lift delay has finished, since the pen is already clear of the surface near the end of the lift
+	PenLiftOverlap_MS int
+
+	// Width of the line drawn by the pen, used to estimate ink usage and by realistic previews
+	PenWidth_MM float64
+
+	// Colour of the pen's ink as #RRGGBB, used by realistic previews
+	PenColor string
+
+	// How gcode files raise and lower the pen when the gcode command isn't given a mode, and the pen codes -togcode writes, see ParseGcodePenMode
+	GcodePenMode string
+
 	// MM traveled by a single step
 	StepSize_MM float64 `xml:"-"`
 
@@ -110,21 +151,79 @@ func (settings *SettingsData) Read() {
 	if settings.Acceleration_Seconds == 0 {
 		settings.Acceleration_Seconds = 1
 	}
+	if settings.PenUpAngle == 0 && settings.PenDownAngle == 0 {
+		settings.PenUpAngle = 40
+		settings.PenDownAngle = 140
+	}
+	if settings.PenColor == "" {
+		settings.PenColor = "#000000"
+	}
+	if settings.GcodePenMode == "" {
+		settings.GcodePenMode = GcodePenZ50
+	}
+	if settings.PenLightAngle == 0 {
+		settings.PenLightAngle = settings.PenDownAngle
+	}
+
+	// the pen delays only default when they are left out, 0 is a real setting for lasers and solenoid pens
+	var delays struct {
+		PenLiftDelay_MS, PenDropDelay_MS *int
+	}
+	if err := xml.Unmarshal(fileData, &delays); err != nil {
+		panic(err)
+	}
+	if delays.PenLiftDelay_MS == nil {
+		settings.PenLiftDelay_MS = DefaultPenDelay_MS
+	}
+	if delays.PenDropDelay_MS == nil {
+		settings.PenDropDelay_MS = DefaultPenDelay_MS
+	}
+	checkPenDelay("PenLiftDelay_MS", settings.PenLiftDelay_MS)
+	checkPenDelay("PenDropDelay_MS", settings.PenDropDelay_MS)
 
 	settings.CalculateDerivedFields()
 }
 
+// Panics unless delay_MS can be sent to the arduino, so a bad setting is reported before plotting instead of part way through
+func checkPenDelay(name string, delay_MS int) {
+	if delay_MS < 0 || delay_MS > commandArgMaxValue {
+		panic(fmt.Sprint(name, " in ", settingsFile, " must be between 0 and ", commandArgMaxValue, " ms, got ", delay_MS))
+	}
+}
+
 // setup derived fields
 func (settings *SettingsData) CalculateDerivedFields() {
 	settings.DrawingSurfaceMaxX_MM = settings.SpoolHorizontalDistance_MM - settings.DrawingSurfaceMinX_MM
 	settings.StepSize_MM = (settings.SpoolSingleStep_Degrees / 360.0) * settings.SpoolCircumference_MM
 
 	stepsPerRevolution := 360.0 / settings.SpoolSingleStep_Degrees
-	stepsPerValue := StepsMaxValue / StepsFixedPointFactor
+	stepsPerValue := settings.MaxStepsPerSlice() / StepsFixedPointFactor
 	settings.MaxSpeed_MM_S = ((stepsPerValue / (TimeSlice_US / 1000000.0)) / stepsPerRevolution) * settings.SpoolCircumference_MM
 	settings.Acceleration_MM_S2 = settings.MaxSpeed_MM_S / settings.Acceleration_Seconds
 }
 
+// Largest step value that can be sent in a single time slice
+func (settings *SettingsData) MaxStepsPerSlice() float64 {
+	if settings.WideSteps {
+		return WideStepsMaxValue
+	}
+	return StepsMaxValue
+}
+
+// Servo angle for a lowered pen at the given Coordinate.PenHeight
+func (settings *SettingsData) PenAngle(penHeight float64) int {
+	penHeight = math.Min(1, math.Max(0, penHeight))
+	return int(math.Floor(float64(settings.PenDownAngle) + penHeight*float64(settings.PenLightAngle-settings.PenDownAngle) + 0.5))
+}
+
+// Time the arduino should wait after lifting the pen, which is the lift delay less the overlap with travel
+func (settings *SettingsData) PenLiftWait_MS() int {
+	if settings.PenLiftOverlap_MS >= settings.PenLiftDelay_MS {
+		return 0
+	}
+	return settings.PenLiftDelay_MS - settings.PenLiftOverlap_MS
+}
+
 // from https://gist.github.com/elazarl/5507969
 func copyFile(src, dst string) error {
 	s, err := os.Open(src)
@@ -0,0 +1,45 @@
+package polargraph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pen delays left out of the settings file default, ones set to 0 stay 0 and ones too long to send are refused
+func TestReadPenDelays(t *testing.T) {
+	defer func(saved string) { settingsFile = saved }(settingsFile)
+	directory, err := ioutil.TempDir("", "gocupi_settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	settingsFile = filepath.Join(directory, "gocupi_config.xml")
+
+	read := func(delays string) (settings SettingsData) {
+		data := "<SettingsData><SpoolSingleStep_Degrees>1.8</SpoolSingleStep_Degrees>" + delays + "</SettingsData>"
+		if err := ioutil.WriteFile(settingsFile, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		settings.Read()
+		return settings
+	}
+
+	if settings := read(""); settings.PenLiftDelay_MS != DefaultPenDelay_MS || settings.PenDropDelay_MS != DefaultPenDelay_MS {
+		t.Error("Expected missing delays to default, got", settings.PenLiftDelay_MS, settings.PenDropDelay_MS)
+	}
+	if settings := read("<PenLiftDelay_MS>0</PenLiftDelay_MS><PenDropDelay_MS>0</PenDropDelay_MS>"); settings.PenLiftDelay_MS != 0 || settings.PenDropDelay_MS != 0 {
+		t.Error("Expected delays of 0 to be kept, got", settings.PenLiftDelay_MS, settings.PenDropDelay_MS)
+	}
+	if settings := read("<PenDropDelay_MS>0</PenDropDelay_MS>"); settings.PenLiftDelay_MS != DefaultPenDelay_MS || settings.PenDropDelay_MS != 0 {
+		t.Error("Expected only the missing delay to default, got", settings.PenLiftDelay_MS, settings.PenDropDelay_MS)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a delay too long to send to the arduino to be refused")
+		}
+	}()
+	read("<PenLiftDelay_MS>10000</PenLiftDelay_MS>")
+}
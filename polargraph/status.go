@@ -0,0 +1,196 @@
+package polargraph
+
+// Decodes the status reports sent back from the arduino
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// These constants are also set in StepperDriver.ino, must be changed in both places
+const (
+	// First byte of a status report, data requests are never larger than 128 so this can't be confused with one
+	StatusHeader byte = 0xA5
+
+	// Total size of a status report including the header
+	StatusLength int = 12
+
+	// Set in StatusFlags when the pen is raised
+	StatusPenUpFlag byte = 0x01
+
+	// Set in StatusFlags when the arduino has dropped data, cleared by ResetCommand
+	StatusErrorFlag byte = 0x02
+
+	// Set in StatusFlags when the arduino code is able to decode wide slices
+	StatusWideStepsFlag byte = 0x04
+)
+
+// name of the file that status reports are logged to during a plot, each plot is added to the end as a new session
+var statusLogFile string = "status_log.json"
+
+// how long to wait for the first status report when it is required, the arduino sends one right after a reset
+var statusTimeout time.Duration = 5 * time.Second
+
+// State of the arduino as reported over serial
+type ControllerStatus struct {
+	// Time the report was received
+	Time time.Time
+
+	// Number of bytes waiting in the arduino's move buffer
+	BufferLength int
+
+	// Absolute position of each spool since the last reset, in steps multiplied by StepsFixedPointFactor
+	LeftPos, RightPos int32
+
+	// True if the pen is currently raised
+	PenUp bool
+
+	// True if the arduino has dropped data since the last reset
+	Error bool
+
+	// True if the arduino supports wide slices
+	WideSteps bool
+}
+
+// Decode a status report, frame must be StatusLength bytes long and start with StatusHeader
+func ParseControllerStatus(frame []byte) ControllerStatus {
+	if len(frame) != StatusLength || frame[0] != StatusHeader {
+		panic(fmt.Sprint("Invalid status report ", frame))
+	}
+
+	return ControllerStatus{
+		Time:         time.Now(),
+		BufferLength: int(binary.LittleEndian.Uint16(frame[1:3])),
+		LeftPos:      int32(binary.LittleEndian.Uint32(frame[3:7])),
+		RightPos:     int32(binary.LittleEndian.Uint32(frame[7:11])),
+		PenUp:        frame[11]&StatusPenUpFlag != 0,
+		Error:        frame[11]&StatusErrorFlag != 0,
+		WideSteps:    frame[11]&StatusWideStepsFlag != 0,
+	}
+}
+
+// ControllerStatus ToString
+func (status ControllerStatus) String() string {
+	pen := "DOWN"
+	if status.PenUp {
+		pen = "UP"
+	}
+	result := fmt.Sprintf("Buffer %4d  Left %9.2f mm  Right %9.2f mm  Pen %-4s", status.BufferLength, status.Spools().LeftDist, status.Spools().RightDist, pen)
+	if status.Error {
+		result += "  ERROR"
+	}
+	return result
+}
+
+// Distance each spool has moved since the last reset, using the same sign convention as GenerateSteps
+func (status ControllerStatus) Spools() PolarCoordinate {
+	stepScale := Settings.StepSize_MM / StepsFixedPointFactor
+	return PolarCoordinate{
+		LeftDist:  -float64(status.LeftPos) * stepScale,
+		RightDist: float64(status.RightPos) * stepScale,
+		PenUp:     status.PenUp,
+	}
+}
+
+// Wait for the next message from the arduino, returns either the number of bytes requested or a status report
+func readSerialMessage(reader io.Reader) (dataRequest int, status *ControllerStatus) {
+	dataRequest, status, err := nextSerialMessage(reader)
+	if err != nil {
+		panic(err)
+	}
+	return dataRequest, status
+}
+
+// Same as readSerialMessage, but returns read errors instead of panicking
+func nextSerialMessage(reader io.Reader) (dataRequest int, status *ControllerStatus, err error) {
+
+	frame := make([]byte, StatusLength)
+	if _, err := io.ReadFull(reader, frame[:1]); err != nil {
+		return 0, nil, err
+	}
+
+	if frame[0] != StatusHeader {
+		return int(frame[0]), nil, nil
+	}
+
+	if _, err := io.ReadFull(reader, frame[1:]); err != nil {
+		return 0, nil, err
+	}
+	parsed := ParseControllerStatus(frame)
+	return 0, &parsed, nil
+}
+
+// Wait for the first status report from the arduino, any data requests that arrive before it are totalled in requested
+// so they can be answered afterwards. Older arduino code never sends a status, so give up with an error after timeout
+func waitForStatus(reader io.Reader, timeout time.Duration) (status ControllerStatus, requested int, err error) {
+
+	type message struct {
+		requested int
+		status    *ControllerStatus
+		err       error
+	}
+
+	// the read can't be interrupted, so it is left to finish when the caller closes the reader
+	messages := make(chan message, 1)
+	go func() {
+		total := 0
+		for {
+			dataRequest, status, err := nextSerialMessage(reader)
+			total += dataRequest
+			if status != nil || err != nil {
+				messages <- message{total, status, err}
+				return
+			}
+		}
+	}()
+
+	select {
+	case result := <-messages:
+		if result.err != nil {
+			return ControllerStatus{}, 0, result.err
+		}
+		return *result.status, result.requested, nil
+	case <-time.After(timeout):
+		return ControllerStatus{}, 0, fmt.Errorf("no status report from the arduino after %v", timeout)
+	}
+}
+
+// Writes each status report received as a line of json
+type statusLogger struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// First line logged for each plot, so the reports of one plot can be told apart from the next
+type statusLogSession struct {
+	SessionStarted time.Time
+}
+
+// Open the status log file and start a new session at the end of it, keeping the reports of earlier plots
+func newStatusLogger(fileName string) *statusLogger {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	logger := &statusLogger{file: file, encoder: json.NewEncoder(file)}
+	if err := logger.encoder.Encode(statusLogSession{SessionStarted: time.Now()}); err != nil {
+		panic(err)
+	}
+	return logger
+}
+
+// Append a status report to the log
+func (logger *statusLogger) Log(status ControllerStatus) {
+	if err := logger.encoder.Encode(status); err != nil {
+		panic(err)
+	}
+}
+
+// Close the log file
+func (logger *statusLogger) Close() {
+	logger.file.Close()
+}
@@ -0,0 +1,99 @@
+package polargraph
+
+// Tests for decoding status reports
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ParseControllerStatus should decode each field of the frame
+func TestParseControllerStatus(t *testing.T) {
+	frame := []byte{StatusHeader, 0x00, 0x02, 0x40, 0x00, 0x00, 0x00, 0xC0, 0xFF, 0xFF, 0xFF, StatusPenUpFlag | StatusErrorFlag}
+
+	status := ParseControllerStatus(frame)
+	if status.BufferLength != 512 {
+		t.Error("Unexpected value for BufferLength", status.BufferLength)
+	}
+	if status.LeftPos != 64 {
+		t.Error("Unexpected value for LeftPos", status.LeftPos)
+	}
+	if status.RightPos != -64 {
+		t.Error("Unexpected value for RightPos", status.RightPos)
+	}
+	if !status.PenUp || !status.Error {
+		t.Error("Unexpected flags", status.PenUp, status.Error)
+	}
+}
+
+// readSerialMessage should tell data requests and status reports apart
+func TestReadSerialMessage(t *testing.T) {
+	data := []byte{128, StatusHeader, 0x10, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 128}
+	reader := bytes.NewReader(data)
+
+	if request, status := readSerialMessage(reader); request != 128 || status != nil {
+		t.Error("Expected data request", request, status)
+	}
+	if request, status := readSerialMessage(reader); request != 0 || status == nil || status.BufferLength != 16 || status.PenUp {
+		t.Error("Expected status report", request, status)
+	}
+	if request, status := readSerialMessage(reader); request != 128 || status != nil {
+		t.Error("Expected data request", request, status)
+	}
+}
+
+// waitForStatus should hold on to data requests that arrive before the status and give up if none arrives
+func TestWaitForStatus(t *testing.T) {
+	data := []byte{128, 128, StatusHeader, 0x10, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, StatusWideStepsFlag}
+	status, requested, err := waitForStatus(bytes.NewReader(data), time.Second)
+	if err != nil || requested != 256 || !status.WideSteps || status.BufferLength != 16 {
+		t.Error("Expected status after two data requests", status, requested, err)
+	}
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go writer.Write([]byte{128})
+	if _, _, err := waitForStatus(reader, 10*time.Millisecond); err == nil {
+		t.Error("Expected timeout without a status report")
+	}
+}
+
+// each plot starts a new session at the end of the log, keeping the reports of earlier plots
+func TestStatusLoggerAppends(t *testing.T) {
+	fileName := filepath.Join(os.TempDir(), "gocupi_test_status_log.json")
+	os.Remove(fileName)
+	defer os.Remove(fileName)
+
+	for job := 0; job < 2; job++ {
+		logger := newStatusLogger(fileName)
+		logger.Log(ControllerStatus{BufferLength: job})
+		logger.Close()
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sessions, reports := 0, 0
+	for lines := bufio.NewScanner(file); lines.Scan(); {
+		var line map[string]interface{}
+		if err := json.Unmarshal(lines.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := line["SessionStarted"]; ok {
+			sessions++
+		} else if line["BufferLength"] == float64(reports) {
+			reports++
+		}
+	}
+	if sessions != 2 || reports != 2 {
+		t.Error("Expected 2 sessions each with their report, got", sessions, "sessions and", reports, "reports")
+	}
+}
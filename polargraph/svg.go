@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -215,12 +214,13 @@ func (this *PathParser) ReadCoord(penUp bool) {
 	this.coordinates = append(this.coordinates, this.currentPosition.ScaledBoth(this.scaleX, this.scaleY))
 }
 
-// read a file
+// read a file, or stdin when fileName is -
 func ParseSvgFile(fileName string) (data []Coordinate) {
-	file, err := os.Open(fileName)
+	file, err := OpenInput(fileName)
 	if err != nil {
 		panic(err)
 	}
+	defer file.Close()
 
 	return ParseSvg(file)
 }
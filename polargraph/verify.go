@@ -0,0 +1,178 @@
+package polargraph
+
+// Compares the path the arduino will draw from the generated step data against the path that was asked for
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// Colours used by step accurate previews
+var (
+	verifyIntendedColor  = color.RGBA{150, 190, 255, 255}
+	verifyTravelColor    = color.RGBA{215, 215, 215, 255}
+	verifyReplayedColor  = color.RGBA{0, 0, 0, 255}
+	verifyDeviationColor = color.RGBA{230, 0, 0, 255}
+)
+
+// Summary of how far the replayed steps strayed from the intended path
+type StepDeviation struct {
+	// Largest distance of a replayed point from the intended path
+	Max_MM float64
+
+	// Number of replayed points further than the tolerance from the intended path
+	Count int
+
+	// Number of replayed points compared
+	Points int
+}
+
+// StepDeviation ToString
+func (deviation StepDeviation) String() string {
+	return fmt.Sprintf("Max deviation %.3f mm, %d of %d replayed points beyond tolerance", deviation.Max_MM, deviation.Count, deviation.Points)
+}
+
+// Distance of each replayed point from the intended path, both in wall coordinates
+// segments holds the index of the intended segment each point's steps were generated for, a drawing can cross or retrace
+// itself so each point is only compared against its own segment and the ones either side of it
+func measureDeviations(intended []Coordinate, replayed []animationPoint, segments []int) []float64 {
+	distances := make([]float64, len(replayed))
+	for index, point := range replayed {
+		if len(intended) < 2 {
+			distances[index] = point.Wall.Minus(intended[0]).Len()
+			continue
+		}
+
+		distances[index] = math.Inf(1)
+		for candidate := segments[index] - 1; candidate <= segments[index]+1; candidate++ {
+			if candidate < 0 || candidate >= len(intended)-1 {
+				continue
+			}
+			distances[index] = math.Min(distances[index], distanceToSegment(point.Wall, intended[candidate], intended[candidate+1]))
+		}
+	}
+	return distances
+}
+
+// Generate the steps for plotCoords, replay them the way the arduino would and draw the result over the intended path
+// replayed points further than tolerance_MM from the intended path are highlighted
+func DrawStepAccurateImage(options OutputOptions, tolerance_MM float64, plotCoords <-chan Coordinate) StepDeviation {
+
+	polarSystem := PolarSystemFromSettings()
+	startingLocation := PolarCoordinate{LeftDist: Settings.StartingLeftDist_MM, RightDist: Settings.StartingRightDist_MM}.ToCoord(polarSystem)
+
+	// keep the intended path in wall coordinates while the coordinates are turned into steps
+	intended := []Coordinate{startingLocation}
+	intendedPenUp := []bool{true}
+	intendedDone := make(chan bool)
+	stepCoords := make(chan Coordinate, 1024)
+	go func() {
+		defer close(intendedDone)
+		defer close(stepCoords)
+		for coord := range plotCoords {
+			wallCoord := coord.Add(startingLocation)
+			intended = append(intended, wallCoord)
+			intendedPenUp = append(intendedPenUp, coord.PenUp)
+			stepCoords <- coord
+		}
+	}()
+
+	// the generator reports each coordinate it starts on over an unbuffered channel, as the steps are unbuffered too the
+	// reports arrive in order with the steps, giving the position in the step data where each coordinate's steps begin
+	generated := make(chan int8)
+	targets := make(chan int)
+	go generateSteps(stepCoords, generated, func(target int) { targets <- target })
+
+	var targetOffsets []int
+	stepData := make(chan int8, 1024)
+	go func() {
+		defer close(stepData)
+		offset := 0
+		for {
+			select {
+			case step, ok := <-generated:
+				if !ok {
+					return
+				}
+				stepData <- step
+				offset++
+			case <-targets:
+				targetOffsets = append(targetOffsets, offset)
+			}
+		}
+	}()
+	replayed := replayAnimationPoints(stepData, 0.5/options.PixelsPerMM)
+	<-intendedDone
+
+	// the steps of coordinate n move along intended segment n, from intended[n] to intended[n+1]
+	segments := make([]int, len(replayed))
+	for index, point := range replayed {
+		segments[index] = sort.Search(len(targetOffsets), func(target int) bool { return targetOffsets[target] > point.Offset }) - 1
+	}
+
+	distances := measureDeviations(intended, replayed, segments)
+	deviation := StepDeviation{Points: len(replayed)}
+	for _, distance := range distances {
+		deviation.Max_MM = math.Max(deviation.Max_MM, distance)
+		if distance > tolerance_MM {
+			deviation.Count++
+		}
+	}
+
+	// size the image to fit both paths
+	minPoint := Coordinate{X: math.Inf(1), Y: math.Inf(1)}
+	maxPoint := Coordinate{X: math.Inf(-1), Y: math.Inf(-1)}
+	extend := func(point Coordinate) {
+		minPoint.X = math.Min(minPoint.X, point.X)
+		minPoint.Y = math.Min(minPoint.Y, point.Y)
+		maxPoint.X = math.Max(maxPoint.X, point.X)
+		maxPoint.Y = math.Max(maxPoint.Y, point.Y)
+	}
+	for _, point := range intended {
+		extend(point)
+	}
+	for _, point := range replayed {
+		extend(point.Wall)
+	}
+	border := Coordinate{X: 12.5, Y: 12.5}
+	minPoint, maxPoint = minPoint.Minus(border), maxPoint.Add(border)
+	size := maxPoint.Minus(minPoint).Scaled(options.PixelsPerMM)
+	width, height := int(math.Ceil(size.X)), int(math.Ceil(size.Y))
+
+	rendered := image.NewRGBA(image.Rect(0, 0, width, height))
+	paper := newCoverageMask(width, height, minPoint, options.PixelsPerMM)
+	paper.Rectangle(minPoint, maxPoint)
+	paper.Composite(rendered, renderPaperColor)
+
+	// the intended path is drawn wide underneath so the replayed path shows up on top of it
+	pixelWidth := 1 / options.PixelsPerMM
+	travel := newCoverageMask(width, height, minPoint, options.PixelsPerMM)
+	intendedStrokes := newCoverageMask(width, height, minPoint, options.PixelsPerMM)
+	for index := 1; index < len(intended); index++ {
+		if intendedPenUp[index] {
+			travel.Line(intended[index-1], intended[index], pixelWidth*3, 1)
+		} else {
+			intendedStrokes.Line(intended[index-1], intended[index], pixelWidth*4, 1)
+		}
+	}
+	travel.Composite(rendered, verifyTravelColor)
+	intendedStrokes.Composite(rendered, verifyIntendedColor)
+
+	replayedPath := newCoverageMask(width, height, minPoint, options.PixelsPerMM)
+	deviations := newCoverageMask(width, height, minPoint, options.PixelsPerMM)
+	for index := 1; index < len(replayed); index++ {
+		replayedPath.Line(replayed[index-1].Wall, replayed[index].Wall, pixelWidth, 1)
+		if distances[index] > tolerance_MM {
+			deviations.Circle(replayed[index].Wall, math.Max(pixelWidth*3, tolerance_MM), 1)
+		}
+	}
+	deviations.Composite(rendered, verifyDeviationColor)
+	replayedPath.Composite(rendered, verifyReplayedColor)
+
+	SaveImage(options, rendered)
+	fmt.Println(deviation)
+	return deviation
+}
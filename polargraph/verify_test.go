@@ -0,0 +1,78 @@
+package polargraph
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeasureDeviations(t *testing.T) {
+	intended := []Coordinate{{X: 0, Y: 0}, {X: 10, Y: 0}, {X: 10, Y: 10}}
+	replayed := []animationPoint{
+		{Wall: Coordinate{X: 0, Y: 0}},
+		{Wall: Coordinate{X: 5, Y: 0.2}},
+		{Wall: Coordinate{X: 10.5, Y: 5}},
+		{Wall: Coordinate{X: 10, Y: 10}},
+	}
+
+	expected := []float64{0, 0.2, 0.5, 0}
+	for index, distance := range measureDeviations(intended, replayed, []int{0, 0, 1, 1}) {
+		if math.Abs(distance-expected[index]) > 0.0001 {
+			t.Error("Expected point", index, "to be", expected[index], "from the path, got", distance)
+		}
+	}
+}
+
+func TestDrawStepAccurateImage(t *testing.T) {
+	defer func(saved SettingsData) { Settings = saved }(Settings)
+	Settings.SpoolHorizontalDistance_MM = 1000
+	Settings.StartingLeftDist_MM = 600
+	Settings.StartingRightDist_MM = 600
+	Settings.StepSize_MM = 0.1
+	Settings.MaxSpeed_MM_S = 100
+	Settings.Acceleration_MM_S2 = 500
+	Settings.DrawingSurfaceMinX_MM = 0
+	Settings.DrawingSurfaceMaxX_MM = 1000
+	Settings.DrawingSurfaceMinY_MM = 0
+	Settings.DrawingSurfaceMaxY_MM = 1000
+
+	directory, err := ioutil.TempDir("", "gocupi_verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	square := func() <-chan Coordinate {
+		plotCoords := make(chan Coordinate, 5)
+		plotCoords <- Coordinate{X: 0, Y: 0}
+		plotCoords <- Coordinate{X: 20, Y: 0}
+		plotCoords <- Coordinate{X: 20, Y: 20}
+		plotCoords <- Coordinate{X: 0, Y: 20}
+		plotCoords <- Coordinate{X: 0, Y: 0, PenUp: true}
+		close(plotCoords)
+		return plotCoords
+	}
+
+	options := DefaultOutputOptions(filepath.Join(directory, "steps.png"))
+	deviation := DrawStepAccurateImage(options, 0.5, square())
+	if deviation.Points == 0 || deviation.Count != 0 || deviation.Max_MM > 0.5 {
+		t.Error("Expected the steps to follow the square within tolerance, got", deviation)
+	}
+	if _, err := os.Stat(options.FileName); err != nil {
+		t.Error("Expected the image to be written", err)
+	}
+
+	// a grid crosses and retraces its own lines, each point must still be measured against the line it was drawn for
+	grid := make(chan Coordinate, 1024)
+	go GenerateGrid(Grid{Width: 50, Cells: 5}, grid)
+	if deviation := DrawStepAccurateImage(options, 0.5, grid); deviation.Count != 0 || deviation.Max_MM > 0.5 {
+		t.Error("Expected the steps to follow the grid within tolerance, got", deviation)
+	}
+
+	// a tolerance below the step size flags the quantisation of the steps
+	if deviation := DrawStepAccurateImage(options, 0.00001, square()); deviation.Count == 0 {
+		t.Error("Expected deviations beyond a tiny tolerance, got", deviation)
+	}
+}
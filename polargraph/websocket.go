@@ -0,0 +1,182 @@
+package polargraph
+
+// Minimal websocket support, enough to stream text messages to a browser and read text messages back
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Appended to the client's key when calculating the accept key, defined by RFC 6455
+const websocketGUID string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Websocket frame opcodes
+const (
+	websocketText  byte = 0x1
+	websocketClose byte = 0x8
+	websocketPing  byte = 0x9
+	websocketPong  byte = 0xA
+)
+
+// Largest message that will be read from a client
+const websocketMaxMessage uint64 = 4096
+
+// An open websocket connection
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Calculate the Sec-WebSocket-Accept value for a client's Sec-WebSocket-Key
+func websocketAcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Complete the websocket handshake and take over the connection from the http server
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "Expected a websocket upgrade request", http.StatusBadRequest)
+		return nil, errors.New("Not a websocket upgrade request")
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "Websockets from other sites are not allowed", http.StatusForbidden)
+		return nil, errors.New("Websocket from another origin")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Websockets are not supported", http.StatusInternalServerError)
+		return nil, errors.New("Connection can't be hijacked")
+	}
+	conn, readWriter, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{conn: conn, reader: readWriter.Reader}, nil
+}
+
+// True unless the request came from a browser page on another site, clients that aren't browsers don't send an Origin
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	originUrl, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(originUrl.Host, r.Host)
+}
+
+// Encode a single unmasked frame, servers never mask the frames they send
+func encodeWebsocketFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	return append(frame, payload...)
+}
+
+// Read a single frame, unmasking the payload if the client masked it
+func readWebsocketFrame(reader io.Reader) (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err = io.ReadFull(reader, extended); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err = io.ReadFull(reader, extended); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > websocketMaxMessage {
+		return opcode, nil, errors.New("Websocket message is too large")
+	}
+
+	mask := make([]byte, 4)
+	if masked {
+		if _, err = io.ReadFull(reader, mask); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		return
+	}
+	for index := range payload {
+		payload[index] ^= mask[index%4]
+	}
+	return
+}
+
+// Send a text message
+func (ws *websocketConn) WriteText(message []byte) error {
+	_, err := ws.conn.Write(encodeWebsocketFrame(websocketText, message))
+	return err
+}
+
+// Read the next text message, answering pings and returning an error once the connection is closed
+func (ws *websocketConn) ReadText() ([]byte, error) {
+	for {
+		opcode, payload, err := readWebsocketFrame(ws.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case websocketText:
+			return payload, nil
+		case websocketPing:
+			if _, err := ws.conn.Write(encodeWebsocketFrame(websocketPong, payload)); err != nil {
+				return nil, err
+			}
+		case websocketClose:
+			ws.conn.Write(encodeWebsocketFrame(websocketClose, nil))
+			return nil, io.EOF
+		}
+	}
+}
+
+// Close the connection
+func (ws *websocketConn) Close() {
+	ws.conn.Close()
+}
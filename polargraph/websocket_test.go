@@ -0,0 +1,29 @@
+package polargraph
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWebsocketAcceptKey(t *testing.T) {
+	// example from RFC 6455
+	if accept := websocketAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error("Unexpected accept key", accept)
+	}
+}
+
+func TestWebsocketFrame(t *testing.T) {
+	for _, length := range []int{0, 5, 125, 126, 1000} {
+		payload := bytes.Repeat([]byte{'a'}, length)
+		opcode, decoded, err := readWebsocketFrame(bytes.NewReader(encodeWebsocketFrame(websocketText, payload)))
+		if err != nil || opcode != websocketText || !bytes.Equal(decoded, payload) {
+			t.Error("Frame of length", length, "did not round trip", opcode, len(decoded), err)
+		}
+	}
+
+	// masked "Hello" from RFC 6455
+	masked := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	if opcode, decoded, err := readWebsocketFrame(bytes.NewReader(masked)); err != nil || opcode != websocketText || string(decoded) != "Hello" {
+		t.Error("Unable to read masked frame", opcode, string(decoded), err)
+	}
+}